@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli/v2"
+)
+
+// statements starting with one of these keywords cannot change anything, query only audits the others
+var readOnlyQueryRegexp = regexp.MustCompile(`(?i)^(SELECT|WITH|SHOW|DESCRIBE|DESC|EXPLAIN|EXISTS)\b`)
+
+// auditEntry is one line of the --audit-log file
+type auditEntry struct {
+	Time     string   `json:"time"`
+	User     string   `json:"user"`
+	Command  string   `json:"command"`
+	Args     []string `json:"args"`
+	Database string   `json:"database"`
+	Profile  string   `json:"profile,omitempty"`
+	Outcome  string   `json:"outcome"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// audited wraps the action of a command that changes the database, appending its outcome to the audit log
+func audited(action cli.ActionFunc) cli.ActionFunc {
+	return auditedIf(nil, action)
+}
+
+// auditedIf is audited for commands that only sometimes change the database, as decided by mutates
+func auditedIf(mutates func(c *cli.Context) bool, action cli.ActionFunc) cli.ActionFunc {
+	return func(c *cli.Context) error {
+		err := action(c)
+
+		path := c.String("audit-log")
+		if path == "" {
+			path = os.Getenv("LOGME_AUDIT_LOG")
+		}
+		if path == "" || (mutates != nil && !mutates(c)) {
+			return err
+		}
+
+		if auditErr := appendAudit(path, c, err); auditErr != nil {
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "warning: "+auditErr.Error())
+				return err
+			}
+			return auditErr
+		}
+
+		return err
+	}
+}
+
+// appendAudit appends the entry of the command, one per database when migrate ran against each of DB_DATABASES with
+// the outcome of that database
+func appendAudit(path string, c *cli.Context, commandErr error) error {
+	var lines []byte
+	for _, database := range auditDatabases(c) {
+		entry := auditEntry{
+			Time:     time.Now().UTC().Format(time.RFC3339),
+			User:     currentUser(),
+			Command:  c.Command.Name,
+			Args:     os.Args[1:],
+			Database: database,
+			Profile:  os.Getenv("LOGME_PROFILE"),
+			Outcome:  "success",
+		}
+		if err := databaseErr(commandErr, database); err != nil {
+			entry.Outcome = "failure"
+			entry.Error = err.Error()
+		}
+
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	// append only, entries from earlier runs are never rewritten
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+	if _, err := file.Write(lines); err != nil {
+		file.Close()
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+
+	return file.Close()
+}
+
+// auditDatabases returns the databases the command ran against: each of DB_DATABASES for migrate, see
+// migrateTargets, otherwise the one of auditIsTest
+func auditDatabases(c *cli.Context) []string {
+	isTest := auditIsTest(c)
+
+	databases := targetDatabases()
+	if (c.Command.Name != "migrate" && c.Command.Name != "migrate-test") || len(databases) == 0 {
+		return []string{getDbName(isTest)}
+	}
+
+	names := make([]string, len(databases))
+	for i, database := range databases {
+		names[i] = targetDbName(database, isTest)
+	}
+	return names
+}
+
+// databaseErr is the error of the command for database, only its own when the databases of DB_DATABASES failed
+// separately
+func databaseErr(commandErr error, database string) error {
+	var failures *databasesError
+	if errors.As(commandErr, &failures) {
+		return failures.failed[database]
+	}
+	return commandErr
+}
+
+// auditIsTest tells whether the command ran against the test database. Most commands pick it with --test, the snapshot
+// commands use it unless given --main
+func auditIsTest(c *cli.Context) bool {
+	switch c.Command.Name {
+	case "migrate-test":
+		return true
+	case "snapshot:create", "snapshot:restore":
+		return !c.Bool("main")
+	}
+	return c.Bool("test")
+}
+
+func currentUser() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// migrateMutates leaves migrate --print-sql-only and --check-syntax out of the log, they change nothing
+func migrateMutates(c *cli.Context) bool {
+	return !c.Bool("print-sql-only") && !c.Bool("check-syntax")
+}
+
+// queryMutates reports whether the statement given to query could change data, so reads are left out of the log
+func queryMutates(c *cli.Context) bool {
+	if c.Bool("explain") {
+		return false
+	}
+
+	sql := strings.Join(c.Args().Slice(), " ")
+	if file := c.String("file"); file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return true
+		}
+		sql = string(content)
+	}
+
+	return !readOnlyQueryRegexp.MatchString(stripLeadingComments(sql))
+}
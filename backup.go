@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+var (
+	dropTableRegexp       = regexp.MustCompile(`(?is)^DROP\s+TABLE\s+(?:IF\s+EXISTS\s+)?([^\s;]+)`)
+	alterDropColumnRegexp = regexp.MustCompile(`(?is)^ALTER\s+TABLE\s+([^\s;]+).*\bDROP\s+COLUMN\b`)
+)
+
+// notBackupTable is a system.tables condition leaving out the tables made by backupTables
+const notBackupTable = `NOT match(name, '_backup_[0-9]{14}(_[0-9]+)?$')`
+
+// destructiveTables lists the tables a migration drops or drops columns from, in statement order
+func destructiveTables(sql string) []string {
+	var tables []string
+	seen := map[string]bool{}
+	for _, statement := range splitStatements(sql) {
+		code := stripLeadingComments(statement)
+		match := dropTableRegexp.FindStringSubmatch(code)
+		if match == nil {
+			match = alterDropColumnRegexp.FindStringSubmatch(code)
+		}
+		if match == nil {
+			continue
+		}
+		table := strings.ReplaceAll(match[1], "`", "")
+		if !seen[table] {
+			seen[table] = true
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// backupTables copies each table about to be dropped or altered into <table>_backup_<timestamp>, in the same
+// database, tables that do not exist (yet) are skipped. A backup made in the same second, by an earlier migration of
+// the run, is kept and the new one numbered <table>_backup_<timestamp>_2 and so on
+func backupTables(ctx context.Context, out io.Writer, db driver.Conn, tables []string) error {
+	suffix := "_backup_" + time.Now().UTC().Format("20060102150405")
+
+	for _, table := range tables {
+		var exists uint8
+		if err := db.QueryRow(ctx, "EXISTS TABLE "+table).Scan(&exists); err != nil {
+			return err
+		}
+		if exists != 1 {
+			continue
+		}
+
+		backup, err := freeBackupName(ctx, db, table+suffix)
+		if err != nil {
+			return err
+		}
+		if err := db.Exec(ctx, fmt.Sprintf("CREATE TABLE %s AS %s", backup, table)); err != nil {
+			return fmt.Errorf("backing up %s: %w", table, err)
+		}
+		if err := db.Exec(ctx, fmt.Sprintf("INSERT INTO %s SELECT * FROM %s", backup, table)); err != nil {
+			return fmt.Errorf("backing up %s: %w", table, err)
+		}
+		fmt.Fprintln(out, "Backed up "+table+" to "+backup)
+	}
+
+	return nil
+}
+
+// freeBackupName returns name, or name with the first counter from 2 that no table has
+func freeBackupName(ctx context.Context, db driver.Conn, name string) (string, error) {
+	candidate := name
+	for n := 2; ; n++ {
+		var exists uint8
+		if err := db.QueryRow(ctx, "EXISTS TABLE "+candidate).Scan(&exists); err != nil {
+			return "", err
+		}
+		if exists != 1 {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s_%d", name, n)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// tableConn is a driver.Conn answering EXISTS TABLE from its tables, CREATE TABLE adds to them, and recording every
+// statement executed
+type tableConn struct {
+	driver.Conn
+	tables map[string]bool
+	execs  []string
+}
+
+func (c *tableConn) QueryRow(ctx context.Context, sql string, args ...interface{}) driver.Row {
+	return existsRow(c.tables[strings.TrimPrefix(sql, "EXISTS TABLE ")])
+}
+
+func (c *tableConn) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	c.execs = append(c.execs, sql)
+	if fields := strings.Fields(sql); len(fields) > 2 && fields[0] == "CREATE" {
+		c.tables[fields[2]] = true
+	}
+	return nil
+}
+
+type existsRow bool
+
+func (r existsRow) Err() error { return nil }
+func (r existsRow) Scan(dest ...interface{}) error {
+	*dest[0].(*uint8) = 0
+	if r {
+		*dest[0].(*uint8) = 1
+	}
+	return nil
+}
+func (r existsRow) ScanStruct(dest interface{}) error { return nil }
+
+func TestDestructiveTables(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"no destructive statement", "CREATE TABLE a (id UInt64) ENGINE = MergeTree ORDER BY id;\nALTER TABLE a ADD COLUMN b String;", nil},
+		{"drop table", "DROP TABLE IF EXISTS `events`;", []string{"events"}},
+		{"drop column", "-- no longer read\nALTER TABLE logme.events DROP COLUMN b;", []string{"logme.events"}},
+		{"each table once, in statement order", "ALTER TABLE b DROP COLUMN x;\nDROP TABLE a;\nALTER TABLE b DROP COLUMN y;", []string{"b", "a"}},
+	}
+
+	for _, test := range tests {
+		if got := destructiveTables(test.sql); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: destructiveTables() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBackupTablesInTheSameSecond(t *testing.T) {
+	db := &tableConn{tables: map[string]bool{"events": true}}
+	ctx := context.Background()
+
+	// two migrations of one run dropping columns of the same table, within a second
+	if err := backupTables(ctx, io.Discard, db, []string{"events", "missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backupTables(ctx, io.Discard, db, []string{"events"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var creates []string
+	for _, sql := range db.execs {
+		if strings.HasPrefix(sql, "CREATE") {
+			creates = append(creates, sql)
+		}
+	}
+	if len(creates) != 2 {
+		t.Fatalf("created %q, want two backups of events", creates)
+	}
+
+	first := strings.Fields(creates[0])[2]
+	if !regexp.MustCompile(`^events_backup_[0-9]{14}$`).MatchString(first) {
+		t.Errorf("first backup = %s, want events_backup_<timestamp>", first)
+	}
+	second := strings.Fields(creates[1])[2]
+	// the second may land in the next second, then it needs no counter
+	if second == first || !regexp.MustCompile(`^events_backup_[0-9]{14}(_2)?$`).MatchString(second) {
+		t.Errorf("second backup = %s, want a new name after %s", second, first)
+	}
+}
+
+func TestNotBackupTableMatchesNumberedBackups(t *testing.T) {
+	pattern := regexp.MustCompile(`_backup_[0-9]{14}(_[0-9]+)?$`)
+	if !strings.Contains(notBackupTable, pattern.String()) {
+		t.Fatalf("notBackupTable = %s, want it to use %s", notBackupTable, pattern)
+	}
+
+	for name, want := range map[string]bool{
+		"events_backup_20260101120000":   true,
+		"events_backup_20260101120000_2": true,
+		"events":                         false,
+		"events_backup":                  false,
+	} {
+		if got := pattern.MatchString(name); got != want {
+			t.Errorf("backup(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
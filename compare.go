@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/joho/godotenv"
+)
+
+const (
+	colorRed   = "\033[31m"
+	colorGreen = "\033[32m"
+	colorReset = "\033[0m"
+)
+
+// schemaSide is one of the databases compared by schema:compare, profile selects the .env.<profile> connection
+// settings when the databases are on different servers
+type schemaSide struct {
+	database string
+	profile  string
+}
+
+// schemaCompare prints a diff of the tables of two databases, one CREATE statement per table with a line per column,
+// and fails when they differ
+func schemaCompare(out io.Writer, source schemaSide, target schemaSide, color string) error {
+	useColor, err := colorEnabled(out, color)
+	if err != nil {
+		return err
+	}
+
+	if source == target {
+		return configErrorf("schema:compare needs two different databases, use --source and --target (or the profile flags)")
+	}
+
+	sourceSchema, err := readSchema(&source)
+	if err != nil {
+		return err
+	}
+	targetSchema, err := readSchema(&target)
+	if err != nil {
+		return err
+	}
+	if source == target {
+		return configErrorf("schema:compare compares %s with itself, pass a different --source or --target", source)
+	}
+
+	if differing, total := printSchemaDiff(out, source.String(), target.String(), sourceSchema, targetSchema, useColor); differing > 0 {
+		return fmt.Errorf("schemas differ in %d of %d table(s)", differing, total)
+	}
+
+	return nil
+}
+
+// colorEnabled reads a --color flag: auto colors output to a terminal unless NO_COLOR is set
+func colorEnabled(out io.Writer, color string) (bool, error) {
+	switch color {
+	case "always":
+		return true, nil
+	case "auto":
+		return isTerminal(out) && os.Getenv("NO_COLOR") == "", nil
+	case "never":
+		return false, nil
+	}
+	return false, configErrorf("invalid --color '%s': expected auto, always or never", color)
+}
+
+// printSchemaDiff prints the tables that differ between two schemas read by readSchema, returning how many differ
+// out of how many tables there are
+func printSchemaDiff(out io.Writer, sourceLabel string, targetLabel string, sourceSchema map[string]string, targetSchema map[string]string, useColor bool) (int, int) {
+	names := map[string]bool{}
+	for name := range sourceSchema {
+		names[name] = true
+	}
+	for name := range targetSchema {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	fmt.Fprintln(out, "--- "+sourceLabel)
+	fmt.Fprintln(out, "+++ "+targetLabel)
+
+	differing := 0
+	for _, name := range sorted {
+		from, to := sourceSchema[name], targetSchema[name]
+		if from == to {
+			continue
+		}
+		differing++
+
+		fmt.Fprintln(out)
+		switch {
+		case from == "":
+			fmt.Fprintln(out, "@@ "+name+": only in "+targetLabel+" @@")
+		case to == "":
+			fmt.Fprintln(out, "@@ "+name+": only in "+sourceLabel+" @@")
+		default:
+			fmt.Fprintln(out, "@@ "+name+" @@")
+		}
+		printLineDiff(out, splitLines(from), splitLines(to), useColor)
+	}
+
+	if differing == 0 {
+		fmt.Fprintf(out, "\nSchemas are identical (%d table(s))\n", len(sorted))
+	}
+
+	return differing, len(sorted)
+}
+
+func (s schemaSide) String() string {
+	if s.profile == "" {
+		return s.database
+	}
+	return s.database + " (profile " + s.profile + ")"
+}
+
+// readSchema renders the tables of a side's database by name, filling in the database from its DB_NAME when unset
+func readSchema(side *schemaSide) (map[string]string, error) {
+	var db driver.Conn
+	err := withProfileEnv(side.profile, func() error {
+		if side.database == "" {
+			side.database = getDbName(false)
+		}
+		var err error
+		db, err = getReadonlyDbConn(false)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+
+	tables := map[string]string{}
+	engines := map[string]string{}
+	rows, err := db.Query(ctx, "SELECT name, engine_full FROM system.tables WHERE database = $1 AND NOT is_temporary AND NOT startsWith(name, '.inner')", side.database)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var name, engine string
+		if err := rows.Scan(&name, &engine); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		engines[name] = engine
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	columns := map[string][]string{}
+	rows, err = db.Query(ctx, `
+		SELECT table, name, type, default_kind, default_expression, compression_codec
+		FROM system.columns
+		WHERE database = $1
+		ORDER BY table, position
+	`, side.database)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var table, name, typ, defaultKind, defaultExpression, codec string
+		if err := rows.Scan(&table, &name, &typ, &defaultKind, &defaultExpression, &codec); err != nil {
+			return nil, err
+		}
+		column := "    " + quoteIdentifier(name) + " " + typ
+		if defaultKind != "" {
+			column += " " + defaultKind + " " + defaultExpression
+		}
+		if codec != "" {
+			column += " " + codec
+		}
+		columns[table] = append(columns[table], column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for name, engine := range engines {
+		tables[name] = "CREATE TABLE " + name + "\n(\n" + strings.Join(columns[name], ",\n") + "\n)\nENGINE = " + engine
+	}
+
+	return tables, nil
+}
+
+// withProfileEnv runs fn with the variables of .env.<profile> in the environment and restores the environment
+// afterwards. The DB_ variables the profile does not set are cleared first, so a DB_LOCAL_ADDR or DB_NAME of the
+// loaded .env cannot redirect the connection away from the profile's server. Without a profile fn runs as is
+func withProfileEnv(profile string, fn func() error) error {
+	if profile == "" {
+		return fn()
+	}
+
+	values, err := godotenv.Read(filepath.Join(projectRoot, ".env."+profile))
+	if err != nil {
+		return &configError{err: fmt.Errorf("error loading .env.%s for profile '%s': %w", profile, profile, err)}
+	}
+
+	for _, v := range envVars {
+		if _, ok := values[v.name]; ok || !strings.HasPrefix(v.name, "DB_") {
+			continue
+		}
+		if previous, wasSet := os.LookupEnv(v.name); wasSet {
+			os.Unsetenv(v.name)
+			defer os.Setenv(v.name, previous)
+		}
+	}
+
+	for name, value := range values {
+		previous, wasSet := os.LookupEnv(name)
+		os.Setenv(name, value)
+		if wasSet {
+			defer os.Setenv(name, previous)
+		} else {
+			defer os.Unsetenv(name)
+		}
+	}
+
+	// as when the profile is loaded with --profile, DB_DATABASE of the profile maps onto DB_NAME
+	if _, ok := values["DB_NAME"]; !ok {
+		defer os.Unsetenv("DB_NAME")
+	}
+	if err := resolveAliases(); err != nil {
+		return &configError{err: err}
+	}
+
+	return fn()
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, "\n")
+}
+
+// printLineDiff prints the lines of from and to, unchanged ones indented and the others prefixed with - and + as
+// found by their longest common subsequence
+func printLineDiff(out io.Writer, from []string, to []string, color bool) {
+	// common[i][j] is the length of the longest common subsequence of from[i:] and to[j:]
+	common := make([][]int, len(from)+1)
+	for i := range common {
+		common[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			switch {
+			case from[i] == to[j]:
+				common[i][j] = common[i+1][j+1] + 1
+			case common[i+1][j] >= common[i][j+1]:
+				common[i][j] = common[i+1][j]
+			default:
+				common[i][j] = common[i][j+1]
+			}
+		}
+	}
+
+	line := func(prefix string, text string, code string) {
+		if color && code != "" {
+			fmt.Fprintln(out, code+prefix+text+colorReset)
+			return
+		}
+		fmt.Fprintln(out, prefix+text)
+	}
+
+	i, j := 0, 0
+	for i < len(from) || j < len(to) {
+		switch {
+		case i < len(from) && j < len(to) && from[i] == to[j]:
+			line(" ", from[i], "")
+			i++
+			j++
+		case j == len(to) || (i < len(from) && common[i+1][j] >= common[i][j+1]):
+			line("-", from[i], colorRed)
+			i++
+		default:
+			line("+", to[j], colorGreen)
+			j++
+		}
+	}
+}
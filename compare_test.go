@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWithProfileEnvUsesOnlyTheProfileConnection(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, ".env.prod"), []byte("DB_ADDR=prod:9000\nDB_DATABASE=events\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	previousRoot := projectRoot
+	projectRoot = root
+	defer func() { projectRoot = previousRoot }()
+
+	t.Setenv("DB_LOCAL_ADDR", "127.0.0.1:9000")
+	t.Setenv("DB_NAME", "logme")
+
+	err := withProfileEnv("prod", func() error {
+		addr, err := getDbAddr()
+		if err != nil {
+			return err
+		}
+		if addr != "prod:9000" {
+			t.Errorf("addr = %q, want the profile's prod:9000", addr)
+		}
+		if name := os.Getenv("DB_NAME"); name != "events" {
+			t.Errorf("DB_NAME = %q, want events from the profile's DB_DATABASE", name)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if addr := os.Getenv("DB_LOCAL_ADDR"); addr != "127.0.0.1:9000" {
+		t.Errorf("DB_LOCAL_ADDR = %q after the profile, want it restored", addr)
+	}
+	if name := os.Getenv("DB_NAME"); name != "logme" {
+		t.Errorf("DB_NAME = %q after the profile, want it restored", name)
+	}
+	if _, set := os.LookupEnv("DB_ADDR"); set {
+		t.Error("DB_ADDR of the profile is still set")
+	}
+}
+
+func TestPrintSchemaDiff(t *testing.T) {
+	before := map[string]string{
+		"events": "CREATE TABLE events\n(\n    `id` UInt64\n)\nENGINE = MergeTree",
+		"users":  "CREATE TABLE users\n(\n    `id` UInt64\n)\nENGINE = MergeTree",
+	}
+	after := map[string]string{
+		"events":   "CREATE TABLE events\n(\n    `id` UInt64,\n    `name` String\n)\nENGINE = MergeTree",
+		"sessions": "CREATE TABLE sessions\n(\n    `id` UInt64\n)\nENGINE = MergeTree",
+		"users":    before["users"],
+	}
+
+	var out bytes.Buffer
+	differing, total := printSchemaDiff(&out, "before 002_a.sql", "logme", before, after, false)
+	if differing != 2 || total != 3 {
+		t.Errorf("printSchemaDiff() = %d, %d, want 2, 3", differing, total)
+	}
+
+	want := `--- before 002_a.sql
++++ logme
+
+@@ events @@
+ CREATE TABLE events
+ (
+-    ` + "`id`" + ` UInt64
++    ` + "`id`" + ` UInt64,
++    ` + "`name`" + ` String
+ )
+ ENGINE = MergeTree
+
+@@ sessions: only in logme @@
++CREATE TABLE sessions
++(
++    ` + "`id`" + ` UInt64
++)
++ENGINE = MergeTree
+`
+	if out.String() != want {
+		t.Errorf("printed:\n%s\nwant:\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/urfave/cli/v2"
+)
+
+// bash and zsh ask the binary for candidates through urfave/cli's --generate-bash-completion, the scripts work on the
+// raw command line since bash splits words on the colon of commands such as migrate:run
+const bashCompletion = `_logme_cli_completion() {
+  local line="${COMP_LINE:0:$COMP_POINT}"
+  local -a words=( $line )
+  local cur="" opts
+  if [[ "$line" != *" " ]]; then
+    cur="${words[${#words[@]}-1]}"
+    unset "words[${#words[@]}-1]"
+  fi
+  if [[ "$cur" == "-"* ]]; then
+    opts=$( "${words[@]}" "$cur" --generate-bash-completion 2>/dev/null )
+  else
+    opts=$( "${words[@]}" --generate-bash-completion 2>/dev/null )
+  fi
+  COMPREPLY=( $(compgen -W "$opts" -- "$cur") )
+  if [[ "$cur" == *:* ]]; then
+    local prefix="${cur%"${cur##*:}"}"
+    COMPREPLY=( "${COMPREPLY[@]#"$prefix"}" )
+  fi
+}
+
+complete -o bashdefault -o default -F _logme_cli_completion logme-cli
+`
+
+const zshCompletion = `#compdef logme-cli
+
+_logme_cli_completion() {
+  local -a opts
+  local cur=${words[-1]}
+  # an empty SHELL keeps the candidates to plain names, zsh would get name:usage pairs that break on migrate:run
+  if [[ "$cur" == "-"* ]]; then
+    opts=("${(@f)$(SHELL= ${words[@]:0:#words[@]-1} ${cur} --generate-bash-completion 2>/dev/null)}")
+  else
+    opts=("${(@f)$(SHELL= ${words[@]:0:#words[@]-1} --generate-bash-completion 2>/dev/null)}")
+  fi
+
+  if [[ "${opts[1]}" != "" ]]; then
+    compadd -- "${opts[@]}"
+  else
+    _files
+  fi
+}
+
+compdef _logme_cli_completion logme-cli
+`
+
+func completion(c *cli.Context, shell string) error {
+	switch shell {
+	case "bash":
+		fmt.Fprint(c.App.Writer, bashCompletion)
+	case "zsh":
+		fmt.Fprint(c.App.Writer, zshCompletion)
+	case "fish":
+		script, err := c.App.ToFishCompletion()
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(c.App.Writer, script)
+	default:
+		return configErrorf("completion requires a shell: bash, zsh or fish")
+	}
+
+	return nil
+}
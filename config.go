@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/joho/godotenv"
+	"gopkg.in/yaml.v3"
+)
+
+const protectedProfile = "prod"
+
+const defaultConfigFile = "logme.yaml"
+
+// loadEnv loads .env, or .env.<profile> when a profile is selected, from dir without overriding the real environment
+func loadEnv(profile string, dir string) error {
+	if profile == "" {
+		// a missing .env is fine, the configuration can come from the environment (and init creates it)
+		if err := godotenv.Load(filepath.Join(dir, ".env")); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return errors.New("Error loading .env file")
+		}
+		return nil
+	}
+
+	if err := godotenv.Load(filepath.Join(dir, ".env."+profile)); err != nil {
+		return fmt.Errorf("error loading .env.%s for profile '%s': %w", profile, profile, err)
+	}
+
+	// expose the selected profile to the rest of the configuration
+	return os.Setenv("LOGME_PROFILE", profile)
+}
+
+// findProjectRoot walks up from the working directory to the first directory holding the .env file (or
+// .env.<profile>) or the migrations directory, the way git finds .git. It returns "." when there is none
+func findProjectRoot(profile string) string {
+	envFile := ".env"
+	if profile != "" {
+		envFile += "." + profile
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		return "."
+	}
+	start := dir
+
+	for {
+		for _, marker := range []string{envFile, migrationDir} {
+			if _, err := os.Stat(filepath.Join(dir, marker)); err == nil {
+				if dir == start {
+					return "."
+				}
+				return dir
+			}
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "."
+		}
+		dir = parent
+	}
+}
+
+// guardProfile refuses destructive operations on the prod profile unless forced
+func guardProfile(force bool) error {
+	if os.Getenv("LOGME_PROFILE") == protectedProfile && !force {
+		return configErrorf("refusing to run a destructive command on the '%s' profile without --force", protectedProfile)
+	}
+	return nil
+}
+
+// resolveAliases maps DB_DATABASE (the name used by the ClickHouse driver and other tools) onto DB_NAME,
+// DB_NAME wins when both are set
+func resolveAliases() error {
+	name, database := os.Getenv("DB_NAME"), os.Getenv("DB_DATABASE")
+
+	switch {
+	case database == "":
+		return nil
+	case name == "":
+		return os.Setenv("DB_NAME", database)
+	case name != database:
+		fmt.Fprintf(os.Stderr, "warning: DB_NAME '%s' and DB_DATABASE '%s' differ, using DB_NAME\n", name, database)
+	}
+
+	return nil
+}
+
+// loadConfig reads a YAML config file into the environment without overriding variables that are already set,
+// giving the precedence: flags > environment > .env > config file > defaults. Without a path logme.yaml is read
+// from dir, if present
+func loadConfig(path string, dir string) error {
+	explicit := path != ""
+	if !explicit {
+		path = filepath.Join(dir, defaultConfigFile)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		// the default config file is optional
+		if !explicit && errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+
+	// config file keys are the lowercased variable names (e.g. db_addr)
+	known := map[string]bool{}
+	lists := map[string]bool{}
+	for _, v := range envVars {
+		if !v.envOnly {
+			known[strings.ToLower(v.name)] = true
+			lists[strings.ToLower(v.name)] = v.list
+		}
+	}
+
+	var unknown []string
+	for key := range values {
+		if !known[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys in config file %s: %s", path, strings.Join(unknown, ", "))
+	}
+
+	for key, value := range values {
+		switch typed := value.(type) {
+		case []interface{}:
+			if !lists[key] {
+				return fmt.Errorf("config file %s: %s must be a single value", path, key)
+			}
+			items := make([]string, len(typed))
+			for i, item := range typed {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		case map[string]interface{}:
+			return fmt.Errorf("config file %s: %s must be a single value", path, key)
+		}
+
+		name := strings.ToUpper(key)
+		if _, set := os.LookupEnv(name); set || value == nil {
+			continue
+		}
+		if err := os.Setenv(name, fmt.Sprint(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
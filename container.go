@@ -0,0 +1,37 @@
+package main
+
+import (
+	"io"
+	"os"
+)
+
+// containerAction starts, stops or removes containers with docker itself rather than docker-compose, for
+// environments running them with plain docker run. force removes running containers as well
+func containerAction(out io.Writer, action string, names []string, force bool, dryRun bool) error {
+	if len(names) == 0 {
+		return configErrorf("container:%s requires at least one container NAME", action)
+	}
+
+	args := []string{action}
+	if action == "remove" {
+		args = []string{"rm"}
+		if force {
+			args = append(args, "--force")
+		}
+	}
+	args = append(args, names...)
+
+	if dryRun {
+		printCommand(out, append([]string{"docker"}, args...))
+		return nil
+	}
+
+	cmd, err := dockerCommand(args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
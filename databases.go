@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// targetDatabases returns the databases of DB_DATABASES, empty when migrate only targets DB_NAME
+func targetDatabases() []string {
+	var databases []string
+	for _, name := range strings.Split(os.Getenv("DB_DATABASES"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			databases = append(databases, name)
+		}
+	}
+	return databases
+}
+
+// migrateTargets runs migrate against DB_NAME or, when DB_DATABASES is set, against each of its databases in turn
+// (with the _test suffix for the test databases), each with its own bookkeeping table. A failing database does not
+// stop the others, the failures are reported together at the end with the exit code of the most severe one
+func migrateTargets(isTest bool, opts migrateOptions) error {
+	databases := targetDatabases()
+	if len(databases) == 0 {
+		return migrate(isTest, opts)
+	}
+	if opts.watch {
+		return configErrorf("--watch cannot be combined with DB_DATABASES, it only watches a single database")
+	}
+
+	dbName := os.Getenv("DB_NAME")
+	defer os.Setenv("DB_NAME", dbName)
+
+	failures := &databasesError{databases: make([]string, len(databases)), failed: map[string]error{}}
+	for i, database := range databases {
+		if i > 0 {
+			fmt.Fprintln(opts.out)
+		}
+		os.Setenv("DB_NAME", database)
+		name := targetDbName(database, isTest)
+		failures.databases[i] = name
+		fmt.Fprintln(opts.out, "Database: "+name)
+
+		// each database writes its own report, bundle and schema instead of overwriting the previous one's
+		runOpts := opts
+		runOpts.junit = databasePath(opts.junit, name)
+		runOpts.diagnosticsBundle = databasePath(opts.diagnosticsBundle, name)
+		runOpts.dumpSchema = databasePath(opts.dumpSchema, name)
+
+		if err := migrate(isTest, runOpts); err != nil {
+			fmt.Fprintln(opts.out, "Failed: "+name+": "+err.Error())
+			failures.failed[name] = err
+		}
+	}
+
+	fmt.Fprintln(opts.out)
+	fmt.Fprintf(opts.out, "Migrated %d database(s), %d failed\n", len(databases)-len(failures.failed), len(failures.failed))
+	if len(failures.failed) > 0 {
+		return failures
+	}
+
+	return nil
+}
+
+// databasesError is the failure of a DB_DATABASES run, with the error of each database that failed. It unwraps to
+// the most severe of them so the run exits with its code
+type databasesError struct {
+	databases []string
+	failed    map[string]error
+}
+
+func (e *databasesError) errs() []error {
+	var errs []error
+	for _, name := range e.databases {
+		if err, ok := e.failed[name]; ok {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+func (e *databasesError) Error() string {
+	var names []string
+	for _, name := range e.databases {
+		if _, ok := e.failed[name]; ok {
+			names = append(names, name)
+		}
+	}
+	return fmt.Sprintf("migrations failed in %d of %d database(s) (%s), %v", len(names), len(e.databases), strings.Join(names, ", "), mostSevere(e.errs()))
+}
+
+func (e *databasesError) Unwrap() error { return mostSevere(e.errs()) }
+
+// targetDbName is the name migrate gives a database of DB_DATABASES, see getDbName
+func targetDbName(database string, isTest bool) string {
+	if isTest {
+		return database + "_test"
+	}
+	return database
+}
+
+// databasePath adds the database to a file name before its extension, e.g. report.xml becomes
+// report.logme_a.xml, empty paths stay empty
+func databasePath(path string, database string) string {
+	if path == "" {
+		return ""
+	}
+
+	ext := filepath.Ext(path)
+	if strings.HasSuffix(path, ".tar.gz") {
+		ext = ".tar.gz"
+	}
+
+	return strings.TrimSuffix(path, ext) + "." + database + ext
+}
+
+// severityOrder ranks every exit code from the most severe: a configuration or connection problem likely affects
+// every database, a held lock stops a whole database and a failed migration only its own. Drift and pending
+// migrations are findings rather than failures, and an unclassified error ranks last
+var severityOrder = []int{exitConfig, exitConnection, exitLock, exitMigration, exitDrift, exitPending, exitFailure}
+
+// mostSevere returns the first of errs with the most severe exit code, so the aggregated error keeps its class
+func mostSevere(errs []error) error {
+	var worst error
+	rank := len(severityOrder)
+	for _, err := range errs {
+		r := len(severityOrder)
+		for i, code := range severityOrder {
+			if exitCode(err) == code {
+				r = i
+				break
+			}
+		}
+		if worst == nil || r < rank {
+			worst, rank = err, r
+		}
+	}
+	return worst
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDatabasePath(t *testing.T) {
+	for _, tc := range []struct {
+		path string
+		want string
+	}{
+		{"", ""},
+		{"report.xml", "report.tenant_a.xml"},
+		{"out/bundle.tar.gz", "out/bundle.tenant_a.tar.gz"},
+		{"schema", "schema.tenant_a"},
+	} {
+		if got := databasePath(tc.path, "tenant_a"); got != tc.want {
+			t.Errorf("databasePath(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+func TestMostSevereKeepsTheExitCode(t *testing.T) {
+	migration := fmt.Errorf("tenant_a: %w", &migrationError{name: "001_a.sql", err: errors.New("syntax error")})
+	connection := fmt.Errorf("tenant_b: %w", &connectionError{err: errors.New("connection refused")})
+	config := fmt.Errorf("tenant_c: %w", configErrorf("invalid setting"))
+	lock := fmt.Errorf("tenant_d: %w", &lockError{name: globalLock, holder: lockHolder{owner: "a"}})
+	pending := fmt.Errorf("tenant_e: %w", &pendingError{count: 1})
+	drift := fmt.Errorf("tenant_f: %w", &driftError{count: 1})
+
+	for _, tc := range []struct {
+		errs []error
+		want int
+	}{
+		{[]error{migration}, exitMigration},
+		{[]error{migration, connection}, exitConnection},
+		{[]error{connection, config, migration}, exitConfig},
+		{[]error{errors.New("other"), migration}, exitMigration},
+		{[]error{migration, lock}, exitLock},
+		{[]error{lock, connection}, exitConnection},
+		{[]error{pending, migration}, exitMigration},
+		{[]error{pending, drift}, exitDrift},
+		{[]error{errors.New("other"), pending}, exitPending},
+	} {
+		err := fmt.Errorf("migrations failed, %w", mostSevere(tc.errs))
+		if got := exitCode(err); got != tc.want {
+			t.Errorf("exitCode(%v) = %d, want %d", err, got, tc.want)
+		}
+	}
+}
+
+func TestSeverityOrderRanksEveryExitCode(t *testing.T) {
+	ranked := map[int]bool{}
+	for _, code := range severityOrder {
+		ranked[code] = true
+	}
+	for _, code := range []int{exitFailure, exitConnection, exitMigration, exitLock, exitConfig, exitPending, exitDrift} {
+		if !ranked[code] {
+			t.Errorf("exit code %d is not ranked by severityOrder", code)
+		}
+	}
+}
+
+func TestDatabaseErrKeepsEachDatabaseOutcome(t *testing.T) {
+	migration := &migrationError{name: "001_a.sql", err: errors.New("syntax error")}
+	failures := &databasesError{
+		databases: []string{"tenant_a", "tenant_b"},
+		failed:    map[string]error{"tenant_b": migration},
+	}
+
+	if err := databaseErr(failures, "tenant_a"); err != nil {
+		t.Errorf("databaseErr(tenant_a) = %v, want nil", err)
+	}
+	if err := databaseErr(failures, "tenant_b"); err != migration {
+		t.Errorf("databaseErr(tenant_b) = %v, want %v", err, migration)
+	}
+	if got := exitCode(failures); got != exitMigration {
+		t.Errorf("exitCode() = %d, want %d", got, exitMigration)
+	}
+
+	other := errors.New("connection refused")
+	if err := databaseErr(other, "tenant_a"); err != other {
+		t.Errorf("databaseErr() = %v, want %v", err, other)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+type columnDescription struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Default string `json:"default,omitempty"`
+	// DEFAULT, MATERIALIZED, ALIAS or EPHEMERAL, empty when the column has no default expression
+	DefaultKind       string `json:"default_kind,omitempty"`
+	DefaultExpression string `json:"default_expression,omitempty"`
+	Codec             string `json:"codec,omitempty"`
+}
+
+type tableDescription struct {
+	Database     string              `json:"database"`
+	Table        string              `json:"table"`
+	Engine       string              `json:"engine"`
+	SortingKey   string              `json:"sorting_key"`
+	PartitionKey string              `json:"partition_key"`
+	CreateQuery  string              `json:"create_query"`
+	Columns      []columnDescription `json:"columns"`
+}
+
+func describe(out io.Writer, isTest bool, table string, format string) error {
+	db, err := getReadonlyDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	desc := tableDescription{
+		Database: getDbName(isTest),
+		Table:    table,
+	}
+
+	err = db.QueryRow(ctx, `
+		SELECT engine, sorting_key, partition_key, create_table_query
+		FROM system.tables
+		WHERE database = currentDatabase() AND name = $1
+	`, table).Scan(&desc.Engine, &desc.SortingKey, &desc.PartitionKey, &desc.CreateQuery)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("table '%s' does not exist in database '%s'", table, desc.Database)
+		}
+		return err
+	}
+
+	rows, err := db.Query(ctx, `
+		SELECT name, type, default_kind, default_expression, compression_codec
+		FROM system.columns
+		WHERE database = currentDatabase() AND table = $1
+		ORDER BY position
+	`, table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var computed []string
+	for rows.Next() {
+		var column columnDescription
+		if err := rows.Scan(&column.Name, &column.Type, &column.DefaultKind, &column.DefaultExpression, &column.Codec); err != nil {
+			return err
+		}
+		if column.DefaultKind != "" {
+			column.Default = column.DefaultKind + " " + column.DefaultExpression
+		}
+		// computed by the server, they cannot be inserted into and ALIAS columns are not even stored
+		if column.DefaultKind == "MATERIALIZED" || column.DefaultKind == "ALIAS" {
+			computed = append(computed, column.Name+" ("+column.DefaultKind+")")
+		}
+		desc.Columns = append(desc.Columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(desc)
+	}
+
+	if format == "markdown" {
+		var cells [][]string
+		for _, column := range desc.Columns {
+			cells = append(cells, []string{markdownCode(column.Name), markdownCode(column.Type), markdownCode(column.Default), markdownCode(column.Codec)})
+		}
+		if err := writeMarkdownTable(out, []string{"Column", "Type", "Default", "Codec"}, cells); err != nil {
+			return err
+		}
+
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "- Engine: "+markdownCode(desc.Engine))
+		fmt.Fprintln(out, "- Sorting key: "+markdownCode(desc.SortingKey))
+		fmt.Fprintln(out, "- Partition key: "+markdownCode(desc.PartitionKey))
+		if len(computed) > 0 {
+			fmt.Fprintln(out, "- Computed columns (not insertable): "+strings.Join(computed, ", "))
+		}
+		return nil
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "COLUMN\tTYPE\tDEFAULT\tCODEC")
+	for _, column := range desc.Columns {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", column.Name, column.Type, column.Default, column.Codec)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, "Engine: "+desc.Engine)
+	fmt.Fprintln(out, "Sorting key: "+desc.SortingKey)
+	fmt.Fprintln(out, "Partition key: "+desc.PartitionKey)
+	if len(computed) > 0 {
+		fmt.Fprintln(out, "Computed columns (not insertable): "+strings.Join(computed, ", "))
+	}
+
+	return nil
+}
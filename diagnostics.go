@@ -0,0 +1,194 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// diagnosticsLogLines is how much of the ClickHouse container logs goes into a diagnostics bundle
+const diagnosticsLogLines = 500
+
+// writeDiagnosticsBundle writes a .tar.gz of what is needed to debug a migration run: the configuration with the
+// passwords redacted, the server version, the migrations and their status, the bookkeeping table, the container
+// logs and, when the run failed, the error and the SQL of the failing migration. db is nil when the run could not
+// connect, each part that cannot be gathered holds the reason instead
+func writeDiagnosticsBundle(path string, db driver.Conn, opts migrateOptions, runErr error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gz := gzip.NewWriter(file)
+	archive := tar.NewWriter(gz)
+	now := time.Now()
+
+	add := func(name string, content string) error {
+		if err := archive.WriteHeader(&tar.Header{
+			Name:    "logme-diagnostics/" + name,
+			Mode:    0644,
+			Size:    int64(len(content)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		_, err := archive.Write([]byte(content))
+		return err
+	}
+
+	ctx := context.Background()
+
+	parts := []struct {
+		name    string
+		content func() (string, error)
+	}{
+		{"config.txt", func() (string, error) { return diagnosticsConfig(opts), nil }},
+		{"server.txt", func() (string, error) {
+			if db == nil {
+				return "", errors.New("not connected")
+			}
+			var version string
+			err := db.QueryRow(ctx, "SELECT version()").Scan(&version)
+			return "ClickHouse " + version + "\n", err
+		}},
+		{"migrations.txt", func() (string, error) { return diagnosticsMigrations(ctx, db, opts.table) }},
+		{"migrations_table.tsv", func() (string, error) {
+			if db == nil {
+				return "", errors.New("not connected")
+			}
+			return diagnosticsTable(ctx, db, opts.table)
+		}},
+		{"clickhouse.log", func() (string, error) { return serverLogs(opts.container, diagnosticsLogLines) }},
+	}
+
+	for _, part := range parts {
+		content, err := part.content()
+		if err != nil {
+			content = "unavailable: " + err.Error() + "\n"
+		}
+		if err := add(part.name, content); err != nil {
+			return err
+		}
+	}
+
+	if runErr != nil {
+		if err := add("error.txt", runErr.Error()+"\n"); err != nil {
+			return err
+		}
+
+		var failed *migrationError
+		if errors.As(runErr, &failed) && failed.name != "" {
+			content, err := os.ReadFile(migrationPath(failed.name))
+			if err != nil {
+				content = []byte("unavailable: " + err.Error() + "\n")
+			}
+			if err := add("failed/"+failed.name, string(content)); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	return file.Close()
+}
+
+// diagnosticsConfig lists the settings of the run and every recognized variable that is set, passwords redacted
+func diagnosticsConfig(opts migrateOptions) string {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "database: "+opts.database)
+	fmt.Fprintln(&b, "migrations table: "+opts.table)
+	fmt.Fprintln(&b, "migrations directories: "+strings.Join(migrationDirs, ", "))
+	fmt.Fprintln(&b, "environment: "+currentEnv())
+	fmt.Fprintln(&b)
+
+	for _, v := range envVars {
+		value, set := os.LookupEnv(v.name)
+		if !set {
+			continue
+		}
+		if strings.HasSuffix(v.name, "_PASS") && value != "" {
+			value = "<redacted>"
+		}
+		fmt.Fprintln(&b, v.name+"="+value)
+	}
+
+	return b.String()
+}
+
+// diagnosticsMigrations lists the migration files with whether they are applied, then the applied migrations whose
+// file is gone
+func diagnosticsMigrations(ctx context.Context, db driver.Conn, table string) (string, error) {
+	names, err := migrationFiles()
+	if err != nil {
+		return "", err
+	}
+
+	var applied map[string]string
+	if db != nil {
+		if applied, err = appliedMigrations(ctx, db, table); err != nil {
+			return "", err
+		}
+	}
+
+	var b strings.Builder
+	onDisk := map[string]bool{}
+	for _, name := range names {
+		onDisk[name] = true
+		status := "pending"
+		if _, ok := applied[name]; ok {
+			status = "applied"
+		} else if db == nil {
+			status = "unknown"
+		}
+		fmt.Fprintf(&b, "%-8s %s\n", status, name)
+	}
+	var missing []string
+	for name := range applied {
+		if !onDisk[name] {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	for _, name := range missing {
+		fmt.Fprintf(&b, "%-8s %s\n", "missing", name)
+	}
+
+	return b.String(), nil
+}
+
+// diagnosticsTable dumps the bookkeeping table in the order the migrations were applied
+func diagnosticsTable(ctx context.Context, db driver.Conn, table string) (string, error) {
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT name, dt, checksum, status, dir, applied_at FROM %s FINAL ORDER BY applied_at, dt, name", table))
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var b strings.Builder
+	fmt.Fprintln(&b, strings.Join(rows.Columns(), "\t"))
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintln(&b, strings.Join(record, "\t"))
+	}
+
+	return b.String(), rows.Err()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var (
+	createTableRegexp     = regexp.MustCompile(`(?is)^CREATE\s+TABLE\s+(?:IF\s+NOT\s+EXISTS\s+)?([^\s(]+)\s*\(`)
+	migrationPrefixRegexp = regexp.MustCompile(`^(\d+)_`)
+	migrationNameRegexp   = regexp.MustCompile(`^[a-z0-9_]+$`)
+	columnRegexp          = regexp.MustCompile(`(?s)^(\S+)\s+(.+)$`)
+	// keywords ending the type in a column definition
+	columnTypeEndRegexp = regexp.MustCompile(`(?i)\s(DEFAULT|MATERIALIZED|ALIAS|EPHEMERAL|CODEC|TTL|COMMENT)\b`)
+)
+
+type schemaColumn struct {
+	name       string
+	definition string
+	typ        string
+}
+
+type schemaTable struct {
+	name    string
+	create  string
+	columns []schemaColumn
+}
+
+// migrateDiff writes a new migration with the statements reconciling the live database with the declarative schema
+// file, changes that could lose data or have several meanings are written as commented out statements to confirm
+func migrateDiff(out io.Writer, isTest bool, table string, name string, schemaFile string) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	name = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(name), " ", "_"))
+	if !migrationNameRegexp.MatchString(name) {
+		return configErrorf("invalid migration name '%s': use lowercase letters, digits and underscores", name)
+	}
+
+	content, err := os.ReadFile(schemaFile)
+	if err != nil {
+		return err
+	}
+
+	desired, err := parseSchema(string(content))
+	if err != nil {
+		return configErrorf("%s: %w", schemaFile, err)
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// live columns per table, the bookkeeping and lock tables are managed by the tool and never part of the schema,
+	// nor are the backups of --backup-before-drop. The schema file only declares tables, so views and the .inner
+	// tables holding materialized views' data are left out
+	rows, err := db.Query(ctx, `
+		SELECT table, name, type
+		FROM system.columns
+		WHERE database = currentDatabase() AND table IN (
+			SELECT name
+			FROM system.tables
+			WHERE database = currentDatabase()
+				AND name NOT IN ($1, $2)
+				AND engine NOT IN ('View', 'MaterializedView', 'LiveView', 'WindowView')
+				AND NOT startsWith(name, '.inner')
+				AND `+notBackupTable+`
+		)
+		ORDER BY table, position
+	`, table, lockTableName(table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var liveTables []string
+	live := map[string]map[string]string{}
+	liveOrder := map[string][]string{}
+	for rows.Next() {
+		var tableName, column, typ string
+		if err := rows.Scan(&tableName, &column, &typ); err != nil {
+			return err
+		}
+		if live[tableName] == nil {
+			live[tableName] = map[string]string{}
+			liveTables = append(liveTables, tableName)
+		}
+		live[tableName][column] = typ
+		liveOrder[tableName] = append(liveOrder[tableName], column)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var statements, confirmations []string
+	desiredTables := map[string]bool{}
+
+	for _, t := range desired {
+		desiredTables[t.name] = true
+
+		columns, exists := live[t.name]
+		if !exists {
+			statements = append(statements, t.create+";")
+			continue
+		}
+
+		wanted := map[string]bool{}
+		previous := ""
+		for _, column := range t.columns {
+			wanted[column.name] = true
+
+			liveType, exists := columns[column.name]
+			switch {
+			case !exists:
+				position := " FIRST"
+				if previous != "" {
+					position = " AFTER " + quoteIdentifier(previous)
+				}
+				statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s%s;", quoteIdentifier(t.name), column.definition, position))
+			case normalizeType(liveType) != normalizeType(column.typ):
+				confirmations = append(confirmations, fmt.Sprintf(
+					"-- confirm: %s.%s is %s in the database but %s in %s, uncomment to change it\n-- ALTER TABLE %s MODIFY COLUMN %s;",
+					t.name, column.name, liveType, column.typ, schemaFile, quoteIdentifier(t.name), column.definition,
+				))
+			}
+			previous = column.name
+		}
+
+		for _, column := range liveOrder[t.name] {
+			if !wanted[column] {
+				confirmations = append(confirmations, fmt.Sprintf(
+					"-- confirm: %s.%s is not in %s, it may have been renamed rather than removed, uncomment to drop it\n-- ALTER TABLE %s DROP COLUMN %s;",
+					t.name, column, schemaFile, quoteIdentifier(t.name), quoteIdentifier(column),
+				))
+			}
+		}
+	}
+
+	for _, tableName := range liveTables {
+		if !desiredTables[tableName] {
+			confirmations = append(confirmations, fmt.Sprintf(
+				"-- confirm: %s is not in %s, it may have been renamed or left out of the file, uncomment to drop it\n-- DROP TABLE %s;",
+				tableName, schemaFile, quoteIdentifier(tableName),
+			))
+		}
+	}
+
+	if len(statements) == 0 && len(confirmations) == 0 {
+		fmt.Fprintln(out, "Schema is up to date, no migration created")
+		return nil
+	}
+
+	file, err := nextMigrationFile(name)
+	if err != nil {
+		return err
+	}
+
+	migration := fmt.Sprintf("-- generated by migrate:diff from %s, review before applying\n%s%s\n\n", schemaFile, directivePrefix, multiStatementDirective) +
+		strings.Join(append(statements, confirmations...), "\n\n") + "\n"
+
+	if err := os.WriteFile(migrationDirs[0]+file, []byte(migration), 0644); err != nil {
+		return err
+	}
+
+	if err := appendOrderFile(file); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Created migration: "+migrationDirs[0]+file)
+	if len(confirmations) > 0 {
+		fmt.Fprintf(out, "%d change(s) need confirming, see the commented statements\n", len(confirmations))
+	}
+
+	return nil
+}
+
+// parseSchema extracts the tables and their column definitions from the CREATE TABLE statements of a schema file
+func parseSchema(sql string) ([]schemaTable, error) {
+	var tables []schemaTable
+
+	for _, statement := range splitStatements(sql) {
+		code := stripLeadingComments(statement)
+		match := createTableRegexp.FindStringSubmatchIndex(code)
+		if match == nil {
+			continue
+		}
+
+		name := code[match[2]:match[3]]
+		// the migration runs in the configured database, so drop any database qualifier
+		if i := strings.LastIndex(name, "."); i >= 0 {
+			name = name[i+1:]
+		}
+		name = strings.Trim(name, "`\"")
+
+		open := match[1] - 1
+		end := matchingParen(code, open)
+		if end < 0 {
+			return nil, fmt.Errorf("unbalanced parentheses in CREATE TABLE %s", name)
+		}
+
+		t := schemaTable{name: name, create: code}
+		for _, element := range splitTopLevel(code[open+1 : end]) {
+			element = strings.TrimSpace(element)
+			if element == "" {
+				continue
+			}
+
+			fields := columnRegexp.FindStringSubmatch(element)
+			if fields == nil {
+				return nil, fmt.Errorf("cannot parse column definition '%s' of table %s", element, name)
+			}
+			if keyword := strings.ToUpper(fields[1]); keyword == "INDEX" || keyword == "CONSTRAINT" || keyword == "PROJECTION" {
+				continue
+			}
+
+			typ := strings.TrimSpace(fields[2])
+			if loc := columnTypeEndRegexp.FindStringIndex(" " + typ); loc != nil {
+				typ = strings.TrimSpace(typ[:loc[0]])
+			}
+
+			t.columns = append(t.columns, schemaColumn{
+				name:       strings.Trim(fields[1], "`\""),
+				definition: element,
+				typ:        typ,
+			})
+		}
+
+		tables = append(tables, t)
+	}
+
+	if len(tables) == 0 {
+		return nil, errors.New("no CREATE TABLE statements found")
+	}
+
+	return tables, nil
+}
+
+func stripLeadingComments(statement string) string {
+	for {
+		statement = strings.TrimSpace(statement)
+		switch {
+		case strings.HasPrefix(statement, "--"):
+			end := strings.IndexByte(statement, '\n')
+			if end < 0 {
+				return ""
+			}
+			statement = statement[end+1:]
+		case strings.HasPrefix(statement, "/*"):
+			end := strings.Index(statement, "*/")
+			if end < 0 {
+				return ""
+			}
+			statement = statement[end+2:]
+		default:
+			return statement
+		}
+	}
+}
+
+// matchingParen returns the index of the parenthesis closing the one at open, skipping quoted text
+func matchingParen(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(s, i)
+		case '(':
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits on commas that are not nested in parentheses or quotes
+func splitTopLevel(s string) []string {
+	var (
+		parts []string
+		depth int
+		start int
+	)
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\'', '"', '`':
+			i = skipQuoted(s, i)
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// skipQuoted returns the index of the quote closing the one at i
+func skipQuoted(s string, i int) int {
+	quote := s[i]
+	for j := i + 1; j < len(s); j++ {
+		if s[j] == '\\' {
+			j++
+			continue
+		}
+		if s[j] == quote {
+			return j
+		}
+	}
+	return len(s) - 1
+}
+
+func normalizeType(typ string) string {
+	return strings.Join(strings.Fields(typ), "")
+}
+
+// nextMigrationFile names a new migration after the highest numeric prefix in the migrations directories,
+// keeping the zero padded width already in use
+func nextMigrationFile(name string) (string, error) {
+	highest, width := 0, 3
+	for _, dir := range migrationDirs {
+		entries, err := readMigrationDir(dir)
+		if err != nil {
+			return "", err
+		}
+
+		for _, entry := range entries {
+			match := migrationPrefixRegexp.FindStringSubmatch(entry.Name())
+			if match == nil {
+				continue
+			}
+			if n, err := strconv.Atoi(match[1]); err == nil && n > highest {
+				highest = n
+			}
+			if len(match[1]) > width {
+				width = len(match[1])
+			}
+		}
+	}
+
+	return fmt.Sprintf("%0*d_%s.sql", width, highest+1, name), nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+const directivePrefix = "-- logme:"
+
+// readDirectives collects the "-- logme:<name> <value>" lines from the comment header at the top of a migration,
+// the header ends at the first line that is neither blank nor a comment
+func readDirectives(content []byte) map[string][]string {
+	directives := map[string][]string{}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		if !strings.HasPrefix(line, directivePrefix) {
+			continue
+		}
+
+		name, value, _ := strings.Cut(strings.TrimPrefix(line, directivePrefix), " ")
+		directives[name] = append(directives[name], strings.TrimSpace(value))
+	}
+
+	return directives
+}
+
+// directiveList splits every occurrence of a directive on commas, so both repeated and comma separated values work
+func directiveList(directives map[string][]string, name string) []string {
+	var values []string
+	for _, value := range directives[name] {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				values = append(values, item)
+			}
+		}
+	}
+	return values
+}
+
+// migrationSettings returns the query settings a migration's directives ask for, they only apply to that migration's
+// statement and so leave the connection defaults untouched for every other file
+func migrationSettings(directives map[string][]string) (clickhouse.Settings, error) {
+	settings := clickhouse.Settings{}
+
+	// "-- logme:timeout 600" raises max_execution_time (in seconds) for slow backfills
+	if values := directives["timeout"]; len(values) > 0 {
+		seconds, err := strconv.Atoi(values[len(values)-1])
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid logme:timeout '%s': expected a positive number of seconds", values[len(values)-1])
+		}
+		settings["max_execution_time"] = seconds
+	}
+
+	return settings, nil
+}
+
+// afterStatements builds the maintenance statements of the "-- logme:after optimize TABLE [final] [deduplicate]"
+// directives, run in order once the migration's own SQL succeeded
+func afterStatements(directives map[string][]string) ([]string, error) {
+	var statements []string
+
+	for _, value := range directives["after"] {
+		fields := strings.Fields(value)
+		if len(fields) < 2 || !strings.EqualFold(fields[0], "optimize") {
+			return nil, fmt.Errorf("invalid logme:after '%s': expected optimize TABLE [final] [deduplicate]", value)
+		}
+
+		// a database qualified name is allowed, each part must be a plain identifier
+		for _, part := range strings.Split(fields[1], ".") {
+			if !identifierRegexp.MatchString(part) {
+				return nil, fmt.Errorf("invalid logme:after '%s': invalid table name '%s'", value, fields[1])
+			}
+		}
+
+		statement := "OPTIMIZE TABLE " + fields[1]
+		var final, deduplicate bool
+		for _, option := range fields[2:] {
+			switch strings.ToLower(option) {
+			case "final":
+				final = true
+			case "deduplicate":
+				deduplicate = true
+			default:
+				return nil, fmt.Errorf("invalid logme:after '%s': unknown option '%s', expected final or deduplicate", value, option)
+			}
+		}
+		// ClickHouse requires FINAL before DEDUPLICATE
+		if final {
+			statement += " FINAL"
+		}
+		if deduplicate {
+			statement += " DEDUPLICATE"
+		}
+
+		statements = append(statements, statement)
+	}
+
+	return statements, nil
+}
+
+// envSkip returns why a migration restricted to some environments ("-- logme:env dev,staging") is skipped in env,
+// nothing when it can run. Restricted migrations never run when the environment is unknown
+func envSkip(directives map[string][]string, env string) string {
+	allowed := directiveList(directives, "env")
+	if len(allowed) == 0 || containsString(allowed, env) {
+		return ""
+	}
+	if env == "" {
+		return "env: only for " + strings.Join(allowed, ", ") + " and LOGME_ENV is not set"
+	}
+	return "env: only for " + strings.Join(allowed, ", ") + ", environment is " + env
+}
+
+// minVersionSkip returns why a migration is skipped on a server older than its "-- logme:min-version 23.8", nothing
+// when it can run
+func minVersionSkip(directives map[string][]string, serverVersion string) (string, error) {
+	values := directives["min-version"]
+	if len(values) == 0 {
+		return "", nil
+	}
+
+	required := values[len(values)-1]
+	if _, err := parseVersion(required); err != nil {
+		return "", fmt.Errorf("invalid logme:min-version '%s': expected a version such as 23.8", required)
+	}
+
+	older, err := versionLess(serverVersion, required)
+	if err != nil || !older {
+		return "", err
+	}
+
+	return "requires ClickHouse " + required + ", server is " + serverVersion, nil
+}
+
+// versionLess compares dotted versions numerically, missing parts count as zero (23.8 is 23.8.0.0)
+func versionLess(a string, b string) (bool, error) {
+	left, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	right, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+
+	for i := 0; i < len(left) || i < len(right); i++ {
+		var l, r int
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			r = right[i]
+		}
+		if l != r {
+			return l < r, nil
+		}
+	}
+
+	return false, nil
+}
+
+func parseVersion(version string) ([]int, error) {
+	parts := strings.Split(strings.TrimSpace(version), ".")
+	numbers := make([]int, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version '%s'", version)
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+func TestMigrationSettings(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		want    clickhouse.Settings
+		invalid bool
+	}{
+		{"", clickhouse.Settings{}, false},
+		{"-- logme:timeout 600\n", clickhouse.Settings{"max_execution_time": 600}, false},
+		{"-- logme:timeout 60\n-- logme:timeout 900\n", clickhouse.Settings{"max_execution_time": 900}, false},
+		{"-- a comment first\n-- logme:timeout 30\n", clickhouse.Settings{"max_execution_time": 30}, false},
+		// only the header counts, not a comment after the first statement
+		{"SELECT 1;\n-- logme:timeout 600\n", clickhouse.Settings{}, false},
+		{"-- logme:timeout 0\n", nil, true},
+		{"-- logme:timeout -5\n", nil, true},
+		{"-- logme:timeout 10m\n", nil, true},
+	} {
+		settings, err := migrationSettings(readDirectives([]byte(tc.header + "SELECT 1;\n")))
+		if tc.invalid {
+			if err == nil {
+				t.Errorf("%q: migrationSettings() = %v, want an error", tc.header, settings)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(settings, tc.want) {
+			t.Errorf("%q: migrationSettings() = %v, %v, want %v", tc.header, settings, err, tc.want)
+		}
+	}
+}
+
+func TestTimeoutOnlyAppliesToTheFlaggedMigration(t *testing.T) {
+	opts := migrateOptions{settings: clickhouse.Settings{"max_execution_time": 60, "allow_experimental_object_type": 1}}
+
+	flagged, err := migrationSettings(readDirectives([]byte("-- logme:timeout 600\nSELECT 1;\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := migrationSettings(readDirectives([]byte("SELECT 2;\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := migrationQuerySettings(opts, "001_backfill.sql", flagged)["max_execution_time"]; got != 600 {
+		t.Errorf("flagged migration runs with max_execution_time %v, want 600", got)
+	}
+	// the next file is back to the connection's setting
+	settings := migrationQuerySettings(opts, "002_plain.sql", plain)
+	if got := settings["max_execution_time"]; got != 60 {
+		t.Errorf("following migration runs with max_execution_time %v, want the default 60", got)
+	}
+	if got := settings["allow_experimental_object_type"]; got != 1 {
+		t.Errorf("following migration lost the setup setting, got %v", got)
+	}
+	if got := opts.settings["max_execution_time"]; got != 60 {
+		t.Errorf("the run's settings were changed to %v", got)
+	}
+}
+
+func TestVersionLess(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want bool
+	}{
+		{"23.3.1.2823", "23.8", true},
+		{"23.8", "23.8.0.0", false},
+		{"23.8.0.0", "23.8", false},
+		{"23.8.1", "23.8", false},
+		{"22.12", "23.1", true},
+		// numeric, not lexical
+		{"23.9", "23.10", true},
+		{"24.1", "23.12.5", false},
+	} {
+		got, err := versionLess(tc.a, tc.b)
+		if err != nil || got != tc.want {
+			t.Errorf("versionLess(%q, %q) = %v, %v, want %v", tc.a, tc.b, got, err, tc.want)
+		}
+	}
+}
+
+func TestVersionLessInvalid(t *testing.T) {
+	for _, version := range []string{"", "23.x", "v23.8"} {
+		if _, err := versionLess(version, "23.8"); err == nil {
+			t.Errorf("versionLess(%q, 23.8) = nil error, want one", version)
+		}
+	}
+}
+
+func TestEnvSkip(t *testing.T) {
+	restricted := readDirectives([]byte("-- logme:env dev, staging\nCREATE TABLE fixtures (id UInt64) ENGINE = Memory;\n"))
+	unrestricted := readDirectives([]byte("CREATE TABLE events (id UInt64) ENGINE = Memory;\n"))
+
+	for _, tc := range []struct {
+		name       string
+		directives map[string][]string
+		env        string
+		skipped    bool
+	}{
+		{"listed environment", restricted, "dev", false},
+		{"second listed environment", restricted, "staging", false},
+		{"other environment", restricted, "prod", true},
+		{"unknown environment", restricted, "", true},
+		{"unrestricted in prod", unrestricted, "prod", false},
+		{"unrestricted without environment", unrestricted, "", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			reason := envSkip(tc.directives, tc.env)
+			if skipped := reason != ""; skipped != tc.skipped {
+				t.Errorf("envSkip(%q) = %q, want skipped %v", tc.env, reason, tc.skipped)
+			}
+			if tc.skipped && !strings.HasPrefix(reason, "env: ") {
+				t.Errorf("reason %q does not start with env:", reason)
+			}
+		})
+	}
+}
+
+func TestMigrationSkipReadsTheEnvironment(t *testing.T) {
+	useMigrationDirs(t, map[string]string{
+		"001_fixtures.sql": "-- logme:env dev\nSELECT 1;\n",
+	})
+
+	for _, tc := range []struct {
+		env, profile string
+		skipped      bool
+	}{
+		{"dev", "", false},
+		{"prod", "", true},
+		// the profile is the environment when LOGME_ENV is not set
+		{"", "dev", false},
+		{"", "prod", true},
+		{"prod", "dev", true},
+	} {
+		t.Setenv("LOGME_ENV", tc.env)
+		t.Setenv("LOGME_PROFILE", tc.profile)
+
+		status, reason, err := migrationSkip("001_fixtures.sql", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if skipped := reason != ""; skipped != tc.skipped {
+			t.Errorf("LOGME_ENV=%q LOGME_PROFILE=%q: migrationSkip() = %q, want skipped %v", tc.env, tc.profile, reason, tc.skipped)
+		}
+		if recorded := status == statusSkippedEnv; recorded != tc.skipped {
+			t.Errorf("LOGME_ENV=%q LOGME_PROFILE=%q: migrationSkip() status = %q", tc.env, tc.profile, status)
+		}
+	}
+}
+
+func TestMigrationSkipRecordsVersionSkips(t *testing.T) {
+	useMigrationDirs(t, map[string]string{
+		"001_json.sql": "-- logme:min-version 23.8\nSELECT 1;\n",
+	})
+	t.Setenv("LOGME_ENV", "")
+	t.Setenv("LOGME_PROFILE", "")
+
+	for _, tc := range []struct {
+		server string
+		status string
+	}{
+		{"23.3.1.2823", statusSkippedVersion},
+		{"23.8.2.7", ""},
+		// the version is only checked when the server's is known
+		{"", ""},
+	} {
+		status, reason, err := migrationSkip("001_json.sql", tc.server)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tc.status || (reason != "") != (tc.status != "") {
+			t.Errorf("migrationSkip() on %q = %q, %q, want status %q", tc.server, status, reason, tc.status)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transientComposeErrorRegexp matches the docker daemon errors that usually go away when the command is retried,
+// as opposed to errors in the compose file or unknown services
+var transientComposeErrorRegexp = regexp.MustCompile(`(?i)network \S+ not found|device or resource busy|is already in progress|connection reset by peer|tls handshake timeout|i/o timeout|context deadline exceeded|unexpected eof`)
+
+// composeRetryDelay is the wait before the first retry of --retries, growing with each attempt
+const composeRetryDelay = 2 * time.Second
+
+// composeArgs assembles a docker-compose command line, COMPOSE_CMD can replace the binary (e.g. "docker compose")
+func composeArgs(args ...string) []string {
+	compose := strings.Fields(os.Getenv("COMPOSE_CMD"))
+	if len(compose) == 0 {
+		compose = []string{"docker-compose"}
+	}
+	if project := os.Getenv("COMPOSE_PROJECT_NAME"); project != "" {
+		compose = append(compose, "-p", project)
+	}
+
+	return append(compose, args...)
+}
+
+func composeCommand(args ...string) (*exec.Cmd, error) {
+	compose := composeArgs(args...)
+
+	path, err := exec.LookPath(compose[0])
+	if err != nil {
+		return nil, fmt.Errorf("%s not found in PATH; install Docker Compose or set COMPOSE_CMD", compose[0])
+	}
+
+	return exec.Command(path, compose[1:]...), nil
+}
+
+// printCommand prints a command line the way it would be typed in a shell, for --dry-run
+func printCommand(out io.Writer, args []string) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	fmt.Fprintln(out, strings.Join(quoted, " "))
+}
+
+func shellQuote(arg string) string {
+	if arg != "" && strings.Trim(arg, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789-_=./:@,+") == "" {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// missingServices returns the services (all of the compose file when none are given) that are not running, the
+// running ones are reported as such
+func missingServices(out io.Writer, services []string) ([]string, error) {
+	if len(services) == 0 {
+		var err error
+		if services, err = composeLines("config", "--services"); err != nil {
+			return nil, err
+		}
+	}
+
+	running, err := composeLines("ps", "--services", "--filter", "status=running")
+	if err != nil {
+		return nil, err
+	}
+	isRunning := map[string]bool{}
+	for _, service := range running {
+		isRunning[service] = true
+	}
+
+	var missing []string
+	for _, service := range services {
+		if isRunning[service] {
+			fmt.Fprintln(out, "Already running: "+service)
+			continue
+		}
+		missing = append(missing, service)
+	}
+
+	return missing, nil
+}
+
+// composeLines runs docker-compose and returns the non-empty lines it printed
+func composeLines(args ...string) ([]string, error) {
+	cmd, err := composeCommand(args...)
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	return strings.Fields(string(output)), nil
+}
+
+func dockerCommand(args ...string) (*exec.Cmd, error) {
+	path, err := exec.LookPath("docker")
+	if err != nil {
+		return nil, fmt.Errorf("docker not found in PATH; install Docker to use this command")
+	}
+
+	return exec.Command(path, args...), nil
+}
+
+// tailServerLogs prints the last lines the ClickHouse container logged, the server side of a failure the driver
+// reports vaguely. It only warns when the logs cannot be read, the migration error is what matters
+func tailServerLogs(out io.Writer, container string, lines int) {
+	output, err := serverLogs(container, lines)
+	if err != nil {
+		fmt.Fprintln(out, "warning: cannot show server logs: "+err.Error())
+		return
+	}
+
+	fmt.Fprintln(out, "Last "+strconv.Itoa(lines)+" lines of "+container+" logs:")
+	fmt.Fprint(out, output)
+}
+
+// serverLogs returns the last lines of the logs of the ClickHouse container
+func serverLogs(container string, lines int) (string, error) {
+	cmd, err := dockerCommand("logs", "--tail", strconv.Itoa(lines), container)
+	if err != nil {
+		return "", err
+	}
+
+	// docker logs replays the container's stderr on stderr, which is where ClickHouse writes its errors
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("container %s: %s", container, strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
+
+// runComposeRetrying runs a compose command streaming its output, running it again up to retries times when it
+// fails with a transient daemon error
+func runComposeRetrying(out io.Writer, retries int, args ...string) error {
+	for attempt := 1; ; attempt++ {
+		cmd, err := composeCommand(args...)
+		if err != nil {
+			return err
+		}
+
+		var stderr bytes.Buffer
+		cmd.Stdout = out
+		cmd.Stderr = io.MultiWriter(os.Stderr, &stderr)
+
+		err = cmd.Run()
+		if err == nil || attempt > retries || !transientComposeErrorRegexp.Match(stderr.Bytes()) {
+			return err
+		}
+
+		delay := composeRetryDelay * time.Duration(attempt)
+		fmt.Fprintf(out, "Transient docker error, retrying in %s (retry %d of %d)\n", delay, attempt, retries)
+		time.Sleep(delay)
+	}
+}
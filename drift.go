@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// migrateCheckDrift compares the checksum recorded for each applied migration with that of its file now and fails
+// with exitDrift when one was edited after it ran. ignore holds file names, or path.Match patterns, of migrations
+// changed on purpose. baseline records the current checksums instead, accepting the files as they are
+func migrateCheckDrift(out io.Writer, isTest bool, table string, ignore []string, baseline bool, lockTTL time.Duration) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+	for _, pattern := range ignore {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return configErrorf("invalid --ignore pattern '%s': %s", pattern, err)
+		}
+	}
+
+	var (
+		db  driver.Conn
+		err error
+	)
+	if baseline {
+		db, err = getDbConn(isTest)
+	} else {
+		db, err = getReadonlyDbConn(isTest)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var exists uint8
+	if err := db.QueryRow(ctx, "EXISTS TABLE "+table).Scan(&exists); err != nil {
+		return err
+	}
+	if exists != 1 {
+		fmt.Fprintln(out, "No applied migrations")
+		return nil
+	}
+
+	if baseline {
+		lock, err := acquireGlobalLock(ctx, out, db, table, lockTTL)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	applied, err := appliedMigrations(ctx, db, table)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(applied))
+	for name := range applied {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	// archived by migrate:squash, their baseline is checked instead
+	squashed, err := squashedMigrations()
+	if err != nil {
+		return err
+	}
+
+	// the new checksum of each migration to baseline, drifted or recorded before checksums existed
+	changed := map[string]string{}
+	var drifted []string
+	for _, name := range names {
+		if driftIgnored(name, ignore) || squashed[name] {
+			continue
+		}
+
+		content, err := os.ReadFile(migrationPath(name))
+		if errors.Is(err, os.ErrNotExist) {
+			// removed files are reported by migrate too
+			fmt.Fprintln(out, "Missing: "+name)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		recorded, current := applied[name], checksum(content)
+		switch {
+		case recorded == current:
+			continue
+		case recorded == "":
+			fmt.Fprintln(out, "No checksum: "+name)
+		default:
+			fmt.Fprintf(out, "Drifted: %s (recorded %s, file %s)\n", name, shortChecksum(recorded), shortChecksum(current))
+			drifted = append(drifted, name)
+		}
+		changed[name] = current
+	}
+
+	if baseline {
+		// wait for each mutation so a check right after sees the new checksums
+		ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+			"mutations_sync": 1,
+		}))
+		for _, name := range names {
+			sum, ok := changed[name]
+			if !ok {
+				continue
+			}
+			if err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s UPDATE checksum = %s WHERE name = %s", table, quoteString(sum), quoteString(name))); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "Baselined %d migration(s)\n", len(changed))
+		return nil
+	}
+
+	if len(drifted) > 0 {
+		return &driftError{count: len(drifted)}
+	}
+
+	fmt.Fprintf(out, "No drift: %d applied migration(s) checked\n", len(names))
+
+	return nil
+}
+
+func driftIgnored(name string, ignore []string) bool {
+	for _, pattern := range ignore {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func shortChecksum(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
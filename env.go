@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+type envVar struct {
+	name        string
+	description string
+	// example is the value shown by print-env-template, the default when there is one
+	example string
+	// envOnly variables cannot come from a config file because they are needed before it is read
+	envOnly bool
+	// list variables are comma separated, a config file may give them as a YAML list
+	list bool
+}
+
+// envVars is the canonical list of environment variables the tool recognizes, keep it in sync when adding options
+var envVars = []envVar{
+	{name: "DB_LOCAL_ADDR", description: "address (host:port) of ClickHouse as seen from the host, only used when neither DB_ADDR nor DB_HOST is set", example: "127.0.0.1:9000"},
+	{name: "DB_ADDR", description: "address (host:port) of ClickHouse as seen from the logme containers", example: "clickhouse:9000"},
+	{name: "DB_HOST", description: "host of ClickHouse, only used when DB_ADDR is not set"},
+	{name: "DB_PORT", description: "port of ClickHouse used with DB_HOST (defaults to 9000)", example: "9000"},
+	{name: "DB_NAME", description: "name of the database, '_test' is appended for the test database (defaults to logme)", example: "logme"},
+	{name: "DB_DATABASE", description: "alias of DB_NAME, DB_NAME wins when both are set"},
+	{name: "DB_DATABASES", description: "comma separated databases migrate and migrate-test run against one after the other, instead of DB_NAME", example: "tenant_a,tenant_b", list: true},
+	{name: "DB_USER", description: "user to authenticate with (optional)"},
+	{name: "DB_PASS", description: "password to authenticate with (optional)"},
+	{name: "DB_READONLY_USER", description: "user for commands that only read: ping, describe, tables, migrate:pending, migrate:check-drift, migrate:export and schema:dump without a flag, query with --readonly, defaults to DB_USER"},
+	{name: "DB_READONLY_PASS", description: "password of DB_READONLY_USER"},
+	{name: "DB_MIGRATIONS_TABLE", description: "name of the table used to track applied migrations (defaults to migrations)", example: "migrations"},
+	{name: "DB_COMPRESSION", description: "compression of the connection: lz4, none or auto (defaults to auto, which disables it for loopback addresses)", example: "auto"},
+	{name: "DB_CONN_MAX_LIFETIME", description: "how long a connection is reused before it is recycled (e.g. 10m, defaults to 1h)", example: "1h"},
+	{name: "DB_SHARD", description: "shard of this server, {{.Shard}} in .sql.tmpl migrations", example: "01"},
+	{name: "DB_REPLICA", description: "replica name of this server, {{.Replica}} in .sql.tmpl migrations", example: "replica_1"},
+	{name: "DB_ZK_PREFIX", description: "keeper path prefix of {{.ZKPath \"table\"}} in .sql.tmpl migrations (defaults to /clickhouse/tables)", example: "/clickhouse/tables"},
+	{name: "DB_SOURCE", description: "database {{.SourceDB}} refers to in .sql.tmpl migrations, for backfills copying from another database", example: "logme_legacy"},
+	{name: "DB_SETUP_SQL", description: "file of statements (e.g. SET allow_experimental_...) run before migrations without being recorded", example: "setup.sql"},
+	{name: "COMPOSE_CMD", description: "command used to run docker compose (defaults to docker-compose)", example: "docker compose"},
+	{name: "COMPOSE_PROJECT_NAME", description: "docker-compose project name, scopes up, down, logs and list to one stack"},
+	{name: "LOGME_CLICKHOUSE_CONTAINER", description: "name of the ClickHouse container read by --tail-errors (defaults to clickhouse)", example: "clickhouse"},
+	{name: "LOGME_AUDIT_LOG", description: "file the commands that change the database are appended to as JSON lines (see --audit-log)", example: "audit.log"},
+	{name: "LOGME_METRICS_ENDPOINT", description: "where migrate sends the duration and counts of each run, see --metrics-endpoint", example: "http://pushgateway:9091/metrics/job/logme"},
+	{name: "LOGME_LOCK_TTL", description: "lease of the migration lock, after which the lock of a runner that died is taken over, see --lock-ttl", example: "5m"},
+	{name: "LOGME_ENV", description: "environment of this deployment (e.g. dev), matched against the \"-- logme:env\" header of migrations (defaults to the profile)", example: "dev"},
+	{name: "LOGME_PROFILE", description: "profile whose .env.<NAME> file is loaded instead of .env", example: "staging", envOnly: true},
+}
+
+// printEnvTemplate writes a .env.example with every variable of envVars commented out, generated so it cannot fall
+// behind the registry
+func printEnvTemplate(out io.Writer) {
+	writeEnvTemplate(out, "print-env-template")
+}
+
+// writeEnvTemplate writes every variable of envVars with its description, commented out except the ones in set which
+// are given their example value. command is the logme-cli command named in the header
+func writeEnvTemplate(out io.Writer, command string, set ...string) {
+	fmt.Fprintf(out, "# LogMe configuration, generated by logme-cli %s. Uncomment and set the variables you need,\n", command)
+	fmt.Fprintln(out, "# values set in the real environment take precedence over this file")
+
+	for _, v := range envVars {
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "# "+v.description)
+		if v.envOnly {
+			fmt.Fprintln(out, "# only read from the environment, setting it in this file has no effect")
+		}
+		if containsString(set, v.name) {
+			fmt.Fprintf(out, "%s=%s\n", v.name, v.example)
+		} else {
+			fmt.Fprintf(out, "# %s=%s\n", v.name, v.example)
+		}
+	}
+}
+
+// strictEnvPrefixes are the prefixes checked by --strict-env for unrecognized (likely misspelled) variables
+var strictEnvPrefixes = []string{"DB_", "LOGME_"}
+
+func isKnownEnvVar(name string) bool {
+	for _, v := range envVars {
+		if v.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStrictEnv errors on DB_/LOGME_ variables, from the environment or the loaded .env, that are not recognized
+func checkStrictEnv() error {
+	var unknown []string
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		for _, prefix := range strictEnvPrefixes {
+			if strings.HasPrefix(name, prefix) && !isKnownEnvVar(name) {
+				unknown = append(unknown, name)
+				break
+			}
+		}
+	}
+
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unrecognized environment variables: %s", strings.Join(unknown, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWriteEnvTemplateListsEveryVariable(t *testing.T) {
+	var out bytes.Buffer
+	writeEnvTemplate(&out, "init", initEnvVars...)
+
+	lines := strings.Split(out.String(), "\n")
+	for _, v := range envVars {
+		want := "# " + v.name + "="
+		if containsString(initEnvVars, v.name) {
+			want = v.name + "=" + v.example
+		}
+
+		found := false
+		for _, line := range lines {
+			if strings.HasPrefix(line, want) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("no line starting with %q in the .env written by init", want)
+		}
+	}
+}
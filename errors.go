@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// Exit codes by failure class, so orchestration can react differently to each
+const (
+	// exitFailure is any failure not classified below
+	exitFailure = 1
+	// exitConnection means ClickHouse could not be reached or refused the connection (connectionError)
+	exitConnection = 2
+	// exitMigration means the SQL of a migration, or of its down migration, failed (migrationError)
+	exitMigration = 3
+	// exitLock means another runner holds the migration lock (lockError)
+	exitLock = 4
+	// exitConfig means the configuration, flags or arguments are invalid (configError)
+	exitConfig = 5
+	// exitPending means migrate:pending found migrations that have not been applied (pendingError)
+	exitPending = 6
+	// exitDrift means migrate:check-drift found applied migrations whose file changed since (driftError)
+	exitDrift = 7
+)
+
+// connectionError wraps a failure to connect to ClickHouse, exits with code 2
+type connectionError struct {
+	err error
+}
+
+func (e *connectionError) Error() string { return "could not connect to ClickHouse: " + e.err.Error() }
+func (e *connectionError) Unwrap() error { return e.err }
+func (e *connectionError) exitCode() int { return exitConnection }
+
+// migrationError wraps a failed migration, exits with code 3
+type migrationError struct {
+	name string
+	err  error
+	// verbose adds the ClickHouse error code, its name and a hint (--verbose-errors)
+	verbose bool
+}
+
+func (e *migrationError) Error() string {
+	if e.name == "" {
+		return e.err.Error()
+	}
+
+	var exception *clickhouse.Exception
+	if e.verbose && errors.As(e.err, &exception) {
+		code := fmt.Sprintf("code %d", exception.Code)
+		message := exception.Message
+		if known, ok := errorCodes[exception.Code]; ok {
+			code += " " + known.name
+			if known.hint != "" {
+				message += " (hint: " + known.hint + ")"
+			}
+		}
+		return fmt.Sprintf("migration %s failed [%s]: %s", e.name, code, message)
+	}
+
+	return fmt.Sprintf("migration %s failed: %s", e.name, e.err)
+}
+
+func (e *migrationError) Unwrap() error { return e.err }
+func (e *migrationError) exitCode() int { return exitMigration }
+
+// lockError reports the migration lock held by another runner whose lease has not expired, exits with code 4
+type lockError struct {
+	name   string
+	holder lockHolder
+	// locks won then given back rather than waited on while holding them
+	released []string
+}
+
+func (e *lockError) Error() string {
+	message := fmt.Sprintf("the %s migration lock is held by %s on %s since %s, until %s (see migrate:unlock)",
+		e.name, e.holder.owner, e.holder.host, e.holder.acquiredAt.Format(time.RFC3339), e.holder.expiresAt.Format(time.RFC3339))
+	if len(e.released) > 0 {
+		message += fmt.Sprintf(", released %s rather than wait holding them and risk a lock-ordering deadlock", strings.Join(e.released, ", "))
+	}
+	return message
+}
+func (e *lockError) exitCode() int { return exitLock }
+
+// configError wraps invalid configuration, flags or arguments, exits with code 5
+type configError struct {
+	err error
+}
+
+func (e *configError) Error() string { return e.err.Error() }
+func (e *configError) Unwrap() error { return e.err }
+func (e *configError) exitCode() int { return exitConfig }
+
+// pendingError reports unapplied migrations found by migrate:pending, exits with code 6
+type pendingError struct {
+	count int
+	// quiet leaves the exit code as the only output (--quiet)
+	quiet bool
+}
+
+func (e *pendingError) Error() string { return fmt.Sprintf("%d pending migration(s)", e.count) }
+func (e *pendingError) exitCode() int { return exitPending }
+func (e *pendingError) silent() bool  { return e.quiet }
+
+// driftError reports applied migrations edited since they ran, found by migrate:check-drift, exits with code 7
+type driftError struct {
+	count int
+}
+
+func (e *driftError) Error() string {
+	return fmt.Sprintf("%d applied migration(s) changed since they ran", e.count)
+}
+func (e *driftError) exitCode() int { return exitDrift }
+
+func configErrorf(format string, args ...interface{}) error {
+	return &configError{err: fmt.Errorf(format, args...)}
+}
+
+// silent reports whether err should only set the exit code without being printed
+func silent(err error) bool {
+	var quiet interface{ silent() bool }
+	return errors.As(err, &quiet) && quiet.silent()
+}
+
+// exitCode maps an error returned by a command to the process exit code
+func exitCode(err error) int {
+	var coded interface{ exitCode() int }
+	if errors.As(err, &coded) {
+		return coded.exitCode()
+	}
+	return exitFailure
+}
+
+// errorReport is the --error-format json rendering of a failed command
+type errorReport struct {
+	Error string `json:"error"`
+	// connection, migration, lock, config, pending or failure
+	Type      string `json:"type"`
+	Code      int    `json:"code"`
+	Migration string `json:"migration,omitempty"`
+	// the ClickHouse exception behind the failure, if any
+	ClickHouseCode int32  `json:"clickhouse_code,omitempty"`
+	ClickHouseName string `json:"clickhouse_name,omitempty"`
+}
+
+func newErrorReport(err error) errorReport {
+	report := errorReport{Error: err.Error(), Type: "failure", Code: exitCode(err)}
+
+	var (
+		connection *connectionError
+		migration  *migrationError
+		lock       *lockError
+		config     *configError
+		pending    *pendingError
+		exception  *clickhouse.Exception
+	)
+	switch {
+	case errors.As(err, &connection):
+		report.Type = "connection"
+	case errors.As(err, &migration):
+		report.Type = "migration"
+		report.Migration = migration.name
+	case errors.As(err, &lock):
+		report.Type = "lock"
+	case errors.As(err, &config):
+		report.Type = "config"
+	case errors.As(err, &pending):
+		report.Type = "pending"
+	}
+
+	if errors.As(err, &exception) {
+		report.ClickHouseCode = exception.Code
+		report.ClickHouseName = errorCodes[exception.Code].name
+	}
+
+	return report
+}
+
+// printError reports a failed command on stderr, as text or as a JSON object for scripts (--error-format json)
+func printError(err error, format string) {
+	if format == "json" {
+		line, _ := json.Marshal(newErrorReport(err))
+		fmt.Fprintln(os.Stderr, string(line))
+		return
+	}
+	log.Println(err)
+}
+
+// isBrokenConnection reports whether err means the connection was closed under us (e.g. by the server after being
+// idle), rather than the query failing
+func isBrokenConnection(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+type errorCode struct {
+	name string
+	hint string
+}
+
+// errorCodes names the ClickHouse error codes migrations commonly run into, see ErrorCodes.cpp in ClickHouse
+var errorCodes = map[int32]errorCode{
+	15:  {"DUPLICATE_COLUMN", "use ADD COLUMN IF NOT EXISTS so the migration can be re-run"},
+	16:  {"NO_SUCH_COLUMN_IN_TABLE", "use DROP COLUMN IF EXISTS, or check the column was not renamed"},
+	36:  {"BAD_ARGUMENTS", ""},
+	44:  {"ILLEGAL_COLUMN", ""},
+	46:  {"UNKNOWN_FUNCTION", "the function may need a newer ClickHouse version"},
+	47:  {"UNKNOWN_IDENTIFIER", "a column referenced by the statement does not exist"},
+	50:  {"UNKNOWN_TYPE", "the type may need a newer ClickHouse version or an allow_experimental_ setting (see --setup-sql)"},
+	53:  {"TYPE_MISMATCH", ""},
+	57:  {"TABLE_ALREADY_EXISTS", "use CREATE TABLE IF NOT EXISTS so the migration can be re-run"},
+	60:  {"UNKNOWN_TABLE", "the table does not exist yet, check the migration order or add a requires directive"},
+	62:  {"SYNTAX_ERROR", "check the statement near the position reported by ClickHouse"},
+	81:  {"UNKNOWN_DATABASE", "create the database or check DB_NAME"},
+	115: {"UNKNOWN_SETTING", "check the setting names in the migration header and --setup-sql"},
+	159: {"TIMEOUT_EXCEEDED", "raise the limit with a '-- logme:timeout SECONDS' header"},
+	164: {"READONLY", "DB_USER is read-only, migrations need a user allowed to write"},
+	497: {"ACCESS_DENIED", "grant DB_USER the privileges the statement needs"},
+	516: {"AUTHENTICATION_FAILED", "check DB_USER and DB_PASS"},
+}
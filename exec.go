@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// statements that drop, empty or rewrite data, exec runs them on a non-test database only with --force
+var destructiveStatementRegexp = regexp.MustCompile(`(?is)^(DROP|TRUNCATE|DETACH|RENAME|EXCHANGE|DELETE\s+FROM|ALTER\s+TABLE\s.*\b(DROP|DELETE|UPDATE|CLEAR|REPLACE)\b)`)
+
+// tablePlaceholder is replaced by each table name when exec runs over several tables
+const tablePlaceholder = "{table}"
+
+// execSQL runs the statements of sql (or of file, or read from stdin when set) against the database. Given tables,
+// the statements run once per table with {table} replaced by its name, on a pool of concurrency workers, and every
+// table is attempted before the failures are reported
+func execSQL(out io.Writer, isTest bool, table string, sql string, file string, stdin io.Reader, tables []string, all bool, concurrency int, force bool) error {
+	sources := 0
+	for _, given := range []bool{strings.TrimSpace(sql) != "", file != "", stdin != nil} {
+		if given {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return configErrorf("exec takes its SQL from one of the arguments, --file or --stdin")
+	}
+
+	switch {
+	case file != "":
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sql = string(content)
+	case stdin != nil:
+		content, err := io.ReadAll(stdin)
+		if err != nil {
+			return err
+		}
+		sql = string(content)
+	}
+	statements := splitStatements(sql)
+	if len(statements) == 0 {
+		return configErrorf("exec requires a SQL statement, --file or --stdin")
+	}
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+	if concurrency < 1 {
+		return configErrorf("invalid --concurrency %d: expected at least 1", concurrency)
+	}
+	batch := len(tables) > 0 || all
+	if batch && !strings.Contains(sql, tablePlaceholder) {
+		return configErrorf("exec over tables requires %s in the SQL, e.g. OPTIMIZE TABLE %s FINAL", tablePlaceholder, tablePlaceholder)
+	}
+
+	for _, statement := range statements {
+		if !destructiveStatementRegexp.MatchString(stripLeadingComments(statement)) {
+			continue
+		}
+		if err := guardProfile(force); err != nil {
+			return err
+		}
+		if dbName := getDbName(isTest); !force && !isTestDatabase(dbName) {
+			return configErrorf("refusing to run %s against non-test database '%s' without --force", sqlPreview(statement, 60), dbName)
+		}
+	}
+
+	poolSize = concurrency
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if !batch {
+		for _, statement := range statements {
+			start := time.Now()
+			if err := db.Exec(ctx, statement); err != nil {
+				return fmt.Errorf("%s: %w", sqlPreview(statement, 60), err)
+			}
+			fmt.Fprintf(out, "Ran: %s (%s)\n", sqlPreview(statement, 60), time.Since(start).Round(time.Millisecond))
+		}
+		return nil
+	}
+
+	if all {
+		if tables, err = dataTables(ctx, db, table); err != nil {
+			return err
+		}
+	}
+
+	out = &lockedWriter{w: out}
+	failures := forEachTable(tables, concurrency, func(name string) error {
+		start := time.Now()
+		for _, statement := range splitStatements(strings.ReplaceAll(sql, tablePlaceholder, quoteIdentifier(name))) {
+			if err := db.Exec(ctx, statement); err != nil {
+				return fmt.Errorf("%s: %w", sqlPreview(statement, 60), err)
+			}
+		}
+		fmt.Fprintf(out, "Ran on: %s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+		return nil
+	})
+
+	return reportTableFailures(out, failures, len(tables))
+}
+
+// tableFailure is the error of one table of a batch run by forEachTable
+type tableFailure struct {
+	table string
+	err   error
+}
+
+// forEachTable runs fn for every table on a pool of concurrency workers, serially in the order of tables when it is
+// 1. Every table is attempted, the failures are returned in the order of tables
+func forEachTable(tables []string, concurrency int, fn func(table string) error) []tableFailure {
+	errs := make([]error, len(tables))
+	next := make(chan int)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency && w < len(tables); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				errs[i] = fn(tables[i])
+			}
+		}()
+	}
+	for i := range tables {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	var failures []tableFailure
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, tableFailure{table: tables[i], err: err})
+		}
+	}
+	return failures
+}
+
+// reportTableFailures prints the failures of a batch once every table was attempted
+func reportTableFailures(out io.Writer, failures []tableFailure, total int) error {
+	if len(failures) == 0 {
+		return nil
+	}
+
+	names := make([]string, len(failures))
+	for i, failure := range failures {
+		fmt.Fprintf(out, "Failed: %s: %v\n", failure.table, failure.err)
+		names[i] = failure.table
+	}
+
+	return fmt.Errorf("%d of %d table(s) failed: %s", len(failures), total, strings.Join(names, ", "))
+}
+
+// dataTables lists the tables of the database holding data, the migrations table, its lock and views aside. Materialized
+// views are listed rather than their .inner tables
+func dataTables(ctx context.Context, db driver.Conn, table string) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT name
+		FROM system.tables
+		WHERE database = currentDatabase()
+			AND name NOT IN ($1, $2)
+			AND engine NOT IN ('View', 'LiveView', 'WindowView', 'Dictionary')
+			AND NOT startsWith(name, '.inner')
+			AND NOT is_temporary
+		ORDER BY name
+	`, table, lockTableName(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+
+	return tables, rows.Err()
+}
+
+// lockedWriter serializes the writes of concurrent workers, each Fprintf is one line
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
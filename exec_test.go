@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestForEachTableAttemptsEveryTable(t *testing.T) {
+	tables := []string{"a", "b", "c", "d"}
+
+	var (
+		mu        sync.Mutex
+		attempted []string
+	)
+	failures := forEachTable(tables, 1, func(table string) error {
+		mu.Lock()
+		attempted = append(attempted, table)
+		mu.Unlock()
+		if table == "b" || table == "d" {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	// serial runs keep the order of the tables
+	if !reflect.DeepEqual(attempted, tables) {
+		t.Errorf("attempted %v, want %v", attempted, tables)
+	}
+	if len(failures) != 2 || failures[0].table != "b" || failures[1].table != "d" {
+		t.Errorf("failures = %v, want b and d", failures)
+	}
+}
+
+func TestForEachTableBoundsConcurrency(t *testing.T) {
+	tables := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+
+	var (
+		mu             sync.Mutex
+		running, peak  int
+		attemptedCount int
+	)
+	failures := forEachTable(tables, 3, func(table string) error {
+		mu.Lock()
+		running++
+		attemptedCount++
+		if running > peak {
+			peak = running
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+
+	if len(failures) != 0 {
+		t.Errorf("failures = %v", failures)
+	}
+	if attemptedCount != len(tables) {
+		t.Errorf("attempted %d table(s), want %d", attemptedCount, len(tables))
+	}
+	if peak > 3 {
+		t.Errorf("%d tables ran at once with a concurrency of 3", peak)
+	}
+}
+
+func TestDestructiveStatementRegexp(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"SELECT 1", false},
+		{"OPTIMIZE TABLE events FINAL", false},
+		{"ALTER TABLE events ADD COLUMN b String", false},
+		{"INSERT INTO events VALUES (1)", false},
+		{"DROP TABLE events", true},
+		{"truncate table events", true},
+		{"ALTER TABLE events DROP COLUMN b", true},
+		{"ALTER TABLE events DELETE WHERE id = 1", true},
+		{"ALTER TABLE events UPDATE b = 'x' WHERE 1", true},
+		{"DELETE FROM events WHERE id = 1", true},
+		{"RENAME TABLE a TO b", true},
+	}
+
+	for _, test := range tests {
+		if got := destructiveStatementRegexp.MatchString(test.sql); got != test.want {
+			t.Errorf("destructive(%q) = %v, want %v", test.sql, got, test.want)
+		}
+	}
+}
+
+func TestExecSQLTakesOneSource(t *testing.T) {
+	tests := []struct {
+		name  string
+		sql   string
+		file  string
+		stdin io.Reader
+	}{
+		{"arguments and stdin", "SELECT 1", "", strings.NewReader("SELECT 2")},
+		{"file and stdin", "", "statements.sql", strings.NewReader("SELECT 2")},
+		{"empty stdin", "", "", strings.NewReader("-- nothing to run\n")},
+	}
+
+	for _, test := range tests {
+		err := execSQL(io.Discard, true, "migrations", test.sql, test.file, test.stdin, nil, false, 1, false)
+		if exitCode(err) != exitConfig {
+			t.Errorf("%s: execSQL() = %v, want a configuration error", test.name, err)
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// outputFormats are the formats accepted by --format of the commands printing tables
+var outputFormats = []string{"text", "json", "markdown"}
+
+// outputFormat validates --format, --json being the older spelling of --format json
+func outputFormat(format string, jsonOutput bool) (string, error) {
+	if jsonOutput {
+		return "json", nil
+	}
+	if !containsString(outputFormats, format) {
+		return "", configErrorf("invalid --format '%s': expected one of %s", format, strings.Join(outputFormats, ", "))
+	}
+	return format, nil
+}
+
+// writeMarkdownTable prints a GitHub-flavored Markdown table, escaping the cell content that would break it
+func writeMarkdownTable(out io.Writer, header []string, rows [][]string) error {
+	escape := strings.NewReplacer("|", `\|`, "\r\n", " ", "\n", " ")
+
+	line := func(cells []string) error {
+		escaped := make([]string, len(cells))
+		for i, cell := range cells {
+			escaped[i] = escape.Replace(cell)
+		}
+		_, err := fmt.Fprintln(out, "| "+strings.Join(escaped, " | ")+" |")
+		return err
+	}
+
+	if err := line(header); err != nil {
+		return err
+	}
+	separator := make([]string, len(header))
+	for i := range separator {
+		separator[i] = "---"
+	}
+	if err := line(separator); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := line(row); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// markdownCode renders a value as inline code, types such as Array(String) would otherwise be read as Markdown
+func markdownCode(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "`" + value + "`"
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// fresh drops every table and view of the database, the migrations table included, and applies every migration
+// again. With plan it only prints what would be dropped and applied
+func fresh(isTest bool, opts migrateOptions, force bool, plan bool) error {
+	if err := validateTableName(opts.table); err != nil {
+		return err
+	}
+	if err := guardProfile(force); err != nil {
+		return err
+	}
+	dbName := getDbName(isTest)
+	if !force && !isTestDatabase(dbName) {
+		return configErrorf("refusing to wipe non-test database '%s' without --force", dbName)
+	}
+
+	var (
+		db  driver.Conn
+		err error
+	)
+	if plan {
+		db, err = getReadonlyDbConn(isTest)
+	} else {
+		db, err = getDbConn(isTest)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	// held through the migrations, which run under it rather than taking it again
+	if !plan {
+		lock, err := acquireGlobalLock(ctx, opts.out, db, opts.table, opts.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+		opts.locked = true
+	}
+
+	listed, err := databaseTables(ctx, db)
+	if err != nil {
+		return err
+	}
+	// the lock table outlives the wipe, fresh holds its lock
+	var tables []string
+	for _, table := range listed {
+		if table != lockTableName(opts.table) {
+			tables = append(tables, table)
+		}
+	}
+
+	if plan {
+		fmt.Fprintf(opts.out, "Plan for database '%s', nothing is changed:\n", dbName)
+		for _, table := range tables {
+			fmt.Fprintln(opts.out, "Would drop: "+table)
+		}
+		names, err := migrationFiles()
+		if err != nil {
+			return err
+		}
+		var serverVersion string
+		if err := db.QueryRow(ctx, "SELECT version()").Scan(&serverVersion); err != nil {
+			return err
+		}
+		applied := 0
+		for _, name := range names {
+			_, reason, err := migrationSkip(name, serverVersion)
+			if err != nil {
+				return err
+			}
+			if reason != "" {
+				fmt.Fprintln(opts.out, "Would skip: "+name+" ("+reason+")")
+				continue
+			}
+			fmt.Fprintln(opts.out, "Would apply: "+name)
+			applied++
+		}
+		fmt.Fprintf(opts.out, "%d table(s) would be dropped and %d migration(s) applied\n", len(tables), applied)
+		return nil
+	}
+
+	for _, table := range tables {
+		// SYNC frees the name right away, the migrations create the same tables again
+		if err := db.Exec(ctx, "DROP TABLE IF EXISTS "+quoteIdentifier(table)+" SYNC"); err != nil {
+			return fmt.Errorf("dropping %s: %w", table, err)
+		}
+		fmt.Fprintln(opts.out, "Dropped: "+table)
+	}
+
+	return migrate(isTest, opts)
+}
+
+// migrateReset reverts every applied migration, newest first, by running its down migration. With plan it only
+// prints the migrations that would be reverted
+func migrateReset(out io.Writer, isTest bool, table string, force bool, plan bool, lockTTL time.Duration) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+	if err := guardProfile(force); err != nil {
+		return err
+	}
+	dbName := getDbName(isTest)
+	if !force && !isTestDatabase(dbName) {
+		return configErrorf("refusing to reset non-test database '%s' without --force", dbName)
+	}
+
+	var (
+		db  driver.Conn
+		err error
+	)
+	if plan {
+		db, err = getReadonlyDbConn(isTest)
+	} else {
+		db, err = getDbConn(isTest)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var exists uint8
+	if err := db.QueryRow(ctx, "EXISTS TABLE "+table).Scan(&exists); err != nil {
+		return err
+	}
+	if exists != 1 {
+		fmt.Fprintln(out, "No applied migrations")
+		return nil
+	}
+
+	applied, err := appliedInOrder(ctx, db, table)
+	if err != nil {
+		return err
+	}
+
+	// without a down migration the schema change would stay while the migration shows as unapplied
+	var missing []string
+	for _, name := range applied {
+		if _, err := os.Stat(migrationPath(downMigrationName(name))); err != nil {
+			missing = append(missing, downMigrationName(name))
+		}
+	}
+
+	if plan {
+		fmt.Fprintf(out, "Plan for database '%s', nothing is changed:\n", dbName)
+		for i := len(applied) - 1; i >= 0; i-- {
+			fmt.Fprintln(out, "Would revert: "+applied[i])
+		}
+		for _, down := range missing {
+			fmt.Fprintln(out, "warning: "+down+" is missing, the reset would fail before reverting anything")
+		}
+		fmt.Fprintf(out, "%d migration(s) would be reverted\n", len(applied))
+		return nil
+	}
+
+	if len(missing) > 0 {
+		return configErrorf("cannot reset, down migrations missing: %s", strings.Join(missing, ", "))
+	}
+
+	lock, err := acquireGlobalLock(ctx, out, db, table, lockTTL)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	// read again under the lock, a run may have applied more migrations meanwhile
+	if applied, err = appliedInOrder(ctx, db, table); err != nil {
+		return err
+	}
+	for _, name := range applied {
+		if _, err := os.Stat(migrationPath(downMigrationName(name))); err != nil {
+			return configErrorf("cannot reset, down migrations missing: %s", downMigrationName(name))
+		}
+	}
+
+	for i := len(applied) - 1; i >= 0; i-- {
+		if err := revertMigration(ctx, out, db, table, applied[i]); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(out, "Reset: reverted %d migration(s)\n", len(applied))
+
+	return nil
+}
+
+// databaseTables lists the tables of the database, views first as they select from the others. The .inner tables
+// of materialized views are left out, they go with their view
+func databaseTables(ctx context.Context, db driver.Conn) ([]string, error) {
+	rows, err := db.Query(ctx, `
+		SELECT name
+		FROM system.tables
+		WHERE database = currentDatabase() AND NOT is_temporary AND NOT startsWith(name, '.inner')
+		ORDER BY engine NOT LIKE '%View', name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		tables = append(tables, name)
+	}
+
+	return tables, rows.Err()
+}
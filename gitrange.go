@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// changedMigrations returns the names of the migration files added or modified since ref, committed or not,
+// untracked files included
+func changedMigrations(ref string) (map[string]bool, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, configErrorf("--since-commit needs git, which is not in PATH")
+	}
+	if _, err := runGit("rev-parse", "--git-dir"); err != nil {
+		return nil, configErrorf("--since-commit needs a git repository: %s", err)
+	}
+
+	diff, err := runGit(append([]string{"diff", "--name-only", "--diff-filter=AMR", ref, "--"}, migrationDirs...)...)
+	if err != nil {
+		return nil, configErrorf("cannot list the migrations changed since %s: %s", ref, err)
+	}
+	untracked, err := runGit(append([]string{"ls-files", "--others", "--exclude-standard", "--"}, migrationDirs...)...)
+	if err != nil {
+		return nil, err
+	}
+
+	changed := map[string]bool{}
+	for _, path := range strings.Fields(diff + "\n" + untracked) {
+		changed[filepath.Base(path)] = true
+	}
+
+	return changed, nil
+}
+
+func runGit(args ...string) (string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+
+	out, err := cmd.Output()
+	if err != nil {
+		if message := strings.TrimSpace(stderr.String()); message != "" {
+			return "", fmt.Errorf("%s", message)
+		}
+		return "", err
+	}
+
+	return string(out), nil
+}
+
+// sinceCommitMigrations keeps the pending migrations changed since ref, in order, warning about the others. A kept
+// migration requiring one that is left out would run before its dependency, so that is an error
+func sinceCommitMigrations(opts migrateOptions, pending []string) ([]string, error) {
+	changed, err := changedMigrations(opts.sinceCommit)
+	if err != nil {
+		return nil, err
+	}
+
+	var kept, left []string
+	leftOut := map[string]bool{}
+	for _, name := range pending {
+		if changed[name] {
+			kept = append(kept, name)
+		} else {
+			left = append(left, name)
+			leftOut[name] = true
+		}
+	}
+
+	for _, name := range kept {
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, required := range directiveList(readDirectives(content), "requires") {
+			if leftOut[required] {
+				return nil, configErrorf("migration %s requires %s, which is pending but not changed since %s", name, required, opts.sinceCommit)
+			}
+		}
+	}
+
+	if len(left) > 0 {
+		fmt.Fprintf(opts.out, "warning: skipping %d unapplied migration(s) not changed since %s: %s\n", len(left), opts.sinceCommit, strings.Join(left, ", "))
+	}
+
+	return kept, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// how often up --wait-healthy polls the containers
+const healthPollInterval = time.Second
+
+// waitHealthy waits until the containers of every service (all of the compose file when none are given) with a
+// healthcheck report healthy, printing each change of a service's health. Services without a healthcheck are not
+// waited for
+func waitHealthy(out io.Writer, services []string, timeout time.Duration) error {
+	if len(services) == 0 {
+		var err error
+		if services, err = composeLines("config", "--services"); err != nil {
+			return err
+		}
+	}
+
+	last := map[string]string{}
+	deadline := time.Now().Add(timeout)
+
+	for {
+		var waiting []string
+		for _, service := range services {
+			status, err := serviceHealth(service)
+			if err != nil {
+				return err
+			}
+			if status != last[service] {
+				fmt.Fprintln(out, service+": "+status)
+				last[service] = status
+			}
+			if status != "healthy" && status != "no healthcheck" {
+				waiting = append(waiting, service)
+			}
+		}
+
+		if len(waiting) == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			sort.Strings(waiting)
+			return fmt.Errorf("services not healthy after %s: %s", timeout, strings.Join(waiting, ", "))
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
+
+// serviceHealth is the health of the containers of a service, the least healthy one when it is scaled: not running,
+// unhealthy, starting, healthy or no healthcheck
+func serviceHealth(service string) (string, error) {
+	ids, err := composeLines("ps", "-q", service)
+	if err != nil {
+		return "", err
+	}
+	if len(ids) == 0 {
+		return "not running", nil
+	}
+
+	rank := map[string]int{"not running": 0, "unhealthy": 1, "starting": 2, "healthy": 3, "no healthcheck": 4}
+
+	worst := "no healthcheck"
+	for _, id := range ids {
+		cmd, err := dockerCommand("inspect", "--format", "{{if not .State.Running}}not running{{else if .State.Health}}{{.State.Health.Status}}{{else}}no healthcheck{{end}}", id)
+		if err != nil {
+			return "", err
+		}
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("inspecting container %s of %s: %w", id, service, err)
+		}
+
+		status := strings.TrimSpace(string(output))
+		if r, known := rank[status]; known && r < rank[worst] {
+			worst = status
+		}
+	}
+
+	return worst, nil
+}
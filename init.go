@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// initEnvVars are the variables the .env written by init sets, the rest of envVars is listed commented out
+var initEnvVars = []string{"DB_ADDR", "DB_NAME"}
+
+const starterMigration = `-- first migration, replace with the schema for your tables
+CREATE TABLE IF NOT EXISTS example (
+    id   UUID,
+    dt   DateTime
+) engine=MergeTree() ORDER BY (dt)
+`
+
+func initProject(out io.Writer, force bool, withMigration bool) error {
+	if _, err := os.Stat(".env"); err == nil && !force {
+		return configErrorf(".env already exists, use --force to overwrite it")
+	}
+
+	var env bytes.Buffer
+	writeEnvTemplate(&env, "init", initEnvVars...)
+	if err := os.WriteFile(".env", env.Bytes(), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Created: .env")
+
+	dir := migrationDirs[0]
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Created: "+dir)
+	}
+
+	if !withMigration {
+		return nil
+	}
+
+	starter := dir + "001_initial.sql"
+	if _, err := os.Stat(starter); err == nil {
+		fmt.Fprintln(out, "Skipped: "+starter+" already exists")
+		return nil
+	}
+
+	if err := os.WriteFile(starter, []byte(starterMigration), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Created: "+starter)
+
+	return nil
+}
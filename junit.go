@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/xml"
+	"os"
+	"time"
+)
+
+// junitReport records a migration run in the JUnit XML format read by CI dashboards, one test case per migration
+type junitReport struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func newJunitReport() *junitReport {
+	return &junitReport{Name: "migrations"}
+}
+
+func (r *junitReport) add(name string, elapsed time.Duration, err error) {
+	c := junitCase{Name: name, ClassName: r.Name, Time: elapsed.Seconds()}
+	if err != nil {
+		c.Failure = &junitMessage{Message: err.Error(), Text: err.Error()}
+		r.Failures++
+	}
+	r.Cases = append(r.Cases, c)
+	r.Tests++
+	r.Time += c.Time
+}
+
+func (r *junitReport) skip(name string, reason string) {
+	r.Cases = append(r.Cases, junitCase{Name: name, ClassName: r.Name, Skipped: &junitMessage{Message: reason}})
+	r.Tests++
+	r.Skipped++
+}
+
+func (r *junitReport) write(path string) error {
+	out, err := xml.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(out, '\n')...), 0644)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const lintConfigFile = ".logme-lint"
+
+// lintRules are the checks of migrate:lint and whether they run without a .logme-lint saying otherwise, on-cluster
+// only makes sense for clustered deployments
+var lintRules = map[string]bool{
+	"prefix":     true,
+	"down":       true,
+	"drop-table": true,
+	"on-cluster": false,
+	"empty":      true,
+}
+
+var (
+	// statements changing the data or structure of existing tables, which need ON CLUSTER to reach every replica
+	clusterStatementRegexp = regexp.MustCompile(`(?i)^(ALTER\s+TABLE|DELETE\s+FROM)\b`)
+	onClusterRegexp        = regexp.MustCompile(`(?i)\bON\s+CLUSTER\b`)
+)
+
+type lintViolation struct {
+	path string
+	line int
+	rule string
+	text string
+}
+
+// migrateLint checks every migration against the enabled rules, printing each violation as path:line: rule: message
+func migrateLint(out io.Writer) error {
+	rules, err := readLintConfig(filepath.Join(projectRoot, lintConfigFile))
+	if err != nil {
+		return err
+	}
+
+	names, err := migrationFiles()
+	if err != nil {
+		return err
+	}
+
+	width := 3
+	for _, name := range names {
+		if match := migrationPrefixRegexp.FindStringSubmatch(name); match != nil && len(match[1]) > width {
+			width = len(match[1])
+		}
+	}
+
+	var violations []lintViolation
+	for _, name := range names {
+		found, err := lintMigration(name, rules, width)
+		if err != nil {
+			return err
+		}
+		violations = append(violations, found...)
+	}
+
+	files := map[string]bool{}
+	for _, v := range violations {
+		files[v.path] = true
+		fmt.Fprintf(out, "%s:%d: %s: %s\n", v.path, v.line, v.rule, v.text)
+	}
+
+	if len(violations) > 0 {
+		return &migrationError{err: fmt.Errorf("%d violation(s) in %d of %d migration(s)", len(violations), len(files), len(names))}
+	}
+
+	fmt.Fprintf(out, "Lint OK: %d migration(s)\n", len(names))
+
+	return nil
+}
+
+func lintMigration(name string, rules map[string]bool, width int) ([]lintViolation, error) {
+	path := migrationPath(name)
+
+	var violations []lintViolation
+	report := func(line int, rule string, format string, args ...interface{}) {
+		if rules[rule] {
+			violations = append(violations, lintViolation{path: path, line: line, rule: rule, text: fmt.Sprintf(format, args...)})
+		}
+	}
+
+	match := migrationPrefixRegexp.FindStringSubmatch(name)
+	switch {
+	case match == nil:
+		report(1, "prefix", "name does not start with a numeric prefix (e.g. %0*d_...)", width, 1)
+	case len(match[1]) < width:
+		report(1, "prefix", "prefix %s is not zero-padded to %d digits", match[1], width)
+	}
+
+	// scripts are programs, there is no SQL to check and no down migration
+	if isScriptMigration(name) {
+		return violations, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(name, ".sql") {
+		if _, err := os.Stat(migrationPath(downMigrationName(name))); errors.Is(err, os.ErrNotExist) {
+			report(1, "down", "no down migration %s", downMigrationName(name))
+		}
+	}
+
+	sql := string(content)
+	statements := splitStatements(sql)
+	if len(statements) == 0 {
+		report(1, "empty", "no SQL statements")
+	}
+
+	allowDrop := len(readDirectives(content)["allow-drop"]) > 0
+	offset := 0
+	for _, statement := range statements {
+		code := stripLeadingComments(statement)
+		if code == "" {
+			continue
+		}
+
+		// line of the statement's code, after the comments leading it
+		start := offset + strings.Index(sql[offset:], statement)
+		offset = start + len(statement)
+		comments := statement[:strings.Index(statement, code)]
+		line := strings.Count(sql[:start], "\n") + strings.Count(comments, "\n") + 1
+
+		if dropTableRegexp.MatchString(code) && !allowDrop && !strings.Contains(comments, directivePrefix+"allow-drop") {
+			report(line, "drop-table", "DROP TABLE without a \"%sallow-drop\" comment confirming it", directivePrefix)
+		}
+		if clusterStatementRegexp.MatchString(code) && !onClusterRegexp.MatchString(code) {
+			report(line, "on-cluster", "%s without ON CLUSTER", strings.ToUpper(strings.Join(strings.Fields(code)[:2], " ")))
+		}
+	}
+
+	return violations, nil
+}
+
+// readLintConfig overlays the rules switched on or off in a .logme-lint file (e.g. "down: false") on the defaults,
+// the file is optional
+func readLintConfig(path string) (map[string]bool, error) {
+	rules := map[string]bool{}
+	for rule, enabled := range lintRules {
+		rules[rule] = enabled
+	}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return rules, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var overrides map[string]bool
+	if err := yaml.Unmarshal(content, &overrides); err != nil {
+		return nil, configErrorf("invalid %s: %s", path, err)
+	}
+
+	var unknown []string
+	for rule, enabled := range overrides {
+		if _, ok := lintRules[rule]; !ok {
+			unknown = append(unknown, rule)
+			continue
+		}
+		rules[rule] = enabled
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, configErrorf("unknown rules in %s: %s", path, strings.Join(unknown, ", "))
+	}
+
+	return rules, nil
+}
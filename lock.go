@@ -0,0 +1,405 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/google/uuid"
+)
+
+// globalLock is the name of the lock row taken by the runs of migrations without a "-- logme:locks" header
+const globalLock = "global"
+
+// tableLockPrefix starts the names of the lock rows of the tables of "-- logme:locks" headers
+const tableLockPrefix = "table:"
+
+// defaultLockTTL is how long a lock outlives a runner that stopped renewing it (--lock-ttl)
+const defaultLockTTL = 5 * time.Minute
+
+// migrationLock is a lease on rows of the lock table, renewed by a heartbeat until released. ClickHouse has no
+// transactions, so it is advisory: every runner inserts a claim row per lock and the earliest claim that has not
+// expired owns it, later claims lose however their inserts and reads interleave (see lockOwners)
+type migrationLock struct {
+	db    driver.Conn
+	table string
+	names []string
+	owner string
+	ttl   time.Duration
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// lockTableName is the table holding the locks of the migrations table
+func lockTableName(table string) string {
+	return table + "_lock"
+}
+
+func lockTableDDL(table string) string {
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+			name        String,
+			owner       String,
+			host        String,
+			acquired_at DateTime64(3),
+			expires_at  DateTime64(3),
+			released    UInt8,
+			updated_at  DateTime64(3)
+		) engine=ReplacingMergeTree(updated_at) ORDER BY (name, owner)
+		TTL toDateTime(expires_at) + INTERVAL 1 DAY
+	`, table)
+}
+
+// migrationLocks returns the locks a run of the migrations takes: the locks of the tables their "-- logme:locks
+// table_a,table_b" headers declare, sorted, or the global lock when one of them has no header, it may change anything
+func migrationLocks(names []string) ([]string, error) {
+	var locks []string
+	for _, name := range names {
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return nil, err
+		}
+
+		tables := directiveList(readDirectives(content), "locks")
+		if len(tables) == 0 {
+			return []string{globalLock}, nil
+		}
+		for _, table := range tables {
+			// a database qualified name is allowed, each part must be a plain identifier
+			for _, part := range strings.Split(table, ".") {
+				if !identifierRegexp.MatchString(part) {
+					return nil, configErrorf("%s: invalid logme:locks table name '%s'", name, table)
+				}
+			}
+			if lock := tableLockPrefix + table; !containsString(locks, lock) {
+				locks = append(locks, lock)
+			}
+		}
+	}
+
+	// the same order in every run, see acquireMigrationLocks
+	sort.Strings(locks)
+
+	return locks, nil
+}
+
+// acquireMigrationLocks takes the locks names of the migrations table for ttl, renewed every third of ttl until
+// released. A lock held by another runner fails with a lockError, one whose lease expired (its runner died) is taken
+// over. The global lock and the table locks exclude each other.
+//
+// The locks are taken at once in sorted order and a run never waits holding some of them: when another runner took
+// one of them meanwhile, the ones won are released and the run fails rather than risk a lock-ordering deadlock
+func acquireMigrationLocks(ctx context.Context, out io.Writer, db driver.Conn, table string, names []string, ttl time.Duration) (*migrationLock, error) {
+	if ttl < time.Second {
+		return nil, configErrorf("invalid --lock-ttl %s: expected at least 1s", ttl)
+	}
+
+	lockTable := lockTableName(table)
+	if err := withRetry(func() error { return db.Exec(ctx, lockTableDDL(lockTable)) }); err != nil {
+		return nil, err
+	}
+
+	holders, err := readLocks(ctx, db, lockTable)
+	if err != nil {
+		return nil, err
+	}
+	if name, ok := lockConflict(holders, names, ""); ok {
+		return nil, &lockError{name: name, holder: holders[name]}
+	}
+	for _, name := range names {
+		if holder := holders[name]; holder.owner != "" {
+			fmt.Fprintf(out, "Reclaimed stale %s lock of %s on %s, expired at %s\n", name, holder.owner, holder.host, holder.expiresAt.Format(time.RFC3339))
+		}
+	}
+
+	hostname, _ := os.Hostname()
+	host := fmt.Sprintf("%s (pid %d)", hostname, os.Getpid())
+	lock := &migrationLock{
+		db:    db,
+		table: lockTable,
+		names: names,
+		owner: uuid.NewString(),
+		ttl:   ttl,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	for _, name := range names {
+		if err := db.Exec(ctx, fmt.Sprintf(
+			"INSERT INTO %s (name, owner, host, acquired_at, expires_at, released, updated_at) SELECT %s, %s, %s, now64(3), now64(3) + toIntervalMillisecond(%d), 0, now64(3)",
+			lockTable, quoteString(name), quoteString(lock.owner), quoteString(host), ttl.Milliseconds(),
+		)); err != nil {
+			// the rows already inserted expire if they cannot be released either
+			releaseLocks(ctx, db, lockTable, names, lock.owner)
+			return nil, err
+		}
+	}
+
+	// another runner may have claimed the same locks at the same time, the earliest claims own them
+	if holders, err = readLocks(ctx, db, lockTable); err != nil {
+		releaseLocks(ctx, db, lockTable, names, lock.owner)
+		return nil, err
+	}
+	if name, ok := lockConflict(holders, names, lock.owner); ok {
+		var won []string
+		for _, name := range names {
+			if holders[name].owner == lock.owner {
+				won = append(won, name)
+			}
+		}
+		releaseLocks(ctx, db, lockTable, names, lock.owner)
+		return nil, &lockError{name: name, holder: holders[name], released: won}
+	}
+
+	go lock.heartbeat()
+
+	return lock, nil
+}
+
+// acquireGlobalLock takes the global lock for a command rewriting the migrations table or dropping tables outside a
+// migrate run, so no run starts meanwhile and it does not start during one
+func acquireGlobalLock(ctx context.Context, out io.Writer, db driver.Conn, table string, ttl time.Duration) (*migrationLock, error) {
+	return acquireMigrationLocks(ctx, out, db, table, []string{globalLock}, ttl)
+}
+
+// lockConflict returns the lock held by a runner other than owner that keeps names from being taken: one of names,
+// the global lock for table locks, or any table lock for the global one
+func lockConflict(holders map[string]lockHolder, names []string, owner string) (string, bool) {
+	blocking := append([]string{globalLock}, names...)
+	if containsString(names, globalLock) {
+		blocking = make([]string, 0, len(holders))
+		for name := range holders {
+			blocking = append(blocking, name)
+		}
+		sort.Strings(blocking)
+	}
+
+	for _, name := range blocking {
+		if holder := holders[name]; holder.held() && holder.owner != owner {
+			return name, true
+		}
+	}
+
+	return "", false
+}
+
+// heartbeat extends the leases until the locks are released, a failed renewal is retried on the next beat. Only the
+// claims that own their lock are extended, keeping their acquired_at, so a renewal never changes the owner
+func (l *migrationLock) heartbeat() {
+	defer close(l.done)
+
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	lost := false
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx := context.Background()
+			err := l.db.Exec(ctx, fmt.Sprintf(`
+				INSERT INTO %[1]s (name, owner, host, acquired_at, expires_at, released, updated_at)
+				SELECT name, owner, host, acquired_at, now64(3) + toIntervalMillisecond(%[2]d), 0, now64(3)
+				FROM %[1]s FINAL
+				WHERE name IN (%[3]s) AND owner = %[4]s AND (name, owner) IN (
+					SELECT name, argMin(owner, (acquired_at, owner))
+					FROM %[1]s FINAL
+					WHERE NOT released AND expires_at > now64(3)
+					GROUP BY name
+				)`,
+				l.table, l.ttl.Milliseconds(), quoteStrings(l.names), quoteString(l.owner),
+			))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "warning: renewing the "+strings.Join(l.names, ", ")+" migration lock: "+err.Error())
+				continue
+			}
+
+			// a lease that ran out before it was renewed may have been claimed by another runner
+			holders, err := readLocks(ctx, l.db, l.table)
+			if err != nil || lost {
+				continue
+			}
+			for _, name := range l.names {
+				if holders[name].owner != l.owner {
+					lost = true
+					fmt.Fprintln(os.Stderr, "warning: lost the "+name+" migration lock, its lease expired before it was renewed")
+				}
+			}
+		}
+	}
+}
+
+// release stops the heartbeat and frees the locks, an error leaves them to expire
+func (l *migrationLock) release() {
+	close(l.stop)
+	<-l.done
+
+	if err := releaseLocks(context.Background(), l.db, l.table, l.names, l.owner); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: releasing the "+strings.Join(l.names, ", ")+" migration lock, it expires in "+l.ttl.String()+": "+err.Error())
+	}
+}
+
+// releaseLocks withdraws the claims of owner on the locks names, every claim on them when owner is empty
+func releaseLocks(ctx context.Context, db driver.Conn, lockTable string, names []string, owner string) error {
+	condition := ""
+	if owner != "" {
+		condition = " AND owner = " + quoteString(owner)
+	}
+	return db.Exec(ctx, fmt.Sprintf(
+		"INSERT INTO %s (name, owner, host, acquired_at, expires_at, released, updated_at) SELECT name, owner, host, acquired_at, now64(3), 1, now64(3) FROM %s FINAL WHERE name IN (%s) AND NOT released%s",
+		lockTable, lockTable, quoteStrings(names), condition,
+	))
+}
+
+func quoteStrings(values []string) string {
+	quoted := make([]string, len(values))
+	for i, value := range values {
+		quoted[i] = quoteString(value)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// lockHolder is the claim owning a lock, or the last one that expired without being released. A free lock has no owner
+type lockHolder struct {
+	owner      string
+	host       string
+	acquiredAt time.Time
+	expiresAt  time.Time
+	// expired by the clock of the server, the runners' clocks may disagree
+	expired bool
+}
+
+func (h lockHolder) held() bool {
+	return h.owner != "" && !h.expired
+}
+
+// lockClaim is a row of the lock table, a runner's claim on a lock that was not released
+type lockClaim struct {
+	name   string
+	holder lockHolder
+}
+
+// readLocks returns the holder of every lock of the lock table, see lockOwners
+func readLocks(ctx context.Context, db driver.Conn, lockTable string) (map[string]lockHolder, error) {
+	rows, err := db.Query(ctx, fmt.Sprintf(
+		"SELECT name, owner, host, acquired_at, expires_at, expires_at <= now64(3) FROM %s FINAL WHERE NOT released",
+		lockTable,
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var claims []lockClaim
+	for rows.Next() {
+		var (
+			claim   lockClaim
+			expired uint8
+		)
+		if err := rows.Scan(&claim.name, &claim.holder.owner, &claim.holder.host, &claim.holder.acquiredAt, &claim.holder.expiresAt, &expired); err != nil {
+			return nil, err
+		}
+		claim.holder.expired = expired == 1
+		claims = append(claims, claim)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return lockOwners(claims), nil
+}
+
+// lockOwners picks the holder of each lock among its claims: the earliest unexpired one, argMin(owner, (acquired_at,
+// owner)) as the heartbeat renews it, so a claim inserted after the owner's never takes the lock over. Without one, the
+// claim that expired last is returned to report the runner that died holding it
+func lockOwners(claims []lockClaim) map[string]lockHolder {
+	holders := map[string]lockHolder{}
+	for _, claim := range claims {
+		current, ok := holders[claim.name]
+		switch {
+		case !ok:
+			holders[claim.name] = claim.holder
+		case !claim.holder.expired:
+			if current.expired || claim.holder.acquiredAt.Before(current.acquiredAt) ||
+				(claim.holder.acquiredAt.Equal(current.acquiredAt) && claim.holder.owner < current.owner) {
+				holders[claim.name] = claim.holder
+			}
+		case current.expired && claim.holder.expiresAt.After(current.expiresAt):
+			holders[claim.name] = claim.holder
+		}
+	}
+	return holders
+}
+
+// stillPending drops the migrations another runner applied while the locks were being taken
+func stillPending(ctx context.Context, db driver.Conn, table string, pending []string) ([]string, error) {
+	applied, err := appliedMigrations(ctx, db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, name := range pending {
+		if _, ok := applied[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// migrateUnlock frees every lock of the migrations table whoever holds it, for a runner known to be gone before its
+// lease expires
+func migrateUnlock(out io.Writer, isTest bool, table string) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var exists uint8
+	if err := db.QueryRow(ctx, "EXISTS TABLE "+lockTableName(table)).Scan(&exists); err != nil {
+		return err
+	}
+	if exists != 1 {
+		fmt.Fprintln(out, "No migration lock")
+		return nil
+	}
+
+	holders, err := readLocks(ctx, db, lockTableName(table))
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name, holder := range holders {
+		if holder.owner != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(out, "No migration lock")
+		return nil
+	}
+	sort.Strings(names)
+
+	if err := releaseLocks(ctx, db, lockTableName(table), names, ""); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		fmt.Fprintf(out, "Released %s lock of %s on %s\n", name, holders[name].owner, holders[name].host)
+	}
+
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLockHolderHeld(t *testing.T) {
+	tests := []struct {
+		name   string
+		holder lockHolder
+		want   bool
+	}{
+		{"never taken", lockHolder{}, false},
+		{"released", lockHolder{host: "runner (pid 1)"}, false},
+		{"held", lockHolder{owner: "a", host: "runner (pid 1)"}, true},
+		{"lease expired", lockHolder{owner: "a", host: "runner (pid 1)", expired: true}, false},
+	}
+
+	for _, test := range tests {
+		if got := test.holder.held(); got != test.want {
+			t.Errorf("%s: held() = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestLockErrorExitsWithLockCode(t *testing.T) {
+	err := &lockError{name: globalLock, holder: lockHolder{owner: "a", host: "runner (pid 1)"}}
+
+	if got := exitCode(err); got != exitLock {
+		t.Errorf("exitCode() = %d, want %d", got, exitLock)
+	}
+	if report := newErrorReport(err); report.Type != "lock" {
+		t.Errorf("report type = %q, want lock", report.Type)
+	}
+}
+
+func TestAcquireMigrationLocksRejectsShortTTL(t *testing.T) {
+	// validated before the database is used
+	if _, err := acquireMigrationLocks(context.Background(), io.Discard, nil, "migrations", []string{globalLock}, 0); exitCode(err) != exitConfig {
+		t.Errorf("acquireMigrationLocks() = %v, want a configuration error", err)
+	}
+}
+
+func TestMigrationLocks(t *testing.T) {
+	useMigrationDirs(t, map[string]string{
+		"001_events.sql":  "-- logme:locks events\nALTER TABLE events ADD COLUMN a String;\n",
+		"002_users.sql":   "-- logme:locks users, events\n-- logme:locks audit\nALTER TABLE users ADD COLUMN a String;\n",
+		"003_any.sql":     "ALTER TABLE events ADD COLUMN b String;\n",
+		"004_invalid.sql": "-- logme:locks events;\nALTER TABLE events ADD COLUMN c String;\n",
+	})
+
+	tests := []struct {
+		name    string
+		pending []string
+		want    []string
+	}{
+		{"one header", []string{"001_events.sql"}, []string{"table:events"}},
+		{"headers merged and sorted", []string{"001_events.sql", "002_users.sql"}, []string{"table:audit", "table:events", "table:users"}},
+		{"a migration without a header", []string{"001_events.sql", "003_any.sql"}, []string{globalLock}},
+	}
+
+	for _, test := range tests {
+		got, err := migrationLocks(test.pending)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: migrationLocks() = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	if _, err := migrationLocks([]string{"004_invalid.sql"}); exitCode(err) != exitConfig {
+		t.Errorf("migrationLocks() = %v, want a configuration error", err)
+	}
+}
+
+func TestLockConflict(t *testing.T) {
+	held := func(owner string) lockHolder { return lockHolder{owner: owner, host: "runner (pid 1)"} }
+
+	tests := []struct {
+		name    string
+		holders map[string]lockHolder
+		names   []string
+		want    string
+	}{
+		{"free", map[string]lockHolder{}, []string{globalLock}, ""},
+		{"global held", map[string]lockHolder{globalLock: held("a")}, []string{globalLock}, globalLock},
+		{"table lock blocks global", map[string]lockHolder{"table:events": held("a")}, []string{globalLock}, "table:events"},
+		{"global blocks table locks", map[string]lockHolder{globalLock: held("a")}, []string{"table:events"}, globalLock},
+		{"same table", map[string]lockHolder{"table:events": held("a")}, []string{"table:events", "table:users"}, "table:events"},
+		{"other tables", map[string]lockHolder{"table:audit": held("a")}, []string{"table:events", "table:users"}, ""},
+		{"expired", map[string]lockHolder{globalLock: {owner: "a", expired: true}}, []string{"table:events"}, ""},
+		{"own locks", map[string]lockHolder{"table:events": held("me")}, []string{"table:events"}, ""},
+	}
+
+	for _, test := range tests {
+		got, ok := lockConflict(test.holders, test.names, "me")
+		if got != test.want || ok != (test.want != "") {
+			t.Errorf("%s: lockConflict() = %q, %v, want %q", test.name, got, ok, test.want)
+		}
+	}
+}
+
+func TestLockOwnersInterleavedClaims(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	claim := func(owner string, acquired time.Duration, expired bool) lockClaim {
+		return lockClaim{name: globalLock, holder: lockHolder{
+			owner:      owner,
+			acquiredAt: start.Add(acquired),
+			expiresAt:  start.Add(acquired + defaultLockTTL),
+			expired:    expired,
+		}}
+	}
+
+	// b reads the table before a claims the lock and inserts its own claim after a verified it owns the lock
+	var table []lockClaim
+	if _, conflict := lockConflict(lockOwners(table), []string{globalLock}, ""); conflict {
+		t.Fatal("b: the lock is free before a claims it")
+	}
+	table = append(table, claim("a", 0, false))
+	if _, conflict := lockConflict(lockOwners(table), []string{globalLock}, "a"); conflict {
+		t.Fatal("a: lost the lock it claimed first")
+	}
+	table = append(table, claim("b", 3*time.Millisecond, false))
+	if _, conflict := lockConflict(lockOwners(table), []string{globalLock}, "b"); !conflict {
+		t.Fatal("b: took over the lock a claimed first")
+	}
+	if _, conflict := lockConflict(lockOwners(table), []string{globalLock}, "a"); conflict {
+		t.Fatal("a: lost the lock to a later claim")
+	}
+
+	// a's renewal extends its claim without changing its acquired_at, the owner stays a
+	table[0].holder.expiresAt = table[0].holder.expiresAt.Add(time.Minute)
+	if owner := lockOwners(table)[globalLock].owner; owner != "a" {
+		t.Errorf("owner after renewal = %q, want a", owner)
+	}
+
+	tests := []struct {
+		name    string
+		claims  []lockClaim
+		owner   string
+		expired bool
+	}{
+		{"both claimed before either read", []lockClaim{claim("b", 2*time.Millisecond, false), claim("a", time.Millisecond, false)}, "a", false},
+		{"same millisecond", []lockClaim{claim("b", 0, false), claim("a", 0, false)}, "a", false},
+		{"earliest claim expired", []lockClaim{claim("a", 0, true), claim("b", time.Millisecond, false)}, "b", false},
+		{"every claim expired", []lockClaim{claim("b", time.Millisecond, true), claim("a", 0, true)}, "b", true},
+	}
+
+	for _, test := range tests {
+		holder := lockOwners(test.claims)[globalLock]
+		if holder.owner != test.owner || holder.expired != test.expired {
+			t.Errorf("%s: holder = %q (expired %v), want %q (expired %v)", test.name, holder.owner, holder.expired, test.owner, test.expired)
+		}
+	}
+}
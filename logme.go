@@ -2,32 +2,392 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
+	"net"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2"
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
-	"github.com/joho/godotenv"
+	"github.com/google/uuid"
 	"github.com/urfave/cli/v2"
 )
 
-func main() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
+const migrationDir = "internal/logme/migrations/"
+
+const serverContainer = "logme_server"
+
+var identifierRegexp = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+var migrationsTableFlag = &cli.StringFlag{
+	Name:    "migrations-table",
+	Usage:   "name of the table used to track applied migrations",
+	Value:   "migrations",
+	EnvVars: []string{"DB_MIGRATIONS_TABLE"},
+}
+
+// lockTTLFlag is the lease of the migration lock taken by the commands changing the migrations table or dropping tables
+var lockTTLFlag = &cli.DurationFlag{
+	Name:    "lock-ttl",
+	Usage:   "lease of the migration lock, renewed while the command runs, after which the lock of a runner that died is taken over",
+	EnvVars: []string{"LOGME_LOCK_TTL"},
+	Value:   defaultLockTTL,
+}
+
+var dryRunFlag = &cli.BoolFlag{
+	Name:  "dry-run",
+	Usage: "print the docker-compose command instead of running it",
+}
+
+var containerDryRunFlag = &cli.BoolFlag{
+	Name:  "dry-run",
+	Usage: "print the docker command instead of running it",
+}
+
+var migrateFlags = []cli.Flag{
+	migrationsTableFlag,
+	lockTTLFlag,
+	&cli.BoolFlag{
+		Name:  "quiet",
+		Usage: "do not print warnings reported by ClickHouse",
+	},
+	&cli.BoolFlag{
+		Name:  "verbose-errors",
+		Usage: "include the ClickHouse error code, its name and a hint in migration errors",
+	},
+	&cli.BoolFlag{
+		Name:  "backup-before-drop",
+		Usage: "copy the tables a migration drops (DROP TABLE, ALTER TABLE ... DROP COLUMN) to <table>_backup_<timestamp> first",
+	},
+	&cli.DurationFlag{
+		Name:  "profile-sql",
+		Usage: "report the statements that took at least `THRESHOLD` (e.g. 500ms) at the end of the run, slowest first",
+	},
+	&cli.IntFlag{
+		Name:  "tail-errors",
+		Usage: "when a migration fails, also print the last `N` lines of the ClickHouse container's logs",
+	},
+	&cli.StringFlag{
+		Name:    "clickhouse-container",
+		Usage:   "`NAME` of the ClickHouse container read by --tail-errors",
+		Value:   "clickhouse",
+		EnvVars: []string{"LOGME_CLICKHOUSE_CONTAINER"},
+	},
+	&cli.StringFlag{
+		Name:    "setup-sql",
+		Usage:   "`FILE` of statements (e.g. SET allow_experimental_...) to run before the migrations, not recorded as a migration",
+		EnvVars: []string{"DB_SETUP_SQL"},
+	},
+}
+
+// flags of the commands running every pending migration (migrate and migrate-test)
+var migrateAllFlags = append([]cli.Flag{
+	&cli.BoolFlag{
+		Name:  "continue-on-error",
+		Usage: "keep applying the remaining migrations after one fails and report every failure at the end",
+	},
+	&cli.BoolFlag{
+		Name:  "progress",
+		Usage: "show a live status line with the current migration when writing to a terminal",
+	},
+	&cli.BoolFlag{
+		Name:  "skip-missing",
+		Usage: "accept applied migrations whose files were removed (e.g. squashed) without warning",
+	},
+	&cli.StringFlag{
+		Name:  "junit",
+		Usage: "also write the results to `PATH` as a JUnit XML report, one test case per migration",
+	},
+	&cli.BoolFlag{
+		Name:  "stateless",
+		Usage: "apply every migration file in order without reading or writing the migrations table, for throwaway databases",
+	},
+	&cli.BoolFlag{
+		Name:  "watch",
+		Usage: "keep running and apply migrations as their files are created or saved, test databases only",
+	},
+	&cli.BoolFlag{
+		Name:  "force",
+		Usage: "allow --watch on a non-test database",
+	},
+	&cli.BoolFlag{
+		Name:  "strict-ordering",
+		Usage: "refuse to run unless every migration has a zero padded numeric prefix of the same width (see migrate:rename)",
+	},
+	&cli.BoolFlag{
+		Name:  "dump-schema-after",
+		Usage: "after a run that applied migrations without failures, write the database's schema to the --schema file",
+	},
+	&cli.StringFlag{
+		Name:  "schema",
+		Usage: "schema `FILE` written by --dump-schema-after, in the format read by migrate:diff",
+		Value: "schema.sql",
+	},
+	&cli.BoolFlag{
+		Name:  "check-syntax",
+		Usage: "only have ClickHouse parse the pending migrations (EXPLAIN AST) and report every statement that does not",
+	},
+	&cli.BoolFlag{
+		Name:  "print-sql-only",
+		Usage: "print the SQL of every migration file in order, with the bookkeeping inserts as comments, without connecting",
+	},
+	&cli.StringFlag{
+		Name:  "output",
+		Usage: "write the --print-sql-only script to `FILE` instead of stdout",
+	},
+	&cli.BoolFlag{
+		Name:  "in-container",
+		Usage: "run the migrations from inside the " + serverContainer + " container with its logme-cli binary",
+	},
+	&cli.StringFlag{
+		Name:    "metrics-endpoint",
+		Usage:   "after the run, send its duration and counts to `URL` (or the host:port of a StatsD server), a failed push only warns",
+		EnvVars: []string{"LOGME_METRICS_ENDPOINT"},
+	},
+	&cli.StringFlag{
+		Name:  "since-commit",
+		Usage: "only apply the pending migrations added or modified since the git `REF` (e.g. origin/main), for preview environments",
+	},
+	&cli.StringFlag{
+		Name:  "diagnostics-bundle",
+		Usage: "write a .tar.gz `FILE` with the redacted configuration, migration status, server version and logs, and the error of a failed run",
+	},
+	&cli.StringFlag{
+		Name:  "progress-socket",
+		Usage: "send the progress of the run as newline-delimited JSON events to the Unix socket at `PATH`, for UIs (see README)",
+	},
+	&cli.StringFlag{
+		Name:  "metrics-format",
+		Usage: "payload of --metrics-endpoint: json, pushgateway (Prometheus text) or statsd",
+		Value: "json",
+	},
+}, migrateFlags...)
+
+type migrateOptions struct {
+	table            string
+	quiet            bool
+	setupSQL         string
+	settings         clickhouse.Settings
+	continueOnError  bool
+	progress         bool
+	skipMissing      bool
+	verboseErrors    bool
+	junit            string
+	watch            bool
+	force            bool
+	backupBeforeDrop bool
+	profile          *sqlProfile
+	out              io.Writer
+	stateless        bool
+	tailErrors       int
+	container        string
+	strictOrdering   bool
+	// tags the queries of one run in system.query_log, see applyMigration
+	runID string
+	// database migrated, for script migrations
+	database string
+	// schema file regenerated after a successful run, see dumpSchema
+	dumpSchema  string
+	checkSyntax bool
+	// where runMigrations reports its duration and counts, see pushMetrics
+	metricsEndpoint string
+	metricsFormat   string
+	// .tar.gz written by migrate whatever the outcome, see writeDiagnosticsBundle
+	diagnosticsBundle string
+	// git ref, only the pending migrations changed since it are applied
+	sinceCommit string
+	// Unix socket the run's progressEvent lines are written to
+	progressSocket string
+	// lease of the migration lock, renewed while the run lasts
+	lockTTL time.Duration
+	// the caller already holds the global lock, see fresh
+	locked bool
+}
+
+func getMigrateOptions(c *cli.Context) migrateOptions {
+	var profile *sqlProfile
+	if threshold := c.Duration("profile-sql"); threshold > 0 {
+		profile = &sqlProfile{threshold: threshold}
+	}
+
+	opts := migrateOptions{
+		table:             c.String("migrations-table"),
+		quiet:             c.Bool("quiet"),
+		setupSQL:          c.String("setup-sql"),
+		continueOnError:   c.Bool("continue-on-error"),
+		progress:          c.Bool("progress"),
+		skipMissing:       c.Bool("skip-missing"),
+		verboseErrors:     c.Bool("verbose-errors"),
+		junit:             c.String("junit"),
+		watch:             c.Bool("watch"),
+		force:             c.Bool("force"),
+		backupBeforeDrop:  c.Bool("backup-before-drop"),
+		profile:           profile,
+		out:               c.App.Writer,
+		stateless:         c.Bool("stateless"),
+		tailErrors:        c.Int("tail-errors"),
+		container:         c.String("clickhouse-container"),
+		strictOrdering:    c.Bool("strict-ordering"),
+		checkSyntax:       c.Bool("check-syntax"),
+		metricsEndpoint:   c.String("metrics-endpoint"),
+		metricsFormat:     c.String("metrics-format"),
+		diagnosticsBundle: c.String("diagnostics-bundle"),
+		sinceCommit:       c.String("since-commit"),
+		progressSocket:    c.String("progress-socket"),
+		lockTTL:           c.Duration("lock-ttl"),
 	}
+	if c.Bool("dump-schema-after") {
+		opts.dumpSchema = c.String("schema")
+	}
+
+	return opts
+}
 
+func main() {
 	app := &cli.App{
 		Name:  "logme-cli",
 		Usage: "A tool to help with commands for LogMe app!",
+		// commands print through the app's writer rather than straight to stdout, so their output can be captured
+		Writer: os.Stdout,
+		// completion candidates for the scripts printed by the completion command
+		EnableBashCompletion: true,
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    "profile",
+				Usage:   "load configuration from .env.<NAME> instead of .env (e.g. staging)",
+				EnvVars: []string{"LOGME_PROFILE"},
+			},
+			&cli.BoolFlag{
+				Name:  "no-env-discovery",
+				Usage: "only read .env and the migrations from the working directory, instead of the nearest parent holding them",
+			},
+			&cli.BoolFlag{
+				Name:  "strict-env",
+				Usage: "fail on unrecognized DB_ and LOGME_ environment variables, which are usually typos",
+			},
+			&cli.StringSliceFlag{
+				Name:  "setting",
+				Usage: "ClickHouse setting `NAME=VALUE` sent with every query of this invocation (e.g. max_memory_usage=20000000000), repeatable",
+			},
+			&cli.StringFlag{
+				Name:    "project-name",
+				Aliases: []string{"p"},
+				Usage:   "docker-compose project name, to run stacks from several checkouts side by side (also COMPOSE_PROJECT_NAME)",
+			},
+			&cli.StringSliceFlag{
+				Name:  "migrations-dir",
+				Usage: "`DIR` to read migrations from, repeatable to merge several directories ordered by numeric prefix (default " + migrationDir + ")",
+			},
+			&cli.StringFlag{
+				Name:  "ssh-tunnel",
+				Usage: "reach ClickHouse through an SSH tunnel to `USER@BASTION`, open for the duration of the command",
+			},
+			&cli.StringFlag{
+				Name:  "ssh-key",
+				Usage: "private key `FILE` used by --ssh-tunnel (defaults to the ssh configuration)",
+			},
+			&cli.IntFlag{
+				Name:  "ssh-local-port",
+				Usage: "local `PORT` forwarded by --ssh-tunnel (defaults to a free port)",
+			},
+			&cli.StringFlag{
+				Name:  "error-format",
+				Usage: "report failures as `FORMAT`: text, or json for an object with the error, its type, exit code and migration",
+				Value: "text",
+			},
+			&cli.StringFlag{
+				Name:  "env",
+				Usage: "environment `NAME` (e.g. dev) the \"-- logme:env\" headers of migrations are matched against (also LOGME_ENV, defaults to the profile)",
+			},
+			&cli.StringFlag{
+				Name:  "source-database",
+				Usage: "`NAME` of the database {{.SourceDB}} refers to in .sql.tmpl migrations, for backfills copying from another database (also DB_SOURCE)",
+			},
+			&cli.StringFlag{
+				Name:  "audit-log",
+				Usage: "append a JSON line to `PATH` for every command that changes the database (also LOGME_AUDIT_LOG)",
+			},
+			&cli.StringFlag{
+				Name:  "config",
+				Usage: "YAML file providing settings (e.g. db_addr, db_name), environment variables and .env take precedence (defaults to " + defaultConfigFile + " if present)",
+			},
+		},
+		Before: func(c *cli.Context) error {
+			switch errorFormat = c.String("error-format"); errorFormat {
+			case "text", "json":
+			default:
+				errorFormat = "text"
+				return configErrorf("invalid --error-format '%s': expected text or json", c.String("error-format"))
+			}
+			if !c.Bool("no-env-discovery") {
+				projectRoot = findProjectRoot(c.String("profile"))
+			}
+			if err := loadEnv(c.String("profile"), projectRoot); err != nil {
+				return &configError{err: err}
+			}
+			if err := loadConfig(c.String("config"), projectRoot); err != nil {
+				return &configError{err: err}
+			}
+			if c.Bool("strict-env") {
+				if err := checkStrictEnv(); err != nil {
+					return &configError{err: err}
+				}
+			}
+			// exported so docker-compose and the commands reading it agree, like a value from .env
+			if project := c.String("project-name"); project != "" {
+				os.Setenv("COMPOSE_PROJECT_NAME", project)
+			}
+			if env := c.String("env"); env != "" {
+				os.Setenv("LOGME_ENV", env)
+			}
+			if source := c.String("source-database"); source != "" {
+				os.Setenv("DB_SOURCE", source)
+			}
+			if dirs := c.StringSlice("migrations-dir"); len(dirs) > 0 {
+				migrationDirs = nil
+				for _, dir := range dirs {
+					migrationDirs = append(migrationDirs, strings.TrimSuffix(dir, "/")+"/")
+				}
+			} else if projectRoot != "." {
+				migrationDirs = []string{filepath.Join(projectRoot, migrationDir) + "/"}
+			}
+			var err error
+			if settingOverrides, err = parseSettingFlags(c.StringSlice("setting")); err != nil {
+				return err
+			}
+			if err := resolveAliases(); err != nil {
+				return err
+			}
+			if bastion := c.String("ssh-tunnel"); bastion != "" {
+				if tunnel, err = openSSHTunnel(bastion, c.String("ssh-key"), c.Int("ssh-local-port")); err != nil {
+					if errors.As(err, new(*configError)) {
+						return err
+					}
+					return &connectionError{err: err}
+				}
+				// every connection of the command goes through the forwarded port, DB_ADDR wins over DB_HOST and DB_LOCAL_ADDR
+				os.Setenv("DB_ADDR", tunnel.localAddr)
+			}
+			return nil
+		},
+		After: func(c *cli.Context) error {
+			if tunnel != nil {
+				tunnel.close()
+			}
+			return nil
+		},
 		Commands: []*cli.Command{
 			{
 				Name:    "migrate",
@@ -35,15 +395,28 @@ func main() {
 				Usage:   "migrate the database",
 				Description: `
 				This command will migrate the database while using the environment variables (.env or otherwise):
-					DB_LOCAL_ADDR - includes host and port
 					DB_ADDR - includes host and port
-					DB_NAME - name of the database to migrate (defaults to 'logme')
+					DB_HOST, DB_PORT - used when DB_ADDR is not set, the port defaults to 9000
+					DB_LOCAL_ADDR - includes host and port, used when neither DB_ADDR nor DB_HOST is set
+					DB_NAME - name of the database to migrate (defaults to 'logme'), DB_DATABASE is accepted as an alias
+					DB_DATABASES (optional) - comma separated databases to migrate one after the other instead of DB_NAME
 					DB_USER (optional) - user to authenticate with
 					DB_PASS (optional) - password to authenticate with
+					DB_READONLY_USER, DB_READONLY_PASS (optional) - credentials for commands that only read: ping, describe, tables, migrate:pending, migrate:check-drift, migrate:export and schema:dump without a flag, query with --readonly
+					DB_MIGRATIONS_TABLE (optional) - name of the migrations bookkeeping table (defaults to 'migrations')
+					DB_COMPRESSION (optional) - lz4, none or auto (default), auto disables compression for loopback addresses
+					DB_CONN_MAX_LIFETIME (optional) - how long a connection is reused before it is recycled (e.g. 10m, defaults to 1h)
 				`,
-				Action: func(c *cli.Context) error {
-					return migrate(false)
-				},
+				Flags: migrateAllFlags,
+				Action: auditedIf(migrateMutates, func(c *cli.Context) error {
+					if c.Bool("print-sql-only") {
+						return printMigrationSQL(c.App.Writer, c.String("migrations-table"), c.String("output"))
+					}
+					if c.Bool("in-container") {
+						return migrateInContainer(c.App.Writer, os.Args[1:])
+					}
+					return migrateTargets(false, getMigrateOptions(c))
+				}),
 			},
 			{
 				Name:    "migrate-test",
@@ -51,23 +424,652 @@ func main() {
 				Usage:   "migrate the test database",
 				Description: `
 				This command will migrate the database while using the environment variables (.env or otherwise):
-					DB_LOCAL_ADDR - includes host and port
 					DB_ADDR - includes host and port
-					DB_NAME - name of the database to migrate (defaults to 'logme'), '_test' will automatically be appended
+					DB_HOST, DB_PORT - used when DB_ADDR is not set, the port defaults to 9000
+					DB_LOCAL_ADDR - includes host and port, used when neither DB_ADDR nor DB_HOST is set
+					DB_NAME - name of the database to migrate (defaults to 'logme'), '_test' will automatically be appended, DB_DATABASE is accepted as an alias
+					DB_DATABASES (optional) - comma separated databases to migrate one after the other instead of DB_NAME, '_test' is appended to each
 					DB_USER (optional) - user to authenticate with
 					DB_PASS (optional) - password to authenticate with
+					DB_READONLY_USER, DB_READONLY_PASS (optional) - credentials for commands that only read: ping, describe, tables, migrate:pending, migrate:check-drift, migrate:export and schema:dump without a flag, query with --readonly
+					DB_MIGRATIONS_TABLE (optional) - name of the migrations bookkeeping table (defaults to 'migrations')
+					DB_COMPRESSION (optional) - lz4, none or auto (default), auto disables compression for loopback addresses
+					DB_CONN_MAX_LIFETIME (optional) - how long a connection is reused before it is recycled (e.g. 10m, defaults to 1h)
+				`,
+				Flags: migrateAllFlags,
+				Action: auditedIf(migrateMutates, func(c *cli.Context) error {
+					if c.Bool("print-sql-only") {
+						return printMigrationSQL(c.App.Writer, c.String("migrations-table"), c.String("output"))
+					}
+					if c.Bool("in-container") {
+						return migrateInContainer(c.App.Writer, os.Args[1:])
+					}
+					return migrateTargets(true, getMigrateOptions(c))
+				}),
+			},
+			{
+				Name:      "migrate:run",
+				Usage:     "run a single migration file",
+				ArgsUsage: "FILE",
+				Description: `
+				This command will run a single migration from the migrations directory, using the same environment variables as migrate.
+				With --replace an already applied migration is reverted (running its .down.sql file if present) and applied again,
+				this is a development convenience and requires --force unless run against the test database.
+				`,
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "run against the test database"},
+					&cli.BoolFlag{Name: "replace", Usage: "re-run the migration if it was already applied"},
+					&cli.BoolFlag{Name: "force", Usage: "allow --replace against a non-test database"},
+					&cli.BoolFlag{Name: "record-only", Usage: "record the migration as applied without running it, for changes made by hand"},
+				}, migrateFlags...),
+				Action: audited(func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return configErrorf("migrate:run requires exactly one migration FILE")
+					}
+					return migrateRun(c.Bool("test"), c.Args().First(), c.Bool("replace"), c.Bool("force"), c.Bool("record-only"), getMigrateOptions(c))
+				}),
+			},
+			{
+				Name:      "migrate:diff",
+				Usage:     "generate a migration from the differences with a schema file",
+				ArgsUsage: "NAME",
+				Description: `
+				This command will compare the CREATE TABLE statements of a declarative schema file (schema.sql by default)
+				with the live database and write a new migration NAME that creates missing tables and adds missing columns.
+				Type changes, and tables and columns missing from the file, are written as commented out statements since
+				they may be renames, review the migration before applying it. Backup tables made by --backup-before-drop are
+				ignored. The migration has a "-- logme:multi-statement" header, so migrate runs each of its statements as its
+				own query while other migrations run as a single one. This is a best-effort helper.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					&cli.BoolFlag{Name: "test", Usage: "compare against the test database"},
+					&cli.StringFlag{Name: "schema", Usage: "declarative schema `FILE`", Value: "schema.sql"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return configErrorf("migrate:diff requires exactly one migration NAME")
+					}
+					return migrateDiff(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.Args().First(), c.String("schema"))
+				},
+			},
+			{
+				Name:  "migrate:export",
+				Usage: "export the migrations table as SQL",
+				Description: `
+				This command will print the migrations bookkeeping table as a CREATE TABLE statement followed by an INSERT
+				of every recorded migration, which can be replayed against another database to seed its migration state.
+				The status column is empty for applied migrations and names why the others were skipped, e.g. "skipped (env)".
+				The dir column is the migrations directory each migration was read from, relative to the project.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					&cli.BoolFlag{Name: "test", Usage: "export from the test database"},
+				},
+				Action: func(c *cli.Context) error {
+					return migrateExport(c.App.Writer, c.Bool("test"), c.String("migrations-table"))
+				},
+			},
+			{
+				Name:  "migrate:unlock",
+				Usage: "release the migration locks held by other runners",
+				Description: `
+				This command will release the locks taken while the migrations table changes or tables are dropped (migrate,
+				migrate:run, rollback, migrate:reset, fresh, migrate:rename, migrate:squash and migrate:check-drift --baseline),
+				the global lock and the table locks of "-- logme:locks" headers, whoever holds them. The lock of a runner that
+				died is taken over once its lease (--lock-ttl) expires, use this command when the runner is known to be gone
+				and waiting is not an option.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					&cli.BoolFlag{Name: "test", Usage: "release the lock of the test database"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					return migrateUnlock(c.App.Writer, c.Bool("test"), c.String("migrations-table"))
+				}),
+			},
+			{
+				Name:  "migrate:rename",
+				Usage: "zero pad the numeric prefixes of the migration files to the same width",
+				Description: `
+				This command will rename migration files such as 1_foo.sql and 10_bar.sql to 001_foo.sql and 010_bar.sql (down
+				migrations included) so they sort the same way everywhere, and rename the rows of the migrations bookkeeping
+				table to match. The "-- logme:requires" headers and order.txt naming a renamed migration are updated too.
+				Run it again with --test (or another profile) to update the bookkeeping of other databases.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					lockTTLFlag,
+					&cli.BoolFlag{Name: "test", Usage: "rename the bookkeeping rows of the test database"},
+					&cli.IntFlag{Name: "width", Usage: "pad prefixes to `N` digits (defaults to the widest existing prefix, at least 3)"},
+					&cli.BoolFlag{Name: "dry-run", Usage: "print the renames without changing anything"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					return migrateRename(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.Int("width"), c.Bool("dry-run"), c.Duration("lock-ttl"))
+				}),
+			},
+			{
+				Name:      "migrate:squash",
+				Usage:     "replace the migration files with a baseline of the current schema",
+				ArgsUsage: "[NAME]",
+				Description: `
+				This command will dump the schema of the migrated database into a single baseline migration (named after
+				the highest prefix, e.g. 042_baseline.sql, unless NAME is given), move the old files to the archive directory
+				and record the baseline as applied. Every migration must have run on the database squashed from. Elsewhere
+				migrate records the baseline without running it where all the squashed migrations ran, runs it on new
+				databases and fails where only some of them ran, so migrate those with the old files first. The baseline
+				holds the schema only, data inserted by the squashed migrations is not re-created, and backup tables made by
+				--backup-before-drop are left out. With several migrations directories each keeps its path under the archive
+				directory.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					lockTTLFlag,
+					&cli.BoolFlag{Name: "test", Usage: "squash from the test database"},
+					&cli.StringFlag{Name: "archive", Usage: "move the squashed files to `DIR` (defaults to archive/ in the migrations directory)"},
+					&cli.BoolFlag{Name: "dry-run", Usage: "print what would be written and archived without changing anything"},
+				},
+				Action: auditedIf(func(c *cli.Context) bool { return !c.Bool("dry-run") }, func(c *cli.Context) error {
+					return migrateSquash(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.Args().First(), c.String("archive"), c.Bool("dry-run"), c.Duration("lock-ttl"))
+				}),
+			},
+			{
+				Name:  "migrate:pending",
+				Usage: "list unapplied migrations and exit non-zero if there are any",
+				Description: `
+				This command will compare the migration files on disk with the migrations bookkeeping table, printing the
+				files not applied yet. It exits with code 0 when everything is applied and 6 when migrations are pending,
+				which can gate a deploy.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					&cli.BoolFlag{Name: "test", Usage: "check the test database"},
+					&cli.BoolFlag{Name: "quiet", Usage: "print nothing, only set the exit code"},
+				},
+				Action: func(c *cli.Context) error {
+					return migratePending(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.Bool("quiet"))
+				},
+			},
+			{
+				Name:  "migrate:check-drift",
+				Usage: "check applied migrations were not edited since they ran",
+				Description: `
+				This command will compare the checksum recorded for each applied migration with that of its file now,
+				without applying anything, and print every migration that differs. It exits with code 0 when nothing
+				drifted and 7 otherwise, to guard CI against editing migrations that shipped. Migrations changed on
+				purpose are skipped with --ignore, or accepted for good with --baseline, which records the current
+				checksums.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					lockTTLFlag,
+					&cli.BoolFlag{Name: "test", Usage: "check the test database"},
+					&cli.StringSliceFlag{Name: "ignore", Usage: "skip the migration `FILE` (or glob, e.g. 001_*), repeatable"},
+					&cli.BoolFlag{Name: "baseline", Usage: "record the checksums of the current files instead of failing"},
+				},
+				Action: auditedIf(func(c *cli.Context) bool { return c.Bool("baseline") }, func(c *cli.Context) error {
+					return migrateCheckDrift(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.StringSlice("ignore"), c.Bool("baseline"), c.Duration("lock-ttl"))
+				}),
+			},
+			{
+				Name:  "migrate:validate",
+				Usage: "check every migration applies to an empty database",
+				Description: `
+				This command will create a temporary database with a random name (logme_validate_...), apply every migration
+				to it and drop it again, also when a migration fails. The configured databases are not touched, the user
+				needs the CREATE DATABASE and DROP DATABASE grants.
+				`,
+				Flags: append([]cli.Flag{
+					&cli.BoolFlag{Name: "keep", Usage: "keep the temporary database to inspect it"},
+				}, migrateFlags...),
+				Action: func(c *cli.Context) error {
+					return migrateValidate(getMigrateOptions(c), c.Bool("keep"))
+				},
+			},
+			{
+				Name:  "migrate:lint",
+				Usage: "check the migration files follow the conventions",
+				Description: `
+				This command will check every migration file, without connecting, and print each violation as FILE:LINE: RULE: message:
+					prefix - the name starts with a numeric prefix zero-padded like the others
+					down - a .sql migration has a .down.sql
+					drop-table - DROP TABLE is confirmed by a "-- logme:allow-drop" comment before it (or in the header)
+					on-cluster - ALTER TABLE and DELETE FROM use ON CLUSTER, off unless enabled for clustered deployments
+					empty - the file has at least one statement
+				Rules are switched on or off in a .logme-lint file next to .env, e.g. "down: false" or "on-cluster: true".
+				It exits non-zero when there is any violation.
+				`,
+				Action: func(c *cli.Context) error {
+					return migrateLint(c.App.Writer)
+				},
+			},
+			{
+				Name:      "completion",
+				Usage:     "print a shell completion script for command names and flags",
+				ArgsUsage: "bash|zsh|fish",
+				Description: `Print a completion script for the given shell, load it from the shell's startup file:
+
+   bash: source <(logme-cli completion bash)            in ~/.bashrc
+   zsh:  source <(logme-cli completion zsh)             in ~/.zshrc, after compinit
+   fish: logme-cli completion fish > ~/.config/fish/completions/logme-cli.fish`,
+				Action: func(c *cli.Context) error {
+					return completion(c, c.Args().First())
+				},
+			},
+			{
+				Name:      "describe",
+				Usage:     "show the columns and keys of a table",
+				ArgsUsage: "TABLE",
+				Description: `
+				This command will print the columns (with their types and defaults), engine, sorting key and partition key
+				of a table in the configured database, as read from system.tables and system.columns.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "describe a table of the test database"},
+					&cli.BoolFlag{Name: "json", Usage: "print the description as JSON, same as --format json"},
+					&cli.StringFlag{Name: "format", Usage: "print the description as `FORMAT`: text, json or markdown", Value: "text"},
+				},
+				Action: func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return configErrorf("describe requires exactly one TABLE")
+					}
+					format, err := outputFormat(c.String("format"), c.Bool("json"))
+					if err != nil {
+						return err
+					}
+					return describe(c.App.Writer, c.Bool("test"), c.Args().First(), format)
+				},
+			},
+			{
+				Name:  "schema:dump",
+				Usage: "write the schema of the database to a file, or diff it with the schema before a migration",
+				Description: `
+				This command will write the CREATE statement of every table and view to the --schema file, in the format
+				read by migrate:diff, as migrate --dump-schema-after does. With --since NAME it writes nothing and prints
+				the changes made to the tables by NAME and the migrations after it instead: the migrations before NAME are
+				applied to a temporary database (dropped afterwards) and its tables are compared with the current ones as
+				schema:compare does. NAME has to be applied already, the user needs the CREATE DATABASE and DROP DATABASE
+				grants.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					&cli.BoolFlag{Name: "test", Usage: "dump the schema of the test database"},
+					&cli.StringFlag{Name: "schema", Usage: "schema `FILE` to write", Value: "schema.sql"},
+					&cli.StringFlag{Name: "since", Usage: "print the changes since the migration `NAME` instead of writing the file"},
+					&cli.StringFlag{Name: "color", Usage: "colorize the --since diff: auto (on a terminal), always or never", Value: "auto"},
+				},
+				Action: func(c *cli.Context) error {
+					return schemaDump(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.String("schema"), c.String("since"), c.String("color"))
+				},
+			},
+			{
+				Name:  "schema:compare",
+				Usage: "diff the schemas of two databases",
+				Description: `
+				This command will print a diff of the tables of two databases, rendered as CREATE TABLE statements with one
+				line per column, and exit non-zero when they differ. Databases on other servers are reached with the
+				connection settings of a profile (.env.<NAME>), e.g. --source-profile staging --target-profile prod.
+				Without --source or --target a side uses the DB_NAME of its profile.
+				`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "source", Usage: "`DATABASE` compared from"},
+					&cli.StringFlag{Name: "target", Usage: "`DATABASE` compared to"},
+					&cli.StringFlag{Name: "source-profile", Usage: "connect to the source with .env.`NAME`"},
+					&cli.StringFlag{Name: "target-profile", Usage: "connect to the target with .env.`NAME`"},
+					&cli.StringFlag{Name: "color", Usage: "colorize the diff: auto (on a terminal), always or never", Value: "auto"},
+				},
+				Action: func(c *cli.Context) error {
+					source := schemaSide{database: c.String("source"), profile: c.String("source-profile")}
+					target := schemaSide{database: c.String("target"), profile: c.String("target-profile")}
+					return schemaCompare(c.App.Writer, source, target, c.String("color"))
+				},
+			},
+			{
+				Name:  "tables",
+				Usage: "list the tables of the database with their row counts and sizes",
+				Description: `
+				This command will print every table of the configured database with its engine, approximate row count and
+				size on disk, as read from system.tables and the active parts in system.parts. Views have no parts and show as empty.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "list the tables of the test database"},
+					&cli.BoolFlag{Name: "json", Usage: "print the tables as JSON, same as --format json"},
+					&cli.StringFlag{Name: "format", Usage: "print the tables as `FORMAT`: text, json or markdown", Value: "text"},
+					&cli.StringFlag{Name: "sort", Usage: "order by `KEY`: name, rows or size (largest first)", Value: "name"},
+				},
+				Action: func(c *cli.Context) error {
+					format, err := outputFormat(c.String("format"), c.Bool("json"))
+					if err != nil {
+						return err
+					}
+					return tables(c.App.Writer, c.Bool("test"), c.String("sort"), format)
+				},
+			},
+			{
+				Name:  "ping",
+				Usage: "check ClickHouse can be reached and print the round trip of SELECT 1",
+				Description: `
+				This command will connect with the configured settings and time a SELECT 1, --count times. It connects as
+				DB_READONLY_USER when set, no --readonly flag is needed. It exits with code 0 when every round trip succeeded
+				and 2 when the connection or any round trip failed.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "connect to the test database"},
+					&cli.IntFlag{Name: "count", Usage: "ping `N` times and print min/avg/max", Value: 1},
+					&cli.DurationFlag{Name: "interval", Usage: "wait `DURATION` between pings", Value: time.Second},
+				},
+				Action: func(c *cli.Context) error {
+					return ping(c.App.Writer, c.Bool("test"), c.Int("count"), c.Duration("interval"))
+				},
+			},
+			{
+				Name:      "snapshot:create",
+				Usage:     "save the schema and data of the test database as a snapshot",
+				ArgsUsage: "NAME",
+				Description: `
+				This command will export every table of the test database in Native format (or the --dump-format), with the file()
+				table function, to logme_snapshots/NAME in the user_files directory of the ClickHouse server, overwriting a snapshot
+				of the same name. Views are saved without data, the data of a materialized view without a TO table is not saved.
+				snapshot:restore reads each data file in the format of its extension.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "main", Usage: "snapshot the main database instead of the test database"},
+					&cli.StringFlag{Name: "dump-format", Usage: "`FORMAT` of the data files: native, parquet or sql (INSERT VALUES, readable but larger)", Value: "native"},
+				},
+				Action: func(c *cli.Context) error {
+					return snapshotCreate(c.App.Writer, c.Args().First(), c.Bool("main"), c.String("dump-format"))
+				},
+			},
+			{
+				Name:      "snapshot:restore",
+				Usage:     "replace the tables of the test database with those of a snapshot",
+				ArgsUsage: "NAME",
+				Description: `
+				This command will drop every table of the test database, then recreate and fill the tables saved by
+				snapshot:create NAME, the migrations table included.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "main", Usage: "restore into the main database instead of the test database, requires --force"},
+					&cli.BoolFlag{Name: "force", Usage: "allow restoring into the main database"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					return snapshotRestore(c.App.Writer, c.Args().First(), c.Bool("main"), c.Bool("force"))
+				}),
+			},
+			{
+				Name:  "init",
+				Usage: "scaffold the LogMe configuration in the current directory",
+				Description: `
+				This command will create a .env file listing every recognized environment variable and the migrations
+				directory (internal/logme/migrations/) if it is missing. An existing .env is only overwritten with --force.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "force", Usage: "overwrite an existing .env"},
+					&cli.BoolFlag{Name: "with-migration", Usage: "also create a starter migration"},
+				},
+				Action: func(c *cli.Context) error {
+					return initProject(c.App.Writer, c.Bool("force"), c.Bool("with-migration"))
+				},
+			},
+			{
+				Name:  "print-env-template",
+				Usage: "print a commented .env.example listing every recognized environment variable",
+				Description: `
+				This command will write every environment variable the tool recognizes to stdout, commented out with its
+				description and an example or default value, e.g. logme-cli print-env-template > .env.example. It is
+				generated from the same list --strict-env checks against, so it stays in sync with the code.
+				`,
+				Action: func(c *cli.Context) error {
+					printEnvTemplate(c.App.Writer)
+					return nil
+				},
+			},
+			{
+				Name:      "optimize",
+				Usage:     "force ClickHouse to merge the parts of tables",
+				ArgsUsage: "[TABLE...]",
+				Description: `
+				This command will run OPTIMIZE TABLE ... FINAL for each given table (or every MergeTree table with --all)
+				in the configured database (or --database), which can be slow on large tables. FINAL is on by default,
+				--no-final (or --final=false) leaves it out.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "optimize tables of the test database"},
+					&cli.StringFlag{Name: "database", Usage: "optimize tables of database `NAME` instead of DB_NAME, --test appends _test"},
+					&cli.BoolFlag{Name: "all", Usage: "optimize every MergeTree table in the database"},
+					&cli.BoolFlag{Name: "final", Usage: "add FINAL, merging every part even when already merged", Value: true},
+					&cli.BoolFlag{Name: "no-final", Usage: "omit FINAL, only merging when ClickHouse deems it worthwhile"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					if c.IsSet("final") && c.IsSet("no-final") {
+						return configErrorf("--final and --no-final cannot be combined")
+					}
+					if database := c.String("database"); database != "" {
+						os.Setenv("DB_NAME", database)
+					}
+					return optimize(c.App.Writer, c.Bool("test"), c.Args().Slice(), c.Bool("all"), c.Bool("final") && !c.Bool("no-final"))
+				}),
+			},
+			{
+				Name:      "exec",
+				Usage:     "run SQL statements against the database",
+				ArgsUsage: "[SQL]",
+				Description: `
+				This command will run the given statements (or the contents of --file, or SQL piped in with --stdin),
+				separated by semicolons, against the configured database (or --database). With --table or --all they run
+				once per table, {table} standing for its name (e.g. exec --all 'OPTIMIZE TABLE {table} FINAL'), on
+				--concurrency connections at once; every table is attempted and the failures are reported at the end.
+				Statements that drop, truncate, rename or rewrite data require --force outside test databases.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					&cli.BoolFlag{Name: "test", Usage: "run against the test database"},
+					&cli.StringFlag{Name: "database", Usage: "run against database `NAME` instead of DB_NAME, --test appends _test"},
+					&cli.StringFlag{Name: "file", Usage: "read the statements from `FILE`"},
+					&cli.BoolFlag{Name: "stdin", Aliases: []string{"from-stdin"}, Usage: "read the statements from standard input, e.g. generated by another tool"},
+					&cli.StringSliceFlag{Name: "table", Usage: "run the statements for `TABLE`, repeatable"},
+					&cli.BoolFlag{Name: "all", Usage: "run the statements for every table but the migrations table"},
+					&cli.IntFlag{Name: "concurrency", Usage: "run the statements of up to `N` tables at once", Value: 1},
+					&cli.BoolFlag{Name: "force", Usage: "allow destructive statements on a non-test database"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					if database := c.String("database"); database != "" {
+						os.Setenv("DB_NAME", database)
+					}
+					var stdin io.Reader
+					if c.Bool("stdin") {
+						stdin = c.App.Reader
+					}
+					return execSQL(c.App.Writer, c.Bool("test"), c.String("migrations-table"), strings.Join(c.Args().Slice(), " "), c.String("file"), stdin, c.StringSlice("table"), c.Bool("all"), c.Int("concurrency"), c.Bool("force"))
+				}),
+			},
+			{
+				Name:      "truncate",
+				Usage:     "empty tables of the database",
+				ArgsUsage: "[TABLE...]",
+				Description: `
+				This command will run TRUNCATE TABLE for each given table, or with --all every table but the migrations
+				table and views, on --concurrency connections at once. Every table is attempted and the failures are
+				reported at the end. Truncating tables of a non-test database requires --force.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					&cli.BoolFlag{Name: "test", Usage: "truncate tables of the test database"},
+					&cli.BoolFlag{Name: "all", Usage: "truncate every table but the migrations table"},
+					&cli.IntFlag{Name: "concurrency", Usage: "truncate up to `N` tables at once", Value: 1},
+					&cli.BoolFlag{Name: "force", Usage: "allow truncating tables of a non-test database"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					return truncate(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.Args().Slice(), c.Bool("all"), c.Int("concurrency"), c.Bool("force"))
+				}),
+			},
+			{
+				Name:      "system",
+				Usage:     "run a ClickHouse SYSTEM command",
+				ArgsUsage: "COMMAND [TABLE] | STATEMENT",
+				Description: `
+				This command will run one of the named SYSTEM commands below, or any other arguments as a SYSTEM
+				statement (e.g. system SYNC REPLICA events), against the configured server:
+					flush-logs - SYSTEM FLUSH LOGS, writes the buffered system.*_log tables
+					reload-config - SYSTEM RELOAD CONFIG
+					drop-cache - SYSTEM DROP MARK CACHE and SYSTEM DROP UNCOMPRESSED CACHE
+					restart-replica TABLE - SYSTEM RESTART REPLICA TABLE
+				drop-cache, restart-replica and statements starting with DROP, KILL, RESTART, RESTORE, SHUTDOWN, STOP or
+				UNFREEZE require --force outside test databases.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "run against the test database"},
+					&cli.BoolFlag{Name: "force", Usage: "allow destructive commands on a non-test database"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					return system(c.App.Writer, c.Bool("test"), c.Args().Slice(), c.Bool("force"))
+				}),
+			},
+			{
+				Name:      "query",
+				Usage:     "run a SELECT and print the result as CSV",
+				ArgsUsage: "[SQL]",
+				Description: `
+				This command will run the given statement (or the contents of --file) against the configured database
+				and write the rows as CSV, or TSV with --tsv, including a header row.
+				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "query the test database"},
+					&cli.StringFlag{Name: "file", Usage: "read the query from `FILE`"},
+					&cli.BoolFlag{Name: "tsv", Usage: "write tab separated values instead of CSV"},
+					&cli.IntFlag{Name: "limit", Usage: "stop after `N` rows (default no limit)"},
+					&cli.BoolFlag{Name: "readonly", Usage: "connect as DB_READONLY_USER (falls back to DB_USER when unset)"},
+					&cli.BoolFlag{Name: "explain", Usage: "print the execution plan of each statement instead of running it"},
+					&cli.StringFlag{Name: "explain-kind", Usage: "`KIND` of EXPLAIN: AST, SYNTAX, PLAN, PIPELINE or ESTIMATE", Value: "PLAN"},
+				},
+				Action: auditedIf(queryMutates, func(c *cli.Context) error {
+					explain := ""
+					if c.Bool("explain") {
+						explain = c.String("explain-kind")
+					}
+					return query(c.App.Writer, c.Bool("test"), strings.Join(c.Args().Slice(), " "), c.String("file"), c.Bool("tsv"), c.Int("limit"), c.Bool("readonly"), explain)
+				}),
+			},
+			{
+				Name:  "rollback",
+				Usage: "revert every migration applied after a given one",
+				Description: `
+				This command will run the down migrations (NAME.down.sql) of every migration applied after the --to
+				migration, newest first, and remove them from the migrations bookkeeping table. It fails before reverting
+				anything when the target is not applied or a down migration is missing. Rolling back a non-test database
+				requires --force.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					lockTTLFlag,
+					&cli.StringFlag{Name: "to", Usage: "migration `NAME` to roll back to, it stays applied", Required: true},
+					&cli.BoolFlag{Name: "test", Usage: "roll back the test database"},
+					&cli.BoolFlag{Name: "force", Usage: "allow rolling back a non-test database"},
+				},
+				Action: audited(func(c *cli.Context) error {
+					return rollback(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.String("to"), c.Bool("force"), c.Duration("lock-ttl"))
+				}),
+			},
+			{
+				Name:  "migrate:reset",
+				Usage: "revert every applied migration",
+				Description: `
+				This command will run the down migration of every applied migration, newest first, and remove them from the
+				migrations bookkeeping table. It fails before reverting anything when a down migration is missing. With
+				--plan it only lists the migrations it would revert. Resetting a non-test database requires --force, with
+				--plan too.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					lockTTLFlag,
+					&cli.BoolFlag{Name: "test", Usage: "reset the test database"},
+					&cli.BoolFlag{Name: "force", Usage: "allow resetting a non-test database"},
+					&cli.BoolFlag{Name: "plan", Aliases: []string{"dry-run"}, Usage: "print the migrations that would be reverted without changing anything"},
+				},
+				Action: auditedIf(func(c *cli.Context) bool { return !c.Bool("plan") }, func(c *cli.Context) error {
+					return migrateReset(c.App.Writer, c.Bool("test"), c.String("migrations-table"), c.Bool("force"), c.Bool("plan"), c.Duration("lock-ttl"))
+				}),
+			},
+			{
+				Name:  "fresh",
+				Usage: "drop every table of the database and run every migration again",
+				Description: `
+				This command will drop every table and view of the database, the migrations bookkeeping table included, and
+				apply every migration to the empty database, as migrate does. With --plan it only lists the tables it would
+				drop and the migrations it would apply. Wiping a non-test database requires --force, with --plan too.
+				`,
+				Flags: []cli.Flag{
+					migrationsTableFlag,
+					lockTTLFlag,
+					&cli.BoolFlag{Name: "test", Usage: "wipe the test database"},
+					&cli.BoolFlag{Name: "force", Usage: "allow wiping a non-test database"},
+					&cli.BoolFlag{Name: "plan", Aliases: []string{"dry-run"}, Usage: "print the tables that would be dropped and the migrations that would be applied without changing anything"},
+				},
+				Action: auditedIf(func(c *cli.Context) bool { return !c.Bool("plan") }, func(c *cli.Context) error {
+					return fresh(c.Bool("test"), getMigrateOptions(c), c.Bool("force"), c.Bool("plan"))
+				}),
+			},
+			{
+				Name:    "repl",
+				Aliases: []string{"console"},
+				Usage:   "run statements interactively over one connection",
+				Description: `
+				This command will open a single connection to the configured database and read statements until \q or
+				Ctrl+D, printing their results as tables. Statements end with a semicolon and can span several lines,
+				\dt lists the tables and the history is kept in ~/.logme_cli_history.
 				`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "test", Usage: "connect to the test database"},
+				},
 				Action: func(c *cli.Context) error {
-					return migrate(true)
+					return repl(c.App.Writer, c.Bool("test"))
+				},
+			},
+			{
+				Name:      "restore",
+				Usage:     "restore a table from a backup table",
+				ArgsUsage: "TABLE",
+				Description: `
+				This command will copy the rows of a backup table (e.g. one made by migrate --backup-before-drop) back into
+				TABLE with INSERT ... SELECT, after checking both tables exist and the backup has every column of TABLE
+				with the same type. Restoring into a non-test database requires --force.
+				`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "from", Usage: "`BACKUP_TABLE` to copy the rows from", Required: true},
+					&cli.BoolFlag{Name: "truncate", Usage: "empty TABLE before restoring into it"},
+					&cli.BoolFlag{Name: "force", Usage: "allow restoring into a non-test database or on the prod profile"},
+					&cli.BoolFlag{Name: "test", Usage: "restore in the test database"},
 				},
+				Action: audited(func(c *cli.Context) error {
+					if c.NArg() != 1 {
+						return configErrorf("restore requires exactly one TABLE")
+					}
+					return restore(c.App.Writer, c.Bool("test"), c.Args().First(), c.String("from"), c.Bool("truncate"), c.Bool("force"))
+				}),
 			},
 			{
 				Name:    "up",
 				Aliases: []string{"u"},
 				Usage:   "start logme docker containers",
-				Description: `Start logme containers`,
+				ArgsUsage: "[SERVICE...]",
+				Description: `Start logme containers, optionally limited to the given docker-compose services`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "force-recreate", Usage: "recreate containers even if their configuration has not changed"},
+					&cli.BoolFlag{Name: "build", Usage: "build images before starting containers"},
+					&cli.BoolFlag{Name: "only-missing", Usage: "only start services that are not running, leaving running ones untouched"},
+					&cli.BoolFlag{Name: "wait-healthy", Usage: "wait until the services defining a healthcheck report healthy"},
+					&cli.DurationFlag{Name: "timeout", Usage: "give up --wait-healthy after `DURATION`", Value: 2 * time.Minute},
+					&cli.IntFlag{Name: "retries", Usage: "retry up to `N` times when docker fails with a transient error (e.g. network not found)"},
+					dryRunFlag,
+				},
 				Action: func(c *cli.Context) error {
-					return up()
+					var waitTimeout time.Duration
+					if c.Bool("wait-healthy") {
+						if waitTimeout = c.Duration("timeout"); waitTimeout <= 0 {
+							return configErrorf("--timeout must be positive")
+						}
+					}
+					return up(c.App.Writer, c.Args().Slice(), c.Bool("force-recreate"), c.Bool("build"), c.Bool("only-missing"), c.Bool("dry-run"), waitTimeout, c.Int("retries"))
 				},
 			},
 			{
@@ -75,8 +1077,43 @@ func main() {
 				Aliases: []string{"d"},
 				Usage:   "stop logme docker containers",
 				Description: `Stop logme containers`,
+				Flags:       []cli.Flag{dryRunFlag},
+				Action: func(c *cli.Context) error {
+					return down(c.App.Writer, c.Bool("dry-run"))
+				},
+			},
+			{
+				Name:      "container:start",
+				Usage:     "start containers with docker, without docker-compose",
+				ArgsUsage: "NAME...",
+				Description: `
+				This command will run docker start for the given containers, for environments that create them with docker
+				run rather than docker-compose. It exits non-zero when docker fails.
+				`,
+				Flags: []cli.Flag{containerDryRunFlag},
+				Action: func(c *cli.Context) error {
+					return containerAction(c.App.Writer, "start", c.Args().Slice(), false, c.Bool("dry-run"))
+				},
+			},
+			{
+				Name:      "container:stop",
+				Usage:     "stop containers with docker, without docker-compose",
+				ArgsUsage: "NAME...",
+				Flags:     []cli.Flag{containerDryRunFlag},
+				Action: func(c *cli.Context) error {
+					return containerAction(c.App.Writer, "stop", c.Args().Slice(), false, c.Bool("dry-run"))
+				},
+			},
+			{
+				Name:      "container:remove",
+				Usage:     "remove containers with docker, without docker-compose",
+				ArgsUsage: "NAME...",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "force", Usage: "also remove running containers"},
+					containerDryRunFlag,
+				},
 				Action: func(c *cli.Context) error {
-					return down()
+					return containerAction(c.App.Writer, "remove", c.Args().Slice(), c.Bool("force"), c.Bool("dry-run"))
 				},
 			},
 			{
@@ -85,230 +1122,1477 @@ func main() {
 				Usage:   "list logme docker containers",
 				Description: `List logme docker containers`,
 				Action: func(c *cli.Context) error {
-					return list()
+					return list(c.App.Writer)
+				},
+			},
+			{
+				Name:      "logs",
+				Usage:     "follow logs of logme docker-compose services",
+				ArgsUsage: "[SERVICE...]",
+				Description: `Stream the interleaved logs of all docker-compose services (or only the given ones) until interrupted`,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "tail", Usage: "number of lines to show from the end of each service's logs (default all)"},
+				},
+				Action: func(c *cli.Context) error {
+					return logs(c.App.Writer, c.Args().Slice(), c.String("tail"))
 				},
 			},
 			{
 				Name:    "test",
 				Aliases: []string{"t"},
 				Usage:   "run logme test",
-				Description: `Run logme tests`,
+				ArgsUsage: "[PACKAGE...] [-- GO TEST FLAGS]",
+				Description: `Run logme tests inside the logme_server container`,
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "json", Usage: "emit machine-readable go test -json events"},
+					&cli.BoolFlag{Name: "summary-only", Usage: "print the number of passed and failed packages instead of the go test output"},
+					&cli.BoolFlag{Name: "verbose", Usage: "run go test -v, with --summary-only also print the full output"},
+					&cli.IntFlag{Name: "parallel", Usage: "run up to `N` parallel tests of a package at once (go test -parallel)"},
+					&cli.IntFlag{Name: "p", Usage: "test up to `N` packages at once (go test -p)"},
+				},
 				Action: func(c *cli.Context) error {
-					return test()
+					return test(c.App.Writer, c.Bool("json"), c.Bool("summary-only"), c.Bool("verbose"), c.Int("parallel"), c.Int("p"), c.Args().Slice())
 				},
 			},
 		},
 	}
 
-	sort.Sort(cli.CommandsByName(app.Commands))
+	sort.Sort(cli.CommandsByName(app.Commands))
+
+	err := app.Run(os.Args)
+	if err != nil {
+		if !silent(err) {
+			printError(err, errorFormat)
+		}
+		os.Exit(exitCode(err))
+	}
+}
+
+func migrate(isTest bool, opts migrateOptions) (err error) {
+	if err := validateTableName(opts.table); err != nil {
+		return err
+	}
+	if dbName := getDbName(isTest); opts.watch && !opts.force && !isTestDatabase(dbName) {
+		return configErrorf("refusing to watch non-test database '%s' without --force", dbName)
+	}
+	if opts.stateless && opts.watch {
+		return configErrorf("--stateless cannot be combined with --watch, every change would re-apply all migrations")
+	}
+	if opts.metricsEndpoint != "" {
+		if err := validateMetricsFormat(opts.metricsFormat); err != nil {
+			return err
+		}
+	}
+	if opts.strictOrdering {
+		names, err := migrationFiles()
+		if err != nil {
+			return err
+		}
+		if err := checkStrictOrdering(names); err != nil {
+			return err
+		}
+	}
+	opts.database = getDbName(isTest)
+	var db driver.Conn
+	if opts.diagnosticsBundle != "" {
+		// written however the run ends, a failing run is what the bundle is for
+		defer func() {
+			if bundleErr := writeDiagnosticsBundle(opts.diagnosticsBundle, db, opts, err); bundleErr != nil {
+				fmt.Fprintln(opts.out, "warning: could not write the diagnostics bundle: "+bundleErr.Error())
+				return
+			}
+			fmt.Fprintln(opts.out, "Diagnostics written to "+opts.diagnosticsBundle)
+		}()
+	}
+	if db, err = getDbConn(isTest); err != nil {
+		return err
+	}
+	if opts.settings, err = runSetupSQL(context.Background(), db, opts.setupSQL); err != nil {
+		return err
+	}
+	if opts.checkSyntax {
+		return checkSyntax(context.Background(), db, opts)
+	}
+	if opts.stateless {
+		fmt.Fprintln(opts.out, "warning: --stateless does not record migrations, running it again re-applies every file")
+	} else if err := createMigrationsTable(db, opts.table); err != nil {
+		return err
+	}
+	if !opts.watch {
+		return runMigrations(db, opts)
+	}
+	// like a failure on a change, a failed first run is reported and the next save of a migration retries it
+	if err := runMigrations(db, opts); err != nil {
+		fmt.Fprintln(opts.out, "error: "+err.Error())
+	}
+	return watchMigrations(db, opts)
+}
+
+// migrateInContainer re-runs the given command line, minus --in-container, with the CLI inside the server container
+func migrateInContainer(out io.Writer, args []string) error {
+	// DB_LOCAL_ADDR is the host's view of ClickHouse, clear it so the container connects through DB_ADDR
+	execArgs := []string{"exec", "-i", "-e", "DB_LOCAL_ADDR=", serverContainer, "logme-cli"}
+	for _, arg := range args {
+		if arg == "--in-container" || arg == "-in-container" || strings.HasPrefix(arg, "--in-container=") {
+			continue
+		}
+		execArgs = append(execArgs, arg)
+	}
+
+	cmd, err := dockerCommand(execArgs...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+func migrateRun(isTest bool, file string, replace bool, force bool, recordOnly bool, opts migrateOptions) error {
+	table := opts.table
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	name := filepath.Base(file)
+	if isDownMigration(name) {
+		return configErrorf("'%s' is a down migration and cannot be run directly", name)
+	}
+	if _, err := os.Stat(migrationPath(name)); err != nil {
+		return err
+	}
+
+	if replace && recordOnly {
+		return configErrorf("--record-only cannot be combined with --replace")
+	}
+
+	dbName := getDbName(isTest)
+	if replace {
+		if err := guardProfile(force); err != nil {
+			return err
+		}
+	}
+	if replace && !force && !isTestDatabase(dbName) {
+		return configErrorf("refusing to replace a migration on non-test database '%s' without --force", dbName)
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+	opts.database = dbName
+
+	ctx := context.Background()
+
+	if opts.settings, err = runSetupSQL(ctx, db, opts.setupSQL); err != nil {
+		return err
+	}
+	if err := createMigrationsTable(db, table); err != nil {
+		return err
+	}
+
+	locks, err := migrationLocks([]string{name})
+	if err != nil {
+		return err
+	}
+	lock, err := acquireMigrationLocks(ctx, opts.out, db, table, locks, opts.lockTTL)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	applied, err := migrationApplied(ctx, db, table, name)
+	if err != nil {
+		return err
+	}
+
+	if recordOnly {
+		if applied {
+			fmt.Fprintln(opts.out, "Migration already recorded: "+name)
+			return nil
+		}
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return err
+		}
+		if err := recordMigration(ctx, db, table, name, content); err != nil {
+			return err
+		}
+		fmt.Fprintln(opts.out, "warning: "+name+" was recorded as applied without running its SQL, make sure its changes are in place")
+		fmt.Fprintln(opts.out, "Recorded migration: "+name)
+		return nil
+	}
+
+	if applied {
+		if !replace {
+			fmt.Fprintln(opts.out, "Migration already ran: "+name+" (use --replace to run it again)")
+			return nil
+		}
+		if err := revertMigration(ctx, opts.out, db, table, name); err != nil {
+			return err
+		}
+	}
+
+	if opts.profile != nil {
+		defer opts.profile.print(opts.out)
+	}
+
+	opts.runID = uuid.NewString()
+	fmt.Fprintln(opts.out, "Run ID: "+opts.runID)
+
+	warnings, err := applyMigration(ctx, db, opts, name)
+	if err != nil {
+		return err
+	}
+
+	if applied {
+		fmt.Fprintln(opts.out, "Replaced migration: "+name)
+	} else {
+		fmt.Fprintln(opts.out, "Successfully migrated: "+name)
+	}
+	printWarnings(opts.out, warnings, opts.quiet)
+
+	return nil
+}
+
+func migrateExport(out io.Writer, isTest bool, table string) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	db, err := getReadonlyDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	rows, err := db.Query(context.Background(), fmt.Sprintf("SELECT name, dt, checksum, status, dir, applied_at FROM %s FINAL ORDER BY applied_at, dt, name", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var (
+			name, sum, status, dir string
+			dt, appliedAt          time.Time
+		)
+		if err := rows.Scan(&name, &dt, &sum, &status, &dir, &appliedAt); err != nil {
+			return err
+		}
+		values = append(values, fmt.Sprintf("(%s, %d, %s, %s, %s, %s)", quoteString(name), dt.Unix(), quoteString(sum), quoteString(status), quoteString(dir), quoteString(formatAppliedAt(appliedAt))))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, strings.TrimSpace(migrationsTableDDL(table))+";")
+
+	// nothing recorded yet, the table definition is all there is to export
+	if len(values) == 0 {
+		return nil
+	}
+
+	fmt.Fprintf(out, "\nINSERT INTO %s (name, dt, checksum, status, dir, applied_at) VALUES\n%s;\n", table, strings.Join(values, ",\n"))
+
+	return nil
+}
+
+func quoteString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", `\'`) + "'"
+}
+
+func validateTableName(table string) error {
+	if !identifierRegexp.MatchString(table) {
+		return configErrorf("invalid migrations table name '%s': must start with a letter or underscore and contain only letters, digits and underscores", table)
+	}
+	return nil
+}
+
+func getDbName(isTest bool) string {
+	dbName := os.Getenv("DB_NAME")
+	if dbName == "" {
+		dbName = "logme"
+	}
+
+	if isTest {
+		dbName += "_test"
+	}
+
+	return dbName
+}
+
+func isTestDatabase(dbName string) bool {
+	return strings.HasSuffix(dbName, "_test")
+}
+
+// getDbAddr resolves the address of ClickHouse from DB_ADDR, then DB_HOST and DB_PORT, then DB_LOCAL_ADDR
+func getDbAddr() (string, error) {
+	if os.Getenv("DB_ADDR") == "" && os.Getenv("DB_HOST") == "" {
+		if localAddr := os.Getenv("DB_LOCAL_ADDR"); localAddr != "" {
+			return localAddr, nil
+		}
+	}
+
+	return getServerAddr()
+}
+
+// getServerAddr is the address of ClickHouse from DB_ADDR or DB_HOST, ignoring the host-side DB_LOCAL_ADDR, as
+// seen from the network of the server (e.g. the other end of --ssh-tunnel)
+func getServerAddr() (string, error) {
+	if addr := os.Getenv("DB_ADDR"); addr != "" {
+		return addr, nil
+	}
+
+	if host := os.Getenv("DB_HOST"); host != "" {
+		port := os.Getenv("DB_PORT")
+		if port == "" {
+			port = "9000"
+		}
+		return net.JoinHostPort(host, port), nil
+	}
+
+	return "", configErrorf("environment variable DB_ADDR, DB_HOST or DB_LOCAL_ADDR required for migrations")
+}
+
+func getCompression(addr string) (*clickhouse.Compression, error) {
+	lz4 := &clickhouse.Compression{
+		Method: clickhouse.CompressionLZ4,
+	}
+
+	switch mode := os.Getenv("DB_COMPRESSION"); mode {
+	case "lz4":
+		return lz4, nil
+	case "none":
+		return nil, nil
+	case "", "auto":
+		// compressing over loopback only costs CPU
+		if isLoopback(addr) {
+			return nil, nil
+		}
+		return lz4, nil
+	default:
+		return nil, configErrorf("invalid DB_COMPRESSION '%s': expected lz4, none or auto", mode)
+	}
+}
+
+// getConnMaxLifetime reads DB_CONN_MAX_LIFETIME (e.g. 10m), pooled connections older than this are recycled instead
+// of reused, zero keeps the driver default of one hour
+func getConnMaxLifetime() (time.Duration, error) {
+	value := os.Getenv("DB_CONN_MAX_LIFETIME")
+	if value == "" {
+		return 0, nil
+	}
+
+	lifetime, err := time.ParseDuration(value)
+	if err != nil || lifetime <= 0 {
+		return 0, configErrorf("invalid DB_CONN_MAX_LIFETIME '%s': expected a positive duration such as 10m", value)
+	}
+
+	return lifetime, nil
+}
+
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil || len(ips) == 0 {
+		return false
+	}
+
+	for _, ip := range ips {
+		if !ip.IsLoopback() {
+			return false
+		}
+	}
+
+	return true
+}
+
+func getDbConn(isTest bool) (driver.Conn, error) {
+	return openDbConn(isTest, os.Getenv("DB_USER"), os.Getenv("DB_PASS"), clickhouse.Settings{
+		"max_execution_time": 60,
+	})
+}
+
+// getReadonlyDbConn connects as DB_READONLY_USER for commands that only read, so they cannot change data even if
+// misused, it falls back to the DB_USER credentials when no readonly user is configured
+func getReadonlyDbConn(isTest bool) (driver.Conn, error) {
+	user := os.Getenv("DB_READONLY_USER")
+	if user == "" {
+		return getDbConn(isTest)
+	}
+
+	// a readonly=1 user may not change any setting, which includes the ones sent along with every query
+	return openDbConn(isTest, user, os.Getenv("DB_READONLY_PASS"), nil)
+}
+
+// settingOverrides holds the --setting flags, layered over the connection settings of every command
+var settingOverrides clickhouse.Settings
+
+// poolSize is the most connections a command opens at once, raised to the --concurrency of exec and truncate. Zero
+// keeps the default of the driver
+var poolSize int
+
+func openDbConn(isTest bool, user string, pass string, settings clickhouse.Settings) (driver.Conn, error) {
+	addr, err := getDbAddr()
+	if err != nil {
+		return nil, err
+	}
+
+	auth := clickhouse.Auth{
+		Database: getDbName(isTest),
+		Username: user,
+		Password: pass,
+	}
+
+	compression, err := getCompression(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	maxLifetime, err := getConnMaxLifetime()
+	if err != nil {
+		return nil, err
+	}
+
+	merged := clickhouse.Settings{}
+	for name, value := range settings {
+		merged[name] = value
+	}
+	for name, value := range settingOverrides {
+		merged[name] = value
+	}
+
+	conn, err := clickhouse.Open(&clickhouse.Options{
+		Addr:            []string{addr},
+		Auth:            auth,
+		Compression:     compression,
+		ConnMaxLifetime: maxLifetime,
+		MaxOpenConns:    poolSize,
+		Settings:        merged,
+	})
+
+	// Failed to connect
+	if err != nil {
+		return nil, &connectionError{err: err}
+	}
+
+	// the driver connects lazily, make connection problems surface here rather than on the first query
+	if err := withRetry(func() error { return conn.Ping(context.Background()) }); err != nil {
+		return nil, &connectionError{err: err}
+	}
+
+	if err := checkSettings(context.Background(), conn, settingOverrides); err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func createMigrationsTable(db driver.Conn, table string) error {
+	// underscores are LIKE wildcards, escape them so only the exact table matches
+	sqlExists := fmt.Sprintf(`SHOW TABLES LIKE '%s'`, strings.ReplaceAll(table, "_", `\\_`))
+
+	// this is the first query of a run, retried in case the server is still starting up
+	var exists string
+	err := withRetry(func() error {
+		err := db.QueryRow(context.Background(), sqlExists).Scan(&exists)
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// migrations table already exists, tables created by older versions may lack columns added since (e.g. checksum)
+	if exists != "" {
+		return upgradeMigrationsTable(db, table)
+	}
+
+	err = withRetry(func() error {
+		return db.Exec(context.Background(), migrationsTableDDL(table))
+	})
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// migrationsTableColumns are the columns of the migrations table, in order, new columns are appended
+var migrationsTableColumns = []columnDescription{
+	{Name: "name", Type: "String"},
+	{Name: "dt", Type: "DateTime"},
+	{Name: "checksum", Type: "String"},
+	{Name: "status", Type: "String"},
+	{Name: "dir", Type: "String"},
+	// the order migrations were applied in, dt only has a precision of seconds. Zero for rows recorded before it
+	{Name: "applied_at", Type: "DateTime64(6, 'UTC')"},
+}
+
+// statuses recorded for the migrations skipped by their "-- logme:env" or "-- logme:min-version" header. Applied
+// migrations have an empty status, the skipped ones stay pending and are checked again on every run, so they are
+// retried once the server is upgraded
+const (
+	statusSkippedEnv     = "skipped (env)"
+	statusSkippedVersion = "skipped (version)"
+)
+
+func migrationsTableDDL(table string) string {
+	columns := make([]string, len(migrationsTableColumns))
+	for i, column := range migrationsTableColumns {
+		columns[i] = fmt.Sprintf("\t\t\t%-10s %s", column.Name, column.Type)
+	}
+
+	return fmt.Sprintf(`
+		CREATE TABLE IF NOT EXISTS %s (
+%s
+		) engine=ReplacingMergeTree(dt) ORDER BY (name)
+	`, table, strings.Join(columns, ",\n"))
+}
+
+// upgradeMigrationsTable adds the columns of migrationsTableColumns an existing migrations table is missing and
+// converts a MergeTree one to ReplacingMergeTree
+func upgradeMigrationsTable(db driver.Conn, table string) error {
+	ctx := context.Background()
+
+	rows, err := db.Query(ctx, "SELECT name FROM system.columns WHERE database = currentDatabase() AND table = $1", table)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	existing := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		existing[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, column := range migrationsTableColumns {
+		if existing[column.Name] {
+			continue
+		}
+		if err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s", table, column.Name, column.Type)); err != nil {
+			return fmt.Errorf("upgrading migrations table %s: %w", table, err)
+		}
+	}
+
+	if err := convertMigrationsTable(ctx, db, table); err != nil {
+		return fmt.Errorf("upgrading migrations table %s: %w", table, err)
+	}
+
+	return nil
+}
+
+// convertMigrationsTable moves a migrations table created as a plain MergeTree to the ReplacingMergeTree of
+// migrationsTableDDL, which collapses rows recorded twice for the same migration. The rows are copied to a new table
+// swapped in once its row count matches, so an interrupted conversion leaves the original untouched
+func convertMigrationsTable(ctx context.Context, db driver.Conn, table string) error {
+	var engine string
+	if err := db.QueryRow(ctx, "SELECT engine FROM system.tables WHERE database = currentDatabase() AND name = $1", table).Scan(&engine); err != nil {
+		return err
+	}
+	// other engines (e.g. ReplicatedMergeTree) were chosen on purpose, left as they are
+	if engine != "MergeTree" {
+		return nil
+	}
+
+	converted := table + "_replacing"
+	previous := table + "_mergetree"
+
+	columns := make([]string, len(migrationsTableColumns))
+	for i, column := range migrationsTableColumns {
+		columns[i] = column.Name
+	}
+
+	for _, sql := range []string{
+		"DROP TABLE IF EXISTS " + converted,
+		migrationsTableDDL(converted),
+		fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", converted, strings.Join(columns, ", "), strings.Join(columns, ", "), table),
+	} {
+		if err := db.Exec(ctx, sql); err != nil {
+			return err
+		}
+	}
+
+	var copied, original uint64
+	if err := db.QueryRow(ctx, "SELECT count() FROM "+converted).Scan(&copied); err != nil {
+		return err
+	}
+	if err := db.QueryRow(ctx, "SELECT count() FROM "+table).Scan(&original); err != nil {
+		return err
+	}
+	if copied != original {
+		return fmt.Errorf("copied %d of %d rows to %s, kept the MergeTree table", copied, original, converted)
+	}
+
+	if err := db.Exec(ctx, fmt.Sprintf("RENAME TABLE %s TO %s, %s TO %s", table, previous, converted, table)); err != nil {
+		return err
+	}
+
+	return db.Exec(ctx, "DROP TABLE "+previous)
+}
+
+func runMigrations(db driver.Conn, opts migrateOptions) (err error) {
+	ctx := context.Background()
+
+	if opts.profile != nil {
+		defer opts.profile.print(opts.out)
+	}
+
+	report := newJunitReport()
+	if opts.junit != "" {
+		// written however the run ends, a failing run is what the report is for
+		defer func() {
+			if writeErr := report.write(opts.junit); writeErr != nil && err == nil {
+				err = writeErr
+			}
+		}()
+	}
+
+	var (
+		migrated int
+		failed   []string
+		skipped  []string
+	)
+
+	if opts.metricsEndpoint != "" {
+		started := time.Now()
+		defer func() {
+			metrics := runMetrics{
+				Database: opts.database,
+				RunID:    opts.runID,
+				Duration: time.Since(started).Seconds(),
+				Applied:  migrated,
+				Failed:   len(failed),
+				Skipped:  len(skipped),
+				Success:  err == nil,
+			}
+			// without --continue-on-error the run stops at the failed migration
+			if err != nil && metrics.Failed == 0 && errors.As(err, new(*migrationError)) {
+				metrics.Failed = 1
+			}
+			pushMetrics(opts.out, opts.metricsEndpoint, opts.metricsFormat, metrics)
+		}()
+	}
+
+	var events *progressEvents
+	if opts.progressSocket != "" {
+		if events, err = dialProgressSocket(opts.out, opts.progressSocket); err != nil {
+			return err
+		}
+		defer events.close()
+		defer func() {
+			applied, failedCount, skippedCount, success := migrated, len(failed), len(skipped), err == nil
+			// without --continue-on-error the run stops at the failed migration
+			if err != nil && failedCount == 0 && errors.As(err, new(*migrationError)) {
+				failedCount = 1
+			}
+			done := progressEvent{Event: "done", RunID: opts.runID, Database: opts.database, Applied: &applied, Failed: &failedCount, Skipped: &skippedCount, Success: &success}
+			if err != nil {
+				done.Error = err.Error()
+			}
+			events.emit(done)
+		}()
+	}
+
+	if !opts.skipMissing && !opts.stateless {
+		missing, err := missingMigrations(ctx, db, opts.table)
+		if err != nil {
+			return err
+		}
+		for _, name := range missing {
+			fmt.Fprintln(opts.out, "warning: applied migration "+name+" no longer exists in "+strings.Join(migrationDirs, ", ")+" (use --skip-missing if it was removed on purpose)")
+		}
+	}
+
+	var pending []string
+	if opts.stateless {
+		pending, err = migrationFiles()
+	} else {
+		pending, err = pendingMigrations(ctx, db, opts.table)
+	}
+	if err != nil {
+		return err
+	}
+
+	if opts.sinceCommit != "" {
+		if pending, err = sinceCommitMigrations(opts, pending); err != nil {
+			return err
+		}
+	}
+
+	// the locks depend on the pending migrations' headers, pending is checked again under them as a concurrent runner
+	// may have applied some meanwhile
+	if !opts.stateless && !opts.locked && len(pending) > 0 {
+		names, err := migrationLocks(pending)
+		if err != nil {
+			return err
+		}
+		lock, err := acquireMigrationLocks(ctx, opts.out, db, opts.table, names, opts.lockTTL)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+
+		if pending, err = stillPending(ctx, db, opts.table, pending); err != nil {
+			return err
+		}
+	}
+
+	// a template missing its variables would otherwise fail the run halfway through
+	if err := checkTemplates(ctx, db, pending); err != nil {
+		return err
+	}
+
+	// for the "-- logme:min-version" directives, queried once
+	var serverVersion string
+	if len(pending) > 0 {
+		if err := db.QueryRow(ctx, "SELECT version()").Scan(&serverVersion); err != nil {
+			return err
+		}
+	}
+
+	if len(pending) > 0 {
+		opts.runID = uuid.NewString()
+		fmt.Fprintln(opts.out, "Run ID: "+opts.runID)
+	}
+	events.emit(progressEvent{Event: "start", RunID: opts.runID, Database: opts.database, Total: len(pending), Pending: pending})
+
+	// the live status line is redrawn in place, so only draw it on a terminal
+	showProgress := opts.progress && !opts.quiet && isTerminal(opts.out)
+
+	for i, name := range pending {
+		status, reason, err := migrationSkip(name, serverVersion)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			// recorded as skipped rather than applied, so it runs once the server is upgraded (or in its environment)
+			if !opts.stateless {
+				if err := recordSkip(ctx, db, opts.table, name, status); err != nil {
+					return err
+				}
+			}
+			fmt.Fprintln(opts.out, "Skipped migration: "+name+" ("+reason+")")
+			report.skip(name, reason)
+			skipped = append(skipped, name)
+			events.emit(progressEvent{Event: "skipped", RunID: opts.runID, Migration: name, Index: i + 1, Total: len(pending), Reason: reason})
+			continue
+		}
+
+		stopProgress := func() {}
+		if showProgress {
+			stopProgress = startProgress(opts.out, i+1, len(pending), name)
+		}
+
+		started := time.Now()
+		warnings, err := applyMigration(ctx, db, opts, name)
+		stopProgress()
+		duration := time.Since(started).Seconds()
+		report.add(name, time.Since(started), err)
+		if err != nil {
+			events.emit(progressEvent{Event: "error", RunID: opts.runID, Migration: name, Index: i + 1, Total: len(pending), Duration: &duration, Error: err.Error()})
+			if !opts.continueOnError {
+				for _, notRun := range pending[i+1:] {
+					report.skip(notRun, "not run, "+name+" failed")
+				}
+				return err
+			}
+			// not recorded as applied, so it is retried on the next run
+			fmt.Fprintln(opts.out, err.Error())
+			failed = append(failed, name)
+			continue
+		}
+
+		migrated++
+		fmt.Fprintln(opts.out, "Successfully migrated: "+name)
+		events.emit(progressEvent{Event: "applied", RunID: opts.runID, Migration: name, Index: i + 1, Total: len(pending), Duration: &duration})
+		printWarnings(opts.out, warnings, opts.quiet)
+	}
+
+	if len(skipped) > 0 {
+		fmt.Fprintf(opts.out, "Skipped %d migration(s) for another environment or a newer ClickHouse, they stay pending: %s\n", len(skipped), strings.Join(skipped, ", "))
+	}
 
-	err = app.Run(os.Args)
-	if err != nil {
-		log.Fatal(err)
+	if opts.continueOnError {
+		fmt.Fprintf(opts.out, "Applied %d migration(s), %d failed\n", migrated, len(failed))
+		if len(failed) > 0 {
+			return &migrationError{err: fmt.Errorf("failed migrations: %s", strings.Join(failed, ", "))}
+		}
+	}
+
+	// a run that changed nothing leaves the committed schema as it is
+	if opts.dumpSchema != "" && migrated > 0 {
+		if err := dumpSchema(ctx, db, opts.dumpSchema, opts.table); err != nil {
+			return err
+		}
+		fmt.Fprintln(opts.out, "Schema written to "+opts.dumpSchema)
 	}
+
+	return nil
 }
 
-func migrate(isTest bool) error {
-	db, err := getDbConn(isTest)
+// migrationSkip reads the directives of a migration to tell whether it does not apply to the current environment
+// or the server is too old to run it, serverVersion is only checked when set. The status is what the migrations table
+// records for the skipped migration
+func migrationSkip(name string, serverVersion string) (status string, reason string, err error) {
+	content, err := os.ReadFile(migrationPath(name))
 	if err != nil {
-		return err
+		return "", "", err
 	}
-	if err := createMigrationsTable(db); err != nil {
-		return err
+
+	directives := readDirectives(content)
+	if reason := envSkip(directives, currentEnv()); reason != "" {
+		return statusSkippedEnv, reason, nil
+	}
+	if serverVersion == "" {
+		return "", "", nil
+	}
+
+	reason, err = minVersionSkip(directives, serverVersion)
+	if err != nil {
+		return "", "", &configError{err: fmt.Errorf("%s: %w", name, err)}
+	}
+	if reason == "" {
+		return "", "", nil
 	}
-	return runMigrations(db)
+
+	return statusSkippedVersion, reason, nil
 }
 
-func getDbConn(isTest bool) (driver.Conn, error) {
-	localAddr := os.Getenv("DB_LOCAL_ADDR")
-	addr := os.Getenv("DB_ADDR")
+// currentEnv is the environment the "-- logme:env" headers are matched against, LOGME_ENV (--env) or the profile
+func currentEnv() string {
+	if env := os.Getenv("LOGME_ENV"); env != "" {
+		return env
+	}
+	return os.Getenv("LOGME_PROFILE")
+}
+
+// projectRoot is the directory .env was looked up in, see findProjectRoot
+var projectRoot = "."
+
+// errorFormat is how main reports a failed command (--error-format)
+var errorFormat = "text"
+
+// tunnel is the --ssh-tunnel of this invocation, closed once the command is done
+var tunnel *sshTunnel
+
+// migrationDirs are the directories migrations are read from (--migrations-dir), new migrations go to the first
+var migrationDirs = []string{migrationDir}
+
+// migrationFiles lists the migrations of every migrations directory in the order they should be applied. Two
+// directories using the same numeric prefix (or file name) is an error, the migrations table records the directory of
+// each migration next to its name
+func migrationFiles() ([]string, error) {
+	var names []string
+	owners := map[string]string{}
+
+	for _, dir := range migrationDirs {
+		files, err := readMigrationDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			// skip directories
+			if file.IsDir() {
+				continue
+			}
 
-	if localAddr != "" {
-		addr = localAddr
+			// skip files that are neither sql nor script migrations
+			if !isMigrationFile(file.Name()) {
+				continue
+			}
+
+			// skip down migrations, they only run when a migration is reverted
+			if isDownMigration(file.Name()) {
+				continue
+			}
+
+			key := file.Name()
+			if match := migrationPrefixRegexp.FindStringSubmatch(key); match != nil {
+				key = strings.TrimLeft(match[1], "0")
+			}
+			if owner, taken := owners[key]; taken && owner != dir {
+				return nil, configErrorf("migration %s%s collides with a migration in %s, use distinct numeric prefixes across migrations directories", dir, file.Name(), owner)
+			}
+			owners[key] = dir
+
+			names = append(names, file.Name())
+		}
 	}
 
-	if addr == "" {
-		return nil, errors.New("environment variable DB_ADDR or DB_LOCAL_ADDR required for migrations")
+	sortMigrationNames(names)
+
+	listed, err := readOrderFile(names)
+	if err != nil {
+		return nil, err
+	}
+	if listed == nil {
+		return orderMigrations(names)
 	}
 
-	dbName := os.Getenv("DB_NAME")
-	if dbName == "" {
-		dbName = "logme"
+	// an order file is applied as written, so the dependencies have to agree with it
+	ordered, err := orderMigrations(listed)
+	if err != nil {
+		return nil, err
+	}
+	for i := range ordered {
+		if ordered[i] != listed[i] {
+			return nil, configErrorf("%s lists %s after a migration requiring it (logme:requires)", migrationDirs[0]+orderFile, ordered[i])
+		}
 	}
 
-	dbSuffix := ""
-	if isTest {
-		dbSuffix = "_test"
+	return listed, nil
+}
+
+// sortMigrationNames sorts by numeric prefix, so files from several directories (or padded to different widths)
+// interleave as numbered, then by name
+func sortMigrationNames(names []string) {
+	prefix := func(name string) (int, bool) {
+		match := migrationPrefixRegexp.FindStringSubmatch(name)
+		if match == nil {
+			return 0, false
+		}
+		n, err := strconv.Atoi(match[1])
+		return n, err == nil
 	}
 
-	auth := clickhouse.Auth{
-		Database: dbName + dbSuffix,
+	sort.SliceStable(names, func(i, j int) bool {
+		a, aNumbered := prefix(names[i])
+		b, bNumbered := prefix(names[j])
+		switch {
+		case aNumbered && bNumbered && a != b:
+			return a < b
+		case aNumbered != bNumbered:
+			return aNumbered
+		}
+		return names[i] < names[j]
+	})
+}
+
+// readMigrationDir lists a migrations directory, explaining the usual cause when it does not exist: running the CLI
+// away from the project root
+func readMigrationDir(dir string) ([]os.DirEntry, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		path, _ := filepath.Abs(dir)
+		return nil, configErrorf("migrations directory %s does not exist, run logme-cli from the project root or point --migrations-dir at the migrations", path)
+	}
+	return entries, err
+}
+
+// migrationPath locates a migration (or down migration) file in the migrations directories, falling back to the
+// first directory for files that do not exist
+func migrationPath(name string) string {
+	for _, dir := range migrationDirs {
+		if _, err := os.Stat(dir + name); err == nil {
+			return dir + name
+		}
 	}
+	return migrationDirs[0] + name
+}
 
-	if user := os.Getenv("DB_USER"); user != "" {
-		auth.Username = user
+func pendingMigrations(ctx context.Context, db driver.Conn, table string) ([]string, error) {
+	names, err := migrationFiles()
+	if err != nil {
+		return nil, err
 	}
 
-	if pass := os.Getenv("DB_PASS"); pass != "" {
-		auth.Password = pass
+	var pending []string
+	for _, name := range names {
+		applied, err := migrationApplied(ctx, db, table, name)
+		if err != nil {
+			return nil, err
+		}
+
+		// migration already ran, continue
+		if applied {
+			continue
+		}
+
+		pending = append(pending, name)
 	}
 
-	conn, err := clickhouse.Open(&clickhouse.Options{
-		Addr: []string{addr},
-		Auth: auth,
-		Compression: &clickhouse.Compression{
-			Method: clickhouse.CompressionLZ4,
-		},
-		Settings: clickhouse.Settings{
-			"max_execution_time": 60,
-		},
-	})
+	return pending, nil
+}
 
-	// Failed to connect
+// appliedMigrations returns the checksum recorded for each applied migration, empty when it predates checksums
+func appliedMigrations(ctx context.Context, db driver.Conn, table string) (map[string]string, error) {
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT name, checksum FROM %s FINAL WHERE status = ''", table))
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	return conn, nil
+	applied := map[string]string{}
+	for rows.Next() {
+		var name, sum string
+		if err := rows.Scan(&name, &sum); err != nil {
+			return nil, err
+		}
+		applied[name] = sum
+	}
+
+	return applied, rows.Err()
 }
 
-func createMigrationsTable(db driver.Conn) error {
-	sqlExists := "SHOW TABLES LIKE 'migrations'"
+// missingMigrations lists applied migrations whose file is no longer in the migrations directory, those squashed
+// into a baseline (migrate:squash) are archived on purpose
+func missingMigrations(ctx context.Context, db driver.Conn, table string) ([]string, error) {
+	applied, err := appliedMigrations(ctx, db, table)
+	if err != nil {
+		return nil, err
+	}
+	squashed, err := squashedMigrations()
+	if err != nil {
+		return nil, err
+	}
 
-	var exists string
-	if err := db.QueryRow(context.Background(), sqlExists).Scan(&exists); err != nil {
-		if !errors.Is(err, sql.ErrNoRows) {
-			// unknown error
-			panic(err.Error())
+	var missing []string
+	for name := range applied {
+		if squashed[name] {
+			continue
+		}
+		if _, err := os.Stat(migrationPath(name)); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, name)
 		}
 	}
+	sort.Strings(missing)
 
-	// migrations table already exists
-	if exists != "" {
-		return nil
+	return missing, nil
+}
+
+func migrationApplied(ctx context.Context, db driver.Conn, table string, name string) (bool, error) {
+	// FINAL so a migration recorded twice (e.g. by two concurrent runs) still reads as a single row
+	sqlExists := fmt.Sprintf("SELECT 1 FROM %s FINAL WHERE name = %s AND status = '' LIMIT 1", table, quoteString(name))
+
+	var exists uint8
+	if err := db.QueryRow(ctx, sqlExists).Scan(&exists); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			// unknown error
+			return false, err
+		}
 	}
 
-	err := db.Exec(context.Background(), `
-		CREATE TABLE IF NOT EXISTS migrations (
-			name       String,
-			dt         DateTime
-		) engine=MergeTree() ORDER BY (name, dt)
-	`)
+	return exists == 1, nil
+}
 
+func applyMigration(ctx context.Context, db driver.Conn, opts migrateOptions, name string) ([]string, error) {
+	content, err := os.ReadFile(migrationPath(name))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
-}
+	// the checksum stays that of the file, the rendered SQL differs across replicas
+	sql, err := renderMigration(name, content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
 
-func runMigrations(db driver.Conn) error {
-	migrationDir := "internal/logme/migrations/"
-	files, err := ioutil.ReadDir(migrationDir)
+	directives := readDirectives(sql)
+	directiveSettings, err := migrationSettings(directives)
 	if err != nil {
-		return err
+		return nil, &configError{err: fmt.Errorf("%s: %w", name, err)}
+	}
+	after, err := afterStatements(directives)
+	if err != nil {
+		return nil, &configError{err: fmt.Errorf("%s: %w", name, err)}
 	}
 
-	ctx := context.Background()
+	var warnings []string
+	execCtx := clickhouse.Context(ctx,
+		clickhouse.WithSettings(migrationQuerySettings(opts, name, directiveSettings)),
+		clickhouse.WithLogs(func(l *clickhouse.Log) {
+			warnings = append(warnings, l.Text)
+		}),
+	)
 
-	for _, file := range files {
-		// skip directories
-		if file.IsDir() {
-			continue
+	// a baseline of migrate:squash is only recorded where the migrations it replaces already ran
+	if !opts.stateless {
+		recordOnly, err := baselineApplied(ctx, db, opts.table, name, directives)
+		if err != nil {
+			return nil, err
 		}
-
-		// skip non-sql files
-		if !strings.HasSuffix(file.Name(), ".sql") {
-			continue
+		if recordOnly {
+			fmt.Fprintln(opts.out, "Recorded baseline "+name+", the migrations it squashes already ran")
+			return nil, recordMigration(ctx, db, opts.table, name, content)
 		}
+	}
 
-		sqlExists := fmt.Sprintf("SELECT 1 FROM migrations WHERE name = '%s'", file.Name())
-
-		var exists uint8
-		if err := db.QueryRow(ctx, sqlExists).Scan(&exists); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				// unknown error
-				return err
+	if opts.backupBeforeDrop {
+		if tables := destructiveTables(string(sql)); len(tables) > 0 {
+			if err := backupTables(execCtx, opts.out, db, tables); err != nil {
+				return warnings, &migrationError{name: name, err: err, verbose: opts.verboseErrors}
 			}
 		}
+	}
 
-		// migration already ran, continue
-		if exists == 1 {
-			continue
+	switch {
+	case isScriptMigration(name):
+		err = runScriptMigration(opts, name)
+	case opts.profile != nil:
+		err = opts.profile.exec(execCtx, db, name, string(sql))
+	default:
+		err = execStatements(execCtx, db, string(sql))
+	}
+	// part of the migration, a failed OPTIMIZE leaves it unrecorded like a failed statement
+	for _, statement := range after {
+		if err != nil {
+			break
 		}
+		err = db.Exec(execCtx, statement)
+	}
 
-		content, err := os.ReadFile(migrationDir + file.Name())
-		if err != nil {
-			return err
+	if err != nil {
+		if opts.tailErrors > 0 {
+			tailServerLogs(opts.out, opts.container, opts.tailErrors)
 		}
+		return warnings, &migrationError{name: name, err: err, verbose: opts.verboseErrors}
+	}
+
+	if opts.stateless {
+		return warnings, nil
+	}
 
-		err = db.Exec(ctx, string(content))
+	return warnings, recordMigration(ctx, db, opts.table, name, content)
+}
 
-		if err != nil {
+// migrationQuerySettings are the settings the statements of one migration run with, built anew for each so a
+// directive of one file never carries over to the next
+func migrationQuerySettings(opts migrateOptions, name string, directiveSettings clickhouse.Settings) clickhouse.Settings {
+	// settings from the setup SQL apply to every migration, a migration's own directives take precedence
+	settings := clickhouse.Settings{}
+	for key, value := range opts.settings {
+		settings[key] = value
+	}
+	for key, value := range directiveSettings {
+		settings[key] = value
+	}
+
+	// have the server send back anything logged at warning level or above while the migration runs
+	settings["send_logs_level"] = "warning"
+
+	// finds the statements of a migration in system.query_log: WHERE log_comment LIKE '%run_id=<id>%'
+	if opts.runID != "" {
+		settings["log_comment"] = "logme-cli migration=" + name + " run_id=" + opts.runID
+	}
+
+	return settings
+}
+
+// recordMigration adds the bookkeeping row marking a migration as applied, with the directory it was read from
+func recordMigration(ctx context.Context, db driver.Conn, table string, name string, content []byte) error {
+	return db.AsyncInsert(
+		ctx,
+		fmt.Sprintf(
+			`INSERT INTO %s (name, dt, checksum, dir, applied_at) VALUES (%s, %d, %s, %s, %s)`,
+			table,
+			quoteString(name),
+			time.Now().Unix(),
+			quoteString(checksum(content)),
+			quoteString(recordedDir(name)),
+			// from the clock of the runner, the insert is asynchronous
+			quoteString(formatAppliedAt(time.Now())),
+		),
+		false,
+	)
+}
+
+// formatAppliedAt renders t as a DateTime64(6, 'UTC') literal of the applied_at column
+func formatAppliedAt(t time.Time) string {
+	return t.UTC().Format("2006-01-02 15:04:05.000000")
+}
+
+// recordedDir is the migrations directory of a migration as the migrations table records it, relative to the
+// project root so the rows do not depend on where the project is checked out
+func recordedDir(name string) string {
+	dir := filepath.Dir(migrationPath(name))
+	if rel, err := filepath.Rel(projectRoot, dir); err == nil {
+		dir = rel
+	}
+	return filepath.ToSlash(dir)
+}
+
+// recordSkip adds the bookkeeping row of a migration skipped with status, applying it later replaces the row
+func recordSkip(ctx context.Context, db driver.Conn, table string, name string, status string) error {
+	return db.Exec(ctx, fmt.Sprintf(
+		"INSERT INTO %s (name, dt, checksum, status, dir) VALUES (%s, %d, '', %s, %s)",
+		table, quoteString(name), time.Now().Unix(), quoteString(status), quoteString(recordedDir(name)),
+	))
+}
+
+func printWarnings(out io.Writer, warnings []string, quiet bool) {
+	if quiet {
+		return
+	}
+	for _, warning := range warnings {
+		fmt.Fprintln(out, "warning: "+warning)
+	}
+}
+
+func revertMigration(ctx context.Context, out io.Writer, db driver.Conn, table string, name string) error {
+	down := downMigrationName(name)
+
+	content, err := os.ReadFile(migrationPath(down))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if err == nil {
+		if err := execStatements(ctx, db, string(content)); err != nil {
+			return &migrationError{name: down, err: err}
+		}
+		// ClickHouse has no transactions, check the down migration really removed what it declares
+		if err := verifyReverted(ctx, db, down, directiveList(readDirectives(content), "assert-dropped")); err != nil {
 			return err
 		}
+		fmt.Fprintln(out, "Successfully reverted: "+name)
+	}
 
-		err = db.AsyncInsert(
-			ctx,
-			fmt.Sprintf(
-				`INSERT INTO migrations (name, dt) VALUES ('%s', %d)`,
-				file.Name(),
-				time.Now().Unix(),
-			),
-			false,
-		)
+	// wait for the mutation so the migration no longer shows as applied
+	ctx = clickhouse.Context(ctx, clickhouse.WithSettings(clickhouse.Settings{
+		"mutations_sync": 1,
+	}))
+
+	return db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DELETE WHERE name = %s", table, quoteString(name)))
+}
+
+// verifyReverted checks each "-- logme:assert-dropped" entry of a down migration, either TABLE or TABLE.COLUMN, is gone
+func verifyReverted(ctx context.Context, db driver.Conn, down string, dropped []string) error {
+	var remaining []string
 
+	for _, object := range dropped {
+		var (
+			count uint64
+			err   error
+		)
+		if table, column, isColumn := strings.Cut(object, "."); isColumn {
+			err = db.QueryRow(ctx, "SELECT count() FROM system.columns WHERE database = currentDatabase() AND table = $1 AND name = $2", table, column).Scan(&count)
+		} else {
+			err = db.QueryRow(ctx, "SELECT count() FROM system.tables WHERE database = currentDatabase() AND name = $1", table).Scan(&count)
+		}
 		if err != nil {
 			return err
 		}
+		if count > 0 {
+			remaining = append(remaining, object)
+		}
+	}
 
-		fmt.Println("Successfully migrated: " + file.Name())
+	if len(remaining) > 0 {
+		return &migrationError{name: down, err: fmt.Errorf("did not fully revert, still present: %s", strings.Join(remaining, ", "))}
 	}
 
 	return nil
 }
 
-func up() error {
-	out, err := exec.Command("/bin/sh", "-c", "docker-compose up", "-d").Output()
+func isDownMigration(name string) bool {
+	return strings.HasSuffix(name, ".down.sql")
+}
 
-	if (err != nil) {
-		return err
+func downMigrationName(name string) string {
+	return strings.TrimSuffix(name, ".sql") + ".down.sql"
+}
+
+func checksum(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+func up(out io.Writer, services []string, forceRecreate bool, build bool, onlyMissing bool, dryRun bool, waitTimeout time.Duration, retries int) error {
+	if retries < 0 {
+		return configErrorf("--retries cannot be negative")
 	}
 
-	fmt.Printf("%s\n", out)
+	if onlyMissing {
+		if forceRecreate {
+			return configErrorf("--only-missing cannot be combined with --force-recreate")
+		}
 
-	return nil
+		var err error
+		if services, err = missingServices(out, services); err != nil {
+			return err
+		}
+		if len(services) == 0 {
+			fmt.Fprintln(out, "All services already running")
+			return nil
+		}
+		if !dryRun {
+			fmt.Fprintln(out, "Starting: "+strings.Join(services, ", "))
+		}
+	}
+
+	args := []string{"up", "-d"}
+	if forceRecreate {
+		args = append(args, "--force-recreate")
+	}
+	if build {
+		args = append(args, "--build")
+	}
+	args = append(args, services...)
+
+	if dryRun {
+		printCommand(out, composeArgs(args...))
+		return nil
+	}
+
+	// stream compose's output (including errors such as unknown services) as it happens
+	if err := runComposeRetrying(out, retries, args...); err != nil || waitTimeout == 0 {
+		return err
+	}
+
+	return waitHealthy(out, services, waitTimeout)
 }
 
-func down() error {
-	out, err := exec.Command("/bin/sh", "-c", "docker-compose down").Output()
+func down(w io.Writer, dryRun bool) error {
+	if dryRun {
+		printCommand(w, composeArgs("down"))
+		return nil
+	}
+
+	cmd, err := composeCommand("down")
+	if err != nil {
+		return err
+	}
+
+	out, err := cmd.Output()
 
-	if (err != nil) {
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s\n", out)
+	fmt.Fprintf(w, "%s\n", out)
 
 	return nil
 }
 
-func list() error {
-	out, err := exec.Command("/bin/sh", "-c", "docker ps --format \"table {{.ID}}\t{{.Names}}\t{{.State}}\t{{.Ports}}\"").Output()
+func list(w io.Writer) error {
+	args := []string{"ps", "--format", "table {{.ID}}\t{{.Names}}\t{{.State}}\t{{.Ports}}"}
+	if project := os.Getenv("COMPOSE_PROJECT_NAME"); project != "" {
+		args = append(args, "--filter", "label=com.docker.compose.project="+project)
+	}
+
+	cmd, err := dockerCommand(args...)
+	if err != nil {
+		return err
+	}
+
+	out, err := cmd.Output()
 
-	if (err != nil) {
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("%s\n", out)
+	fmt.Fprintf(w, "%s\n", out)
 
 	return nil
 }
 
-func test() error {
-	out, _ := exec.Command("/bin/sh", "-c", "docker exec -i logme_server /usr/local/go/bin/go test").Output()
+func logs(out io.Writer, services []string, tail string) error {
+	args := []string{"logs", "-f"}
+	if tail != "" {
+		args = append(args, "--tail", tail)
+	}
+	args = append(args, services...)
+
+	cmd, err := composeCommand(args...)
+	if err != nil {
+		return err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
 
-	fmt.Printf("%s\n", out)
+	// handle Ctrl-C ourselves so we only exit once docker-compose has, instead of orphaning it
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
 
-	return nil
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-interrupt:
+		cmd.Process.Signal(os.Interrupt)
+		<-done
+		return nil
+	}
 }
 
+// test runs go test in the server container, passing parallel (-parallel) and packages (-p) when set and then the
+// extra arguments, packages or go test flags
+func test(w io.Writer, jsonOutput bool, summaryOnly bool, verbose bool, parallel int, packages int, extra []string) error {
+	if jsonOutput && summaryOnly {
+		return configErrorf("--json cannot be combined with --summary-only")
+	}
+	if parallel < 0 || packages < 0 {
+		return configErrorf("--parallel and -p expect a positive number")
+	}
+
+	args := []string{"exec", "-i", serverContainer, "/usr/local/go/bin/go", "test"}
+	if jsonOutput {
+		args = append(args, "-json")
+	}
+	if verbose {
+		args = append(args, "-v")
+	}
+	if parallel > 0 {
+		args = append(args, "-parallel", strconv.Itoa(parallel))
+	}
+	if packages > 0 {
+		args = append(args, "-p", strconv.Itoa(packages))
+	}
+	for _, arg := range extra {
+		// go test takes its flags after the packages too, the separator only stops our own flag parsing
+		if arg != "--" {
+			args = append(args, arg)
+		}
+	}
+
+	cmd, err := dockerCommand(args...)
+	if err != nil {
+		return err
+	}
+
+	// a failing test run exits non-zero, return it so the exit code reflects the failure
+	started := time.Now()
+	out, err := cmd.Output()
+
+	switch {
+	case jsonOutput:
+		w.Write(out)
+	case summaryOnly:
+		if verbose {
+			fmt.Fprintf(w, "%s\n", out)
+		}
+		printTestSummary(w, parseTestOutput(out), time.Since(started))
+	default:
+		fmt.Fprintf(w, "%s\n", out)
+	}
+
+	return err
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// setEnv sets the given variables and unsets the other connection variables for the duration of the test
+func setEnv(t *testing.T, values map[string]string) {
+	t.Helper()
+
+	for _, name := range []string{"DB_LOCAL_ADDR", "DB_ADDR", "DB_HOST", "DB_PORT"} {
+		value, set := values[name]
+		// t.Setenv restores the previous value once the test is done
+		t.Setenv(name, value)
+		if !set {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestGetDbAddrPrecedence(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		env    map[string]string
+		want   string
+		server string
+	}{
+		{"address first", map[string]string{"DB_LOCAL_ADDR": "127.0.0.1:19000", "DB_ADDR": "clickhouse:9000", "DB_HOST": "db"}, "clickhouse:9000", "clickhouse:9000"},
+		{"address before host", map[string]string{"DB_ADDR": "clickhouse:9000", "DB_HOST": "db", "DB_PORT": "9440"}, "clickhouse:9000", "clickhouse:9000"},
+		{"host before local address", map[string]string{"DB_LOCAL_ADDR": "127.0.0.1:19000", "DB_HOST": "db", "DB_PORT": "9440"}, "db:9440", "db:9440"},
+		{"host and port", map[string]string{"DB_HOST": "db", "DB_PORT": "9440"}, "db:9440", "db:9440"},
+		{"host with the default port", map[string]string{"DB_HOST": "db"}, "db:9000", "db:9000"},
+		{"IPv6 host", map[string]string{"DB_HOST": "::1"}, "[::1]:9000", "[::1]:9000"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			setEnv(t, tc.env)
+
+			if got, err := getDbAddr(); err != nil || got != tc.want {
+				t.Errorf("getDbAddr() = %q, %v, want %q", got, err, tc.want)
+			}
+			if got, err := getServerAddr(); err != nil || got != tc.server {
+				t.Errorf("getServerAddr() = %q, %v, want %q", got, err, tc.server)
+			}
+		})
+	}
+}
+
+func TestGetDbAddrRequiresAnAddress(t *testing.T) {
+	setEnv(t, map[string]string{"DB_PORT": "9000"})
+
+	if _, err := getDbAddr(); exitCode(err) != exitConfig {
+		t.Errorf("getDbAddr() = %v, want a configuration error", err)
+	}
+
+	setEnv(t, map[string]string{"DB_LOCAL_ADDR": "127.0.0.1:9000"})
+
+	if got, err := getDbAddr(); err != nil || got != "127.0.0.1:9000" {
+		t.Errorf("getDbAddr() = %q, %v, want the local address as the last resort", got, err)
+	}
+	if _, err := getServerAddr(); exitCode(err) != exitConfig {
+		t.Errorf("getServerAddr() = %v, want a configuration error without DB_ADDR or DB_HOST", err)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// metricsFormats are the payloads accepted by --metrics-format
+var metricsFormats = []string{"json", "pushgateway", "statsd"}
+
+const metricsTimeout = 5 * time.Second
+
+// runMetrics summarizes a migration run for --metrics-endpoint
+type runMetrics struct {
+	Database string  `json:"database"`
+	RunID    string  `json:"run_id,omitempty"`
+	Duration float64 `json:"duration_seconds"`
+	Applied  int     `json:"applied"`
+	Failed   int     `json:"failed"`
+	Skipped  int     `json:"skipped"`
+	Success  bool    `json:"success"`
+}
+
+func validateMetricsFormat(format string) error {
+	if !containsString(metricsFormats, format) {
+		return configErrorf("invalid --metrics-format '%s': expected one of %s", format, strings.Join(metricsFormats, ", "))
+	}
+	return nil
+}
+
+// pushMetrics sends the metrics of a run to endpoint, a URL accepting a POST for json and pushgateway (e.g.
+// http://pushgateway:9091/metrics/job/logme) or the host:port of a StatsD server. It only warns on failure, the
+// run itself is what matters
+func pushMetrics(out io.Writer, endpoint string, format string, metrics runMetrics) {
+	var err error
+	switch format {
+	case "statsd":
+		err = pushStatsd(endpoint, metrics)
+	case "pushgateway":
+		err = postMetrics(endpoint, "text/plain; version=0.0.4", []byte(pushgatewayMetrics(metrics)))
+	default:
+		var payload []byte
+		if payload, err = json.Marshal(metrics); err == nil {
+			err = postMetrics(endpoint, "application/json", payload)
+		}
+	}
+
+	if err != nil {
+		fmt.Fprintf(out, "warning: could not push metrics to %s: %s\n", endpoint, err)
+	}
+}
+
+func postMetrics(url string, contentType string, payload []byte) error {
+	client := http.Client{Timeout: metricsTimeout}
+
+	resp, err := client.Post(url, contentType, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+// pushgatewayMetrics renders the Prometheus text format, the job and other labels come from the pushgateway URL
+func pushgatewayMetrics(metrics runMetrics) string {
+	success := 0
+	if metrics.Success {
+		success = 1
+	}
+
+	var b strings.Builder
+	for _, metric := range []struct {
+		name  string
+		help  string
+		value interface{}
+	}{
+		{"logme_migration_duration_seconds", "Duration of the last migration run.", metrics.Duration},
+		{"logme_migrations_applied", "Migrations applied by the last run.", metrics.Applied},
+		{"logme_migrations_failed", "Migrations that failed in the last run.", metrics.Failed},
+		{"logme_migrations_skipped", "Migrations skipped by the last run.", metrics.Skipped},
+		{"logme_migration_success", "Whether the last migration run succeeded.", success},
+	} {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", metric.name, metric.help, metric.name, metric.name, metric.value)
+	}
+
+	return b.String()
+}
+
+func pushStatsd(addr string, metrics runMetrics) error {
+	conn, err := net.DialTimeout("udp", strings.TrimPrefix(addr, "udp://"), metricsTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	payload := fmt.Sprintf(
+		"logme.migrations.duration:%d|ms\nlogme.migrations.applied:%d|c\nlogme.migrations.failed:%d|c\nlogme.migrations.skipped:%d|c\n",
+		time.Duration(metrics.Duration*float64(time.Second)).Milliseconds(), metrics.Applied, metrics.Failed, metrics.Skipped,
+	)
+
+	_, err = conn.Write([]byte(payload))
+	return err
+}
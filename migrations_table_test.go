@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// schemaConn is a driver.Conn answering the system.columns and system.tables lookups of upgradeMigrationsTable
+// from its fields and recording every statement executed
+type schemaConn struct {
+	driver.Conn
+	columns []string
+	engine  string
+	execs   []string
+}
+
+func (c *schemaConn) Query(ctx context.Context, sql string, args ...interface{}) (driver.Rows, error) {
+	return &stringRows{values: c.columns}, nil
+}
+
+func (c *schemaConn) QueryRow(ctx context.Context, sql string, args ...interface{}) driver.Row {
+	return stringRow(c.engine)
+}
+
+func (c *schemaConn) Exec(ctx context.Context, sql string, args ...interface{}) error {
+	c.execs = append(c.execs, sql)
+	return nil
+}
+
+// stringRows returns one single String column row per value
+type stringRows struct {
+	driver.Rows
+	values []string
+	next   int
+}
+
+func (r *stringRows) Next() bool {
+	r.next++
+	return r.next <= len(r.values)
+}
+
+func (r *stringRows) Scan(dest ...interface{}) error {
+	*dest[0].(*string) = r.values[r.next-1]
+	return nil
+}
+
+func (r *stringRows) Err() error   { return nil }
+func (r *stringRows) Close() error { return nil }
+
+type stringRow string
+
+func (r stringRow) Err() error { return nil }
+func (r stringRow) Scan(dest ...interface{}) error {
+	*dest[0].(*string) = string(r)
+	return nil
+}
+func (r stringRow) ScanStruct(dest interface{}) error { return nil }
+
+func TestUpgradeMigrationsTableAddsMissingColumns(t *testing.T) {
+	// created before checksums were recorded
+	db := &schemaConn{columns: []string{"name", "dt"}, engine: "ReplacingMergeTree"}
+
+	if err := upgradeMigrationsTable(db, "migrations"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"ALTER TABLE migrations ADD COLUMN IF NOT EXISTS checksum String",
+		"ALTER TABLE migrations ADD COLUMN IF NOT EXISTS status String",
+		"ALTER TABLE migrations ADD COLUMN IF NOT EXISTS dir String",
+		"ALTER TABLE migrations ADD COLUMN IF NOT EXISTS applied_at DateTime64(6, 'UTC')",
+	}
+	if !reflect.DeepEqual(db.execs, want) {
+		t.Errorf("executed %q, want %q", db.execs, want)
+	}
+}
+
+func TestUpgradeMigrationsTableLeavesACurrentTable(t *testing.T) {
+	db := &schemaConn{columns: []string{"name", "dt", "checksum", "status", "dir", "applied_at"}, engine: "ReplacingMergeTree"}
+
+	if err := upgradeMigrationsTable(db, "migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.execs) != 0 {
+		t.Errorf("executed %q on an up to date table", db.execs)
+	}
+}
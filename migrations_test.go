@@ -0,0 +1,77 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMigrationFilesMergesDirectoriesByPrefix(t *testing.T) {
+	useMigrationDirs(t,
+		map[string]string{
+			"001_core.sql":      "SELECT 1;\n",
+			"001_core.down.sql": "SELECT -1;\n",
+			"010_core.sql":      "SELECT 10;\n",
+			"notes.txt":         "not a migration",
+		},
+		map[string]string{
+			"2_app.sql":   "SELECT 2;\n",
+			"0005_app.sh": "#!/bin/sh\n",
+		},
+	)
+
+	names, err := migrationFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// ordered by numeric prefix across directories whatever the padding, down migrations and other files left out
+	want := []string{"001_core.sql", "2_app.sql", "0005_app.sh", "010_core.sql"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("migrationFiles() = %v, want %v", names, want)
+	}
+}
+
+func TestMigrationFilesPrefixCollision(t *testing.T) {
+	dirs := useMigrationDirs(t,
+		map[string]string{"002_core.sql": "SELECT 1;\n"},
+		map[string]string{"2_app.sql": "SELECT 2;\n"},
+	)
+
+	_, err := migrationFiles()
+	if exitCode(err) != exitConfig {
+		t.Fatalf("migrationFiles() = %v, want a configuration error", err)
+	}
+	if !strings.Contains(err.Error(), dirs[1]+"2_app.sql") || !strings.Contains(err.Error(), dirs[0]) {
+		t.Errorf("error %q does not name both directories", err)
+	}
+}
+
+func TestMigrationFilesSameNameCollision(t *testing.T) {
+	useMigrationDirs(t,
+		map[string]string{"setup.sql": "SELECT 1;\n"},
+		map[string]string{"setup.sql": "SELECT 2;\n"},
+	)
+
+	if _, err := migrationFiles(); exitCode(err) != exitConfig {
+		t.Errorf("migrationFiles() = %v, want a configuration error for the same file name in two directories", err)
+	}
+}
+
+func TestRecordedDirIsRelativeToTheProject(t *testing.T) {
+	dirs := useMigrationDirs(t,
+		map[string]string{"001_core.sql": "SELECT 1;\n"},
+		map[string]string{"002_app.sql": "SELECT 2;\n"},
+	)
+
+	previous := projectRoot
+	t.Cleanup(func() { projectRoot = previous })
+	projectRoot = filepath.Dir(filepath.Clean(dirs[0]))
+
+	for name, want := range map[string]string{"001_core.sql": "a", "002_app.sql": "b"} {
+		if got := recordedDir(name); got != want {
+			t.Errorf("recordedDir(%s) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+func optimize(out io.Writer, isTest bool, tables []string, all bool, final bool) error {
+	if len(tables) == 0 && !all {
+		return configErrorf("optimize requires at least one TABLE or --all")
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if all {
+		// only the MergeTree family has parts to merge
+		rows, err := db.Query(ctx, "SELECT name FROM system.tables WHERE database = currentDatabase() AND engine LIKE '%MergeTree' ORDER BY name")
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+
+		tables = nil
+		for rows.Next() {
+			var name string
+			if err := rows.Scan(&name); err != nil {
+				return err
+			}
+			tables = append(tables, name)
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, table := range tables {
+		sql := "OPTIMIZE TABLE " + quoteIdentifier(table)
+		if final {
+			sql += " FINAL"
+		}
+
+		start := time.Now()
+		if err := db.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("optimizing %s: %w", table, err)
+		}
+
+		fmt.Fprintf(out, "Optimized: %s (%s)\n", table, time.Since(start).Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "\\`") + "`"
+}
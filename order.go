@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+)
+
+// orderFile lists the migrations of a migrations directory one per line, in the order to apply them, for teams
+// preferring explicit order over the numeric prefixes
+const orderFile = "order.txt"
+
+// orderMigrations sorts migrations so that every file comes after the ones it declares with
+// "-- logme:requires", otherwise keeping the given order
+func orderMigrations(names []string) ([]string, error) {
+	requires := map[string][]string{}
+	for _, name := range names {
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return nil, err
+		}
+		requires[name] = directiveList(readDirectives(content), "requires")
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+
+	var (
+		ordered []string
+		state   = map[string]int{}
+		path    []string
+		visit   func(name string) error
+	)
+
+	visit = func(name string) error {
+		switch state[name] {
+		case visited:
+			return nil
+		case visiting:
+			// report the cycle starting from the first time we entered this migration
+			for i, step := range path {
+				if step == name {
+					return configErrorf("migration dependency cycle: %s", strings.Join(append(path[i:], name), " -> "))
+				}
+			}
+		}
+
+		state[name] = visiting
+		path = append(path, name)
+
+		for _, dependency := range requires[name] {
+			if _, ok := requires[dependency]; !ok {
+				return configErrorf("migration %s requires %s which does not exist", name, dependency)
+			}
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+		ordered = append(ordered, name)
+
+		return nil
+	}
+
+	for _, name := range names {
+		if err := visit(name); err != nil {
+			return nil, err
+		}
+	}
+
+	return ordered, nil
+}
+
+// readOrderFile returns the migrations in the order of the order.txt of the migrations directory, nil without one.
+// Blank lines and lines starting with # are ignored, the file must list every migration exactly once
+func readOrderFile(names []string) ([]string, error) {
+	path := ""
+	for _, dir := range migrationDirs {
+		if _, err := os.Stat(dir + orderFile); err == nil {
+			path = dir + orderFile
+		}
+	}
+	if path == "" {
+		return nil, nil
+	}
+	if len(migrationDirs) > 1 {
+		return nil, configErrorf("%s is only supported with a single migrations directory", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	exists := map[string]bool{}
+	for _, name := range names {
+		exists[name] = true
+	}
+
+	var listed []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		switch {
+		case seen[line]:
+			return nil, configErrorf("%s lists %s twice", path, line)
+		case !exists[line]:
+			return nil, configErrorf("%s lists %s, which is not a migration in %s", path, line, migrationDirs[0])
+		}
+		seen[line] = true
+		listed = append(listed, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	for _, name := range names {
+		if !seen[name] {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, configErrorf("%s does not list: %s", path, strings.Join(missing, ", "))
+	}
+
+	return listed, nil
+}
+
+// appendOrderFile adds a new migration at the end of order.txt, when the migrations directory has one
+func appendOrderFile(name string) error {
+	path := migrationDirs[0] + orderFile
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(content) > 0 && !bytes.HasSuffix(content, []byte("\n")) {
+		content = append(content, '\n')
+	}
+
+	return os.WriteFile(path, append(content, name+"\n"...), 0644)
+}
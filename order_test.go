@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// useMigrationDirs points migrationDirs at new directories holding the given files, one map per directory, for the
+// duration of the test
+func useMigrationDirs(t *testing.T, dirs ...map[string]string) []string {
+	t.Helper()
+
+	previous := migrationDirs
+	t.Cleanup(func() { migrationDirs = previous })
+
+	migrationDirs = nil
+	root := t.TempDir()
+	for i, files := range dirs {
+		dir := filepath.Join(root, string(rune('a'+i))) + "/"
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		for name, content := range files {
+			if err := os.WriteFile(dir+name, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		migrationDirs = append(migrationDirs, dir)
+	}
+
+	return migrationDirs
+}
+
+func TestOrderMigrationsDiamond(t *testing.T) {
+	// d requires b and c, which both require a, all listed in the reverse of that order
+	useMigrationDirs(t, map[string]string{
+		"d.sql": "-- logme:requires b.sql, c.sql\nSELECT 4;\n",
+		"c.sql": "-- logme:requires a.sql\nSELECT 3;\n",
+		"b.sql": "-- logme:requires a.sql\nSELECT 2;\n",
+		"a.sql": "SELECT 1;\n",
+	})
+
+	ordered, err := orderMigrations([]string{"d.sql", "c.sql", "b.sql", "a.sql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a once, before b and c, which keep their relative order, then d
+	want := []string{"a.sql", "b.sql", "c.sql", "d.sql"}
+	if !reflect.DeepEqual(ordered, want) {
+		t.Errorf("orderMigrations() = %v, want %v", ordered, want)
+	}
+}
+
+func TestOrderMigrationsKeepsTheGivenOrderWithoutDependencies(t *testing.T) {
+	useMigrationDirs(t, map[string]string{
+		"001_a.sql": "SELECT 1;\n",
+		"002_b.sql": "SELECT 2;\n",
+	})
+
+	ordered, err := orderMigrations([]string{"002_b.sql", "001_a.sql"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"002_b.sql", "001_a.sql"}; !reflect.DeepEqual(ordered, want) {
+		t.Errorf("orderMigrations() = %v, want %v", ordered, want)
+	}
+}
+
+func TestOrderMigrationsCycle(t *testing.T) {
+	useMigrationDirs(t, map[string]string{
+		"a.sql": "-- logme:requires c.sql\nSELECT 1;\n",
+		"b.sql": "-- logme:requires a.sql\nSELECT 2;\n",
+		"c.sql": "-- logme:requires b.sql\nSELECT 3;\n",
+	})
+
+	_, err := orderMigrations([]string{"a.sql", "b.sql", "c.sql"})
+	if err == nil {
+		t.Fatal("orderMigrations() = nil, want a cycle error")
+	}
+	if !errors.As(err, new(*configError)) {
+		t.Errorf("error %v is not a configError", err)
+	}
+	if want := "a.sql -> c.sql -> b.sql -> a.sql"; !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not show the cycle %s", err, want)
+	}
+}
+
+func TestOrderMigrationsUnknownRequirement(t *testing.T) {
+	useMigrationDirs(t, map[string]string{
+		"a.sql": "-- logme:requires missing.sql\nSELECT 1;\n",
+	})
+
+	if _, err := orderMigrations([]string{"a.sql"}); err == nil || !strings.Contains(err.Error(), "missing.sql") {
+		t.Errorf("orderMigrations() = %v, want an error naming missing.sql", err)
+	}
+}
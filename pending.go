@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// migratePending lists the migrations that have not been applied and fails with exitPending when there are any, so
+// a deploy can be blocked on forgotten migrations
+func migratePending(out io.Writer, isTest bool, table string, quiet bool) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	db, err := getReadonlyDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var exists uint8
+	if err := db.QueryRow(ctx, "EXISTS TABLE "+table).Scan(&exists); err != nil {
+		return err
+	}
+
+	var pending []string
+	if exists == 1 {
+		pending, err = pendingMigrations(ctx, db, table)
+	} else {
+		// nothing has ever been migrated
+		pending, err = migrationFiles()
+	}
+	if err != nil {
+		return err
+	}
+
+	// migrations for other environments never run here, they would block every deploy
+	applicable := pending[:0]
+	for _, name := range pending {
+		_, reason, err := migrationSkip(name, "")
+		if err != nil {
+			return err
+		}
+		if reason == "" {
+			applicable = append(applicable, name)
+		}
+	}
+	pending = applicable
+
+	if len(pending) == 0 {
+		if !quiet {
+			fmt.Fprintln(out, "No pending migrations")
+		}
+		return nil
+	}
+
+	if !quiet {
+		for _, name := range pending {
+			fmt.Fprintln(out, "Pending: "+name)
+		}
+	}
+
+	return &pendingError{count: len(pending), quiet: quiet}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ping runs SELECT 1 count times, interval apart, printing the round trip of each and, for several, the min, avg
+// and max like the ping utility. A failed round trip is reported and counted, the command fails if any did
+func ping(out io.Writer, isTest bool, count int, interval time.Duration) error {
+	if count <= 0 {
+		return configErrorf("--count must be positive")
+	}
+
+	addr, err := getDbAddr()
+	if err != nil {
+		return err
+	}
+
+	// a health check only reads, it never needs the full-access credentials
+	db, err := getReadonlyDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	var (
+		failed int
+		total  time.Duration
+		min    time.Duration
+		max    time.Duration
+	)
+
+	for i := 1; i <= count; i++ {
+		if i > 1 {
+			time.Sleep(interval)
+		}
+
+		var one uint8
+		started := time.Now()
+		err := db.QueryRow(context.Background(), "SELECT 1").Scan(&one)
+		elapsed := time.Since(started)
+		if err != nil {
+			failed++
+			fmt.Fprintf(out, "ping %d to %s failed: %s\n", i, addr, err)
+			continue
+		}
+
+		fmt.Fprintf(out, "ping %d to %s: time=%s\n", i, addr, elapsed.Round(time.Microsecond))
+		total += elapsed
+		if min == 0 || elapsed < min {
+			min = elapsed
+		}
+		if elapsed > max {
+			max = elapsed
+		}
+	}
+
+	if count > 1 {
+		fmt.Fprintf(out, "%d sent, %d failed", count, failed)
+		if succeeded := count - failed; succeeded > 0 {
+			avg := total / time.Duration(succeeded)
+			fmt.Fprintf(out, ", min/avg/max = %s/%s/%s", min.Round(time.Microsecond), avg.Round(time.Microsecond), max.Round(time.Microsecond))
+		}
+		fmt.Fprintln(out)
+	}
+
+	if failed > 0 {
+		return &connectionError{err: fmt.Errorf("%d of %d ping(s) failed", failed, count)}
+	}
+
+	return nil
+}
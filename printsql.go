@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// printMigrationSQL writes the SQL of every migration file in execution order as one reviewable script, to output
+// when set, without connecting to the database. The bookkeeping inserts migrate would make are included as comments
+func printMigrationSQL(out io.Writer, table string, output string) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	if output == "" {
+		return writeMigrationSQL(out, table)
+	}
+
+	file, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	if err := writeMigrationSQL(file, table); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+func writeMigrationSQL(out io.Writer, table string) error {
+	names, err := migrationFiles()
+	if err != nil {
+		return err
+	}
+
+	// without a connection the applied migrations are unknown, so every file is listed
+	fmt.Fprintf(out, "-- %d migration(s) from %s, already applied ones are not excluded\n", len(names), strings.Join(migrationDirs, ", "))
+
+	for _, name := range names {
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintln(out)
+		fmt.Fprintln(out, "-- file: "+name)
+		if isScriptMigration(name) {
+			fmt.Fprintln(out, "-- script migration, run as a program rather than SQL")
+		} else {
+			sql, err := renderMigration(name, content)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			after, err := afterStatements(readDirectives(sql))
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			script := strings.TrimSpace(string(sql))
+			// the "-- logme:after" statements run once the file's own statements succeeded
+			if len(after) > 0 && !strings.HasSuffix(script, ";") {
+				script += ";"
+			}
+			fmt.Fprintln(out, script)
+			for _, statement := range after {
+				fmt.Fprintln(out, statement+";")
+			}
+		}
+		fmt.Fprintf(out, "-- INSERT INTO %s (name, dt, checksum, dir, applied_at) VALUES (%s, toUnixTimestamp(now()), %s, %s, now64(6));\n", table, quoteString(name), quoteString(checksum(content)), quoteString(recordedDir(name)))
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// sqlProfile collects the migration statements slower than a threshold (--profile-sql)
+type sqlProfile struct {
+	threshold time.Duration
+	slow      []slowStatement
+}
+
+type slowStatement struct {
+	migration string
+	sql       string
+	elapsed   time.Duration
+}
+
+// exec runs the statements of a migration like execStatements, timing each of them
+func (p *sqlProfile) exec(ctx context.Context, db driver.Conn, migration string, sql string) error {
+	for _, statement := range migrationStatements(sql) {
+		start := time.Now()
+		err := db.Exec(ctx, statement)
+		if elapsed := time.Since(start); elapsed >= p.threshold {
+			p.slow = append(p.slow, slowStatement{migration: migration, sql: statement, elapsed: elapsed})
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// print reports the slow statements, slowest first, and starts a new profile (--watch runs several times)
+func (p *sqlProfile) print(out io.Writer) {
+	slow := p.slow
+	p.slow = nil
+
+	if len(slow) == 0 {
+		fmt.Fprintf(out, "No statements slower than %s\n", p.threshold)
+		return
+	}
+
+	sort.SliceStable(slow, func(i, j int) bool { return slow[i].elapsed > slow[j].elapsed })
+
+	fmt.Fprintf(out, "Slow statements (>= %s):\n", p.threshold)
+	for _, s := range slow {
+		fmt.Fprintf(out, "  %10s  %s  %s\n", s.elapsed.Round(time.Millisecond), s.migration, sqlPreview(s.sql, 80))
+	}
+}
+
+// sqlPreview collapses a statement to one line, cut to at most width characters
+func sqlPreview(sql string, width int) string {
+	preview := strings.Join(strings.Fields(stripLeadingComments(sql)), " ")
+	if len(preview) > width {
+		preview = preview[:width-3] + "..."
+	}
+	return preview
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// startProgress redraws "Migrating [N/M]: <file> (elapsed)" on the current line until the returned stop is called,
+// which clears the line again
+func startProgress(out io.Writer, index int, total int, name string) func() {
+	start := time.Now()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+
+	draw := func() {
+		fmt.Fprintf(out, "\r\033[KMigrating [%d/%d]: %s (%s)", index, total, name, time.Since(start).Round(100*time.Millisecond))
+	}
+
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(200 * time.Millisecond)
+		defer ticker.Stop()
+
+		draw()
+		for {
+			select {
+			case <-done:
+				fmt.Fprint(out, "\r\033[K")
+				return
+			case <-ticker.C:
+				draw()
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+// isTerminal reports whether w is a terminal, writers that are not files (e.g. a buffer in a test) never are
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
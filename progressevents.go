@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+const progressSocketTimeout = 5 * time.Second
+
+// progressEvent is one line of --progress-socket, the fields not relevant to an event are left out
+type progressEvent struct {
+	Event     string   `json:"event"`
+	Time      string   `json:"time"`
+	RunID     string   `json:"run_id,omitempty"`
+	Database  string   `json:"database,omitempty"`
+	Migration string   `json:"migration,omitempty"`
+	Index     int      `json:"index,omitempty"`
+	Total     int      `json:"total,omitempty"`
+	Pending   []string `json:"pending,omitempty"`
+	Duration  *float64 `json:"duration_seconds,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	Applied   *int     `json:"applied,omitempty"`
+	Failed    *int     `json:"failed,omitempty"`
+	Skipped   *int     `json:"skipped,omitempty"`
+	Success   *bool    `json:"success,omitempty"`
+}
+
+// progressEvents writes the events of a run as newline-delimited JSON to the Unix socket a parent process listens
+// on, a nil one discards them
+type progressEvents struct {
+	conn net.Conn
+	enc  *json.Encoder
+	out  io.Writer
+}
+
+func dialProgressSocket(out io.Writer, path string) (*progressEvents, error) {
+	conn, err := net.DialTimeout("unix", path, progressSocketTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("--progress-socket: %w", err)
+	}
+
+	return &progressEvents{conn: conn, enc: json.NewEncoder(conn), out: out}, nil
+}
+
+// emit sends an event, on failure it warns once and drops the following events, the run itself is what matters
+func (p *progressEvents) emit(event progressEvent) {
+	if p == nil || p.enc == nil {
+		return
+	}
+
+	event.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	p.conn.SetWriteDeadline(time.Now().Add(progressSocketTimeout))
+	if err := p.enc.Encode(event); err != nil {
+		fmt.Fprintf(p.out, "warning: could not send progress events to %s: %s\n", p.conn.RemoteAddr(), err)
+		p.enc = nil
+	}
+}
+
+func (p *progressEvents) close() {
+	if p != nil {
+		p.conn.Close()
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// explainKinds are the EXPLAIN variants accepted by --explain-kind
+var explainKinds = []string{"AST", "SYNTAX", "PLAN", "PIPELINE", "ESTIMATE"}
+
+// query prints the result of sql as CSV, or with explain set (e.g. PLAN) the execution plan of each of its
+// statements without running them
+func query(w io.Writer, isTest bool, sql string, file string, tsv bool, limit int, readonly bool, explain string) error {
+	if file != "" {
+		content, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		sql = string(content)
+	}
+	if strings.TrimSpace(sql) == "" {
+		return configErrorf("query requires a SQL statement or --file")
+	}
+	if explain != "" {
+		explain = strings.ToUpper(explain)
+		if !containsString(explainKinds, explain) {
+			return configErrorf("invalid --explain-kind '%s': expected one of %s", explain, strings.Join(explainKinds, ", "))
+		}
+	}
+
+	connect := getDbConn
+	if readonly {
+		connect = getReadonlyDbConn
+	}
+
+	db, err := connect(isTest)
+	if err != nil {
+		return err
+	}
+
+	if explain != "" {
+		return explainStatements(w, db, sql, explain)
+	}
+
+	rows, err := queryRetrying(context.Background(), db, sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	out := csv.NewWriter(w)
+	if tsv {
+		out.Comma = '\t'
+	}
+
+	if err := out.Write(rows.Columns()); err != nil {
+		return err
+	}
+
+	for count := 0; rows.Next() && (limit <= 0 || count < limit); count++ {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return err
+		}
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
+
+// queryRetrying runs sql once more when the connection turns out to have been closed under us, typically by the
+// server after the REPL sat idle. The driver discards the broken connection, so the retry dials a new one
+func queryRetrying(ctx context.Context, db driver.Conn, sql string) (driver.Rows, error) {
+	rows, err := db.Query(ctx, sql)
+	if isBrokenConnection(err) {
+		rows, err = db.Query(ctx, sql)
+	}
+	return rows, err
+}
+
+// explainStatements prints the plan ClickHouse would use for each statement, preceded by a preview of the statement
+// when there are several
+func explainStatements(w io.Writer, db driver.Conn, sql string, kind string) error {
+	statements := splitStatements(sql)
+
+	for i, statement := range statements {
+		if len(statements) > 1 {
+			if i > 0 {
+				fmt.Fprintln(w)
+			}
+			fmt.Fprintln(w, "-- "+sqlPreview(statement, 100))
+		}
+
+		rows, err := db.Query(context.Background(), "EXPLAIN "+kind+" "+statement)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var line string
+			if err := rows.Scan(&line); err != nil {
+				rows.Close()
+				return err
+			}
+			fmt.Fprintln(w, line)
+		}
+		err = rows.Err()
+		rows.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// scanRecord reads the current row whatever its columns, formatted as text by formatValue
+func scanRecord(rows driver.Rows) ([]string, error) {
+	columnTypes := rows.ColumnTypes()
+
+	values := make([]interface{}, len(columnTypes))
+	for i, columnType := range columnTypes {
+		values[i] = reflect.New(columnType.ScanType()).Interface()
+	}
+	if err := rows.Scan(values...); err != nil {
+		return nil, err
+	}
+
+	record := make([]string, len(values))
+	for i, value := range values {
+		record[i] = formatValue(reflect.ValueOf(value).Elem(), columnTypes[i].DatabaseTypeName())
+	}
+
+	return record, nil
+}
+
+// formatValue renders a scanned ClickHouse value as text, NULL becomes an empty string and arrays are bracketed
+func formatValue(value reflect.Value, chType string) string {
+	switch value.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if value.IsNil() {
+			return ""
+		}
+		return formatValue(value.Elem(), chType)
+	case reflect.Slice, reflect.Array:
+		if value.Type().Elem().Kind() == reflect.Uint8 && value.Kind() == reflect.Slice {
+			return string(value.Bytes())
+		}
+		items := make([]string, value.Len())
+		for i := range items {
+			items[i] = formatValue(value.Index(i), chType)
+		}
+		return "[" + strings.Join(items, ",") + "]"
+	case reflect.Map:
+		items := make([]string, 0, value.Len())
+		iter := value.MapRange()
+		for iter.Next() {
+			items = append(items, formatValue(iter.Key(), chType)+":"+formatValue(iter.Value(), chType))
+		}
+		return "{" + strings.Join(items, ",") + "}"
+	}
+
+	if t, ok := value.Interface().(time.Time); ok {
+		// Date and Date32 carry no time of day, also inside Nullable(...) and Array(...)
+		if strings.Contains(chType, "Date") && !strings.Contains(chType, "DateTime") {
+			return t.Format("2006-01-02")
+		}
+		return t.Format("2006-01-02 15:04:05")
+	}
+
+	return fmt.Sprint(value.Interface())
+}
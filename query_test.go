@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// dropConnections listens on a local port closing every connection as soon as it is accepted, like a server that
+// went away, it returns the address and the number of connections accepted so far
+func dropConnections(t *testing.T) (string, func() int) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		accepted int
+		done     = make(chan struct{})
+	)
+	go func() {
+		defer close(done)
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			accepted++
+			mu.Unlock()
+			conn.Close()
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+
+	return listener.Addr().String(), func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return accepted
+	}
+}
+
+func TestPrintQueryRetriesOverADroppedConnection(t *testing.T) {
+	addr, accepted := dropConnections(t)
+
+	db, err := clickhouse.Open(&clickhouse.Options{Addr: []string{addr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var out bytes.Buffer
+	if err := printQuery(&out, db, "SYSTEM FLUSH LOGS"); !isBrokenConnection(err) {
+		t.Fatalf("printQuery() = %v, want the broken connection of the retry", err)
+	}
+	if got := accepted(); got != 2 {
+		t.Errorf("%d connections, want the one of the query and a new one for its retry", got)
+	}
+}
+
+func TestGetDbConnRetriesADroppedConnection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits through every backoff")
+	}
+
+	addr, accepted := dropConnections(t)
+	t.Setenv("DB_ADDR", addr)
+	t.Setenv("DB_NAME", "logme")
+
+	var connErr *connectionError
+	if _, err := getDbConn(false); !errors.As(err, &connErr) {
+		t.Fatalf("getDbConn() = %v, want a connection error", err)
+	}
+	if got := accepted(); got != retryAttempts {
+		t.Errorf("%d connections, want one per attempt (%d)", got, retryAttempts)
+	}
+}
+
+// failingConn fails every query with err
+type failingConn struct {
+	driver.Conn
+	err     error
+	queries int
+}
+
+func (c *failingConn) Query(ctx context.Context, sql string, args ...interface{}) (driver.Rows, error) {
+	c.queries++
+	return nil, c.err
+}
+
+func TestQueryRetryingOnlyRetriesBrokenConnections(t *testing.T) {
+	for _, tc := range []struct {
+		err     error
+		queries int
+	}{
+		{net.ErrClosed, 2},
+		{errors.New("code: 62, message: Syntax error"), 1},
+	} {
+		db := &failingConn{err: tc.err}
+		if _, err := queryRetrying(context.Background(), db, "SELECT 1"); !errors.Is(err, tc.err) {
+			t.Errorf("queryRetrying() = %v, want %v", err, tc.err)
+		}
+		if db.queries != tc.queries {
+			t.Errorf("%v: %d queries, want %d", tc.err, db.queries, tc.queries)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+)
+
+// checkStrictOrdering requires every migration to start with a zero padded number of the same width, so the order
+// of the files is the same however they are sorted (1_a, 10_b and 2_c are not)
+func checkStrictOrdering(names []string) error {
+	var first string
+	for _, name := range names {
+		match := migrationPrefixRegexp.FindStringSubmatch(name)
+		if match == nil {
+			return configErrorf("migration %s has no numeric prefix, --strict-ordering expects names such as 001_%s", name, name)
+		}
+		if first == "" {
+			first = match[1]
+			continue
+		}
+		if len(match[1]) != len(first) {
+			return configErrorf("migration %s has a %d digit prefix but the first migration uses %d, run migrate:rename to zero pad every prefix to the same width", name, len(match[1]), len(first))
+		}
+	}
+
+	return nil
+}
+
+// paddedMigrationName zero pads the numeric prefix of a (down) migration to width digits, names without a prefix or
+// already that wide are returned as is
+func paddedMigrationName(name string, width int) string {
+	match := migrationPrefixRegexp.FindStringSubmatch(name)
+	if match == nil || len(match[1]) >= width {
+		return name
+	}
+
+	return strings.Repeat("0", width-len(match[1])) + name
+}
+
+// migrateRename zero pads the prefixes of the migration files to a common width and renames the bookkeeping rows
+// of the database to match. The "-- logme:requires" headers and the order.txt naming a renamed migration are
+// rewritten too, and the recorded checksum of an applied migration whose header changed follows its file. Rows are
+// renamed from the table itself, so running it again for another database (e.g. --test) after the files were
+// renamed still updates that database
+func migrateRename(out io.Writer, isTest bool, table string, width int, dryRun bool, lockTTL time.Duration) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	type rename struct{ from, to string }
+	var renames []rename
+
+	widest := 3
+	for _, dir := range migrationDirs {
+		entries, err := readMigrationDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if match := migrationPrefixRegexp.FindStringSubmatch(entry.Name()); match != nil && len(match[1]) > widest {
+				widest = len(match[1])
+			}
+		}
+	}
+	if width == 0 {
+		width = widest
+	}
+	if width < widest {
+		return configErrorf("--width %d is narrower than the existing %d digit prefixes", width, widest)
+	}
+
+	// new name of each renamed file, by file name as the requires headers and order.txt refer to them
+	renamed := map[string]string{}
+	for _, dir := range migrationDirs {
+		entries, err := readMigrationDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isMigrationFile(entry.Name()) {
+				continue
+			}
+			to := paddedMigrationName(entry.Name(), width)
+			if to == entry.Name() {
+				continue
+			}
+			if _, err := os.Stat(dir + to); err == nil {
+				return fmt.Errorf("cannot rename %s%s: %s%s already exists", dir, entry.Name(), dir, to)
+			}
+			renames = append(renames, rename{from: dir + entry.Name(), to: dir + to})
+			renamed[entry.Name()] = to
+		}
+	}
+
+	// rewritten contents by the name the file has once renamed (names are unique across the migrations
+	// directories), with its path and the checksums before and after
+	type rewrite struct {
+		path           string
+		content        []byte
+		oldSum, newSum string
+	}
+	rewrites := map[string]rewrite{}
+	var rewritten []string
+	for _, dir := range migrationDirs {
+		entries, err := readMigrationDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || !isMigrationFile(entry.Name()) {
+				continue
+			}
+			content, err := os.ReadFile(dir + entry.Name())
+			if err != nil {
+				return err
+			}
+			updated := rewriteRequires(content, renamed)
+			if bytes.Equal(updated, content) {
+				continue
+			}
+			name := paddedMigrationName(entry.Name(), width)
+			rewrites[name] = rewrite{path: dir + name, content: updated, oldSum: checksum(content), newSum: checksum(updated)}
+			rewritten = append(rewritten, name)
+		}
+	}
+	sort.Strings(rewritten)
+
+	var orderFiles []string
+	orderContents := map[string][]byte{}
+	for _, dir := range migrationDirs {
+		content, err := os.ReadFile(dir + orderFile)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if updated := rewriteOrderFile(content, renamed); !bytes.Equal(updated, content) {
+			orderFiles = append(orderFiles, dir+orderFile)
+			orderContents[dir+orderFile] = updated
+		}
+	}
+
+	if dryRun {
+		for _, r := range renames {
+			fmt.Fprintln(out, "Would rename: "+r.from+" -> "+r.to)
+		}
+		for _, name := range rewritten {
+			fmt.Fprintln(out, "Would update logme:requires: "+rewrites[name].path)
+		}
+		for _, path := range orderFiles {
+			fmt.Fprintln(out, "Would update: "+path)
+		}
+		fmt.Fprintln(out, "Bookkeeping rows of "+table+" using the old names would be renamed too")
+		return nil
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	// wait for each mutation so the old rows are gone, and the checksums updated, once the command returns
+	ctx := clickhouse.Context(context.Background(), clickhouse.WithSettings(clickhouse.Settings{
+		"mutations_sync": 1,
+	}))
+
+	lock, err := acquireGlobalLock(ctx, out, db, table, lockTTL)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	var exists uint8
+	if err := db.QueryRow(ctx, "EXISTS TABLE "+table).Scan(&exists); err != nil {
+		return err
+	}
+
+	if exists == 1 {
+		applied, err := appliedMigrations(ctx, db, table)
+		if err != nil {
+			return err
+		}
+
+		names := make([]string, 0, len(applied))
+		for name := range applied {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			to := paddedMigrationName(name, width)
+
+			// a checksum already differing from the file is drift to report, not to hide
+			sum := "checksum"
+			r, updated := rewrites[to]
+			if updated && applied[name] == r.oldSum {
+				sum = quoteString(r.newSum)
+			} else {
+				updated = false
+			}
+
+			if to == name {
+				if updated {
+					if err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s UPDATE checksum = %s WHERE name = %s", table, sum, quoteString(name))); err != nil {
+						return err
+					}
+					fmt.Fprintln(out, "Updated bookkeeping checksum: "+name)
+				}
+				continue
+			}
+			if _, taken := applied[to]; taken {
+				return fmt.Errorf("cannot rename bookkeeping row %s: %s is already recorded in %s", name, to, table)
+			}
+
+			// name is part of the sorting key and cannot be updated, so the row is copied under the new name
+			if err := db.Exec(ctx, fmt.Sprintf("INSERT INTO %s (name, dt, checksum, dir, applied_at) SELECT %s, dt, %s, dir, applied_at FROM %s FINAL WHERE name = %s", table, quoteString(to), sum, table, quoteString(name))); err != nil {
+				return err
+			}
+			if err := db.Exec(ctx, fmt.Sprintf("ALTER TABLE %s DELETE WHERE name = %s", table, quoteString(name))); err != nil {
+				return err
+			}
+			fmt.Fprintln(out, "Renamed bookkeeping row: "+name+" -> "+to)
+		}
+	}
+
+	for _, r := range renames {
+		if err := os.Rename(r.from, r.to); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Renamed: "+r.from+" -> "+r.to)
+	}
+
+	for _, name := range rewritten {
+		r := rewrites[name]
+		if err := os.WriteFile(r.path, r.content, 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Updated logme:requires: "+r.path)
+	}
+
+	for _, path := range orderFiles {
+		if err := os.WriteFile(path, orderContents[path], 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Updated: "+path)
+	}
+
+	if len(renames) == 0 {
+		fmt.Fprintf(out, "Every migration file already has a %d digit prefix\n", width)
+	}
+
+	return nil
+}
+
+// rewriteRequires renames the migrations listed by the "-- logme:requires" lines of a migration's header, leaving
+// everything else, including the line endings, as it is
+func rewriteRequires(content []byte, renamed map[string]string) []byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	for i, line := range lines {
+		text := strings.TrimSpace(string(line))
+		if text == "" {
+			continue
+		}
+		// the header ends at the first line that is not a comment, as in readDirectives
+		if !strings.HasPrefix(text, "--") {
+			break
+		}
+		if directive, _, _ := strings.Cut(strings.TrimPrefix(text, directivePrefix), " "); !strings.HasPrefix(text, directivePrefix) || directive != "requires" {
+			continue
+		}
+
+		prefix := string(line[:bytes.Index(line, []byte(directivePrefix))+len(directivePrefix+"requires")])
+		end := strings.TrimRight(string(line), "\r\n")
+		ending := string(line[len(end):])
+
+		items := strings.Split(end[len(prefix):], ",")
+		changed := false
+		for j, item := range items {
+			if to, ok := renamed[strings.TrimSpace(item)]; ok {
+				items[j] = strings.Replace(item, strings.TrimSpace(item), to, 1)
+				changed = true
+			}
+		}
+		if changed {
+			lines[i] = []byte(prefix + strings.Join(items, ",") + ending)
+		}
+	}
+
+	return bytes.Join(lines, nil)
+}
+
+// rewriteOrderFile renames the migrations listed in an order.txt, comments and blank lines are kept
+func rewriteOrderFile(content []byte, renamed map[string]string) []byte {
+	lines := bytes.SplitAfter(content, []byte("\n"))
+	for i, line := range lines {
+		name := strings.TrimSpace(string(line))
+		if to, ok := renamed[name]; ok {
+			lines[i] = bytes.Replace(line, []byte(name), []byte(to), 1)
+		}
+	}
+
+	return bytes.Join(lines, nil)
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestRewriteRequires(t *testing.T) {
+	renamed := map[string]string{"1_users.sql": "001_users.sql", "2_events.sql": "002_events.sql"}
+
+	content := "-- logme:requires 1_users.sql, 2_events.sql\r\n-- logme:requires 10_other.sql\n-- logme:requiresx 1_users.sql\n\nSELECT '-- logme:requires 1_users.sql';\n-- logme:requires 1_users.sql\n"
+	want := "-- logme:requires 001_users.sql, 002_events.sql\r\n-- logme:requires 10_other.sql\n-- logme:requiresx 1_users.sql\n\nSELECT '-- logme:requires 1_users.sql';\n-- logme:requires 1_users.sql\n"
+
+	if got := string(rewriteRequires([]byte(content), renamed)); got != want {
+		t.Errorf("rewriteRequires() =\n%q\nwant\n%q", got, want)
+	}
+}
+
+func TestRewriteOrderFile(t *testing.T) {
+	renamed := map[string]string{"1_users.sql": "001_users.sql"}
+
+	content := "# users first\n1_users.sql\n\n010_events.sql"
+	want := "# users first\n001_users.sql\n\n010_events.sql"
+
+	if got := string(rewriteOrderFile([]byte(content), renamed)); got != want {
+		t.Errorf("rewriteOrderFile() = %q, want %q", got, want)
+	}
+}
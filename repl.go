@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/chzyer/readline"
+)
+
+const replHelp = `Statements run once terminated by a semicolon and may span several lines.
+  \dt    list the tables of the database
+  \q     quit (or Ctrl+D)
+  \?     show this help`
+
+// repl reads statements interactively and prints their results as tables, over a single connection kept open for
+// the whole session. History is kept in ~/.logme_cli_history
+func repl(w io.Writer, isTest bool) error {
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	prompt := getDbName(isTest) + "> "
+	config := &readline.Config{Prompt: prompt, Stdout: w}
+	if home, err := os.UserHomeDir(); err == nil {
+		config.HistoryFile = filepath.Join(home, ".logme_cli_history")
+	}
+
+	rl, err := readline.NewEx(config)
+	if err != nil {
+		return err
+	}
+	defer rl.Close()
+
+	fmt.Fprintln(w, `Connected to `+getDbName(isTest)+`, \? for help`)
+
+	var statement []string
+	for {
+		line, err := rl.Readline()
+		if errors.Is(err, readline.ErrInterrupt) {
+			// Ctrl+C abandons the statement being typed
+			statement = nil
+			rl.SetPrompt(prompt)
+			continue
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line = strings.TrimSpace(line)
+		if len(statement) == 0 && strings.HasPrefix(line, `\`) {
+			switch line {
+			case `\q`:
+				return nil
+			case `\dt`:
+				line = "SHOW TABLES;"
+			case `\?`:
+				fmt.Fprintln(w, replHelp)
+				continue
+			default:
+				fmt.Fprintln(w, `unknown command `+line+`, \? for help`)
+				continue
+			}
+		}
+		if line == "" {
+			continue
+		}
+
+		statement = append(statement, line)
+		if !strings.HasSuffix(line, ";") {
+			rl.SetPrompt(strings.Repeat(" ", len(prompt)-3) + "-> ")
+			continue
+		}
+
+		sql := strings.TrimSuffix(strings.Join(statement, "\n"), ";")
+		statement = nil
+		rl.SetPrompt(prompt)
+
+		// an error ends the statement, not the session
+		if err := printQuery(w, db, sql); err != nil {
+			fmt.Fprintln(w, "error: "+err.Error())
+		}
+	}
+}
+
+// printQuery runs sql and prints the rows it returns as an aligned table followed by the row count, the session's
+// connection is reestablished when the server dropped it while idle
+func printQuery(w io.Writer, db driver.Conn, sql string) error {
+	rows, err := queryRetrying(context.Background(), db, sql)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	columns := rows.Columns()
+	if len(columns) == 0 {
+		fmt.Fprintln(w, "OK")
+		return rows.Err()
+	}
+
+	table := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, strings.Join(columns, "\t"))
+
+	count := 0
+	for rows.Next() {
+		record, err := scanRecord(rows)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(table, strings.Join(record, "\t"))
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "(%d row(s))\n", count)
+
+	return nil
+}
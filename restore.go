@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// restore copies the rows of a backup table made by --backup-before-drop back into table
+func restore(out io.Writer, isTest bool, table string, backup string, truncate bool, force bool) error {
+	if err := guardProfile(force); err != nil {
+		return err
+	}
+	if dbName := getDbName(isTest); !force && !isTestDatabase(dbName) {
+		return configErrorf("refusing to restore into non-test database '%s' without --force", dbName)
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	target, err := insertableColumns(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	if len(target) == 0 {
+		return fmt.Errorf("table '%s' does not exist, recreate it first (e.g. CREATE TABLE %s AS %s)", table, table, backup)
+	}
+	source, err := insertableColumns(ctx, db, backup)
+	if err != nil {
+		return err
+	}
+	if len(source) == 0 {
+		return fmt.Errorf("backup table '%s' does not exist", backup)
+	}
+
+	// columns dropped since the backup are left behind, but every column of the table has to come from the backup
+	types := map[string]string{}
+	for _, column := range source {
+		types[column.Name] = column.Type
+	}
+	names := make([]string, len(target))
+	for i, column := range target {
+		backupType, ok := types[column.Name]
+		switch {
+		case !ok:
+			return fmt.Errorf("incompatible schemas: column %s of %s is missing from %s", column.Name, table, backup)
+		case backupType != column.Type:
+			return fmt.Errorf("incompatible schemas: column %s is %s in %s but %s in %s", column.Name, column.Type, table, backupType, backup)
+		}
+		names[i] = quoteIdentifier(column.Name)
+	}
+
+	if truncate {
+		if err := db.Exec(ctx, "TRUNCATE TABLE "+quoteIdentifier(table)); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Truncated: "+table)
+	}
+
+	columns := strings.Join(names, ", ")
+	sql := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s", quoteIdentifier(table), columns, columns, quoteIdentifier(backup))
+	if err := db.Exec(ctx, sql); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Restored "+table+" from "+backup)
+
+	return nil
+}
+
+// insertableColumns returns the columns of table that can be inserted into, in order, none when the table does not
+// exist. MATERIALIZED and ALIAS columns are computed by the server
+func insertableColumns(ctx context.Context, db driver.Conn, table string) ([]columnDescription, error) {
+	rows, err := db.Query(ctx, `
+		SELECT name, type
+		FROM system.columns
+		WHERE database = currentDatabase() AND table = $1 AND default_kind NOT IN ('MATERIALIZED', 'ALIAS')
+		ORDER BY position
+	`, table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []columnDescription
+	for rows.Next() {
+		var column columnDescription
+		if err := rows.Scan(&column.Name, &column.Type); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+
+	return columns, rows.Err()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"syscall"
+	"time"
+)
+
+// a server that is still starting (e.g. a container just brought up) gets this many attempts, about 4s in total
+const (
+	retryAttempts = 5
+	retryBackoff  = 250 * time.Millisecond
+)
+
+// withRetry runs op until it succeeds, fails with an error that is not transient or runs out of attempts, doubling
+// the wait between attempts
+func withRetry(op func() error) error {
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		err := op()
+		if err == nil || attempt == retryAttempts || !isTransient(err) {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// isTransient reports whether err looks like a server that is not ready yet rather than a genuine problem, which
+// includes a refused connection, one closed under us and timeouts. ClickHouse exceptions are never transient
+func isTransient(err error) bool {
+	if isBrokenConnection(err) || errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+func TestWithRetryTransientThenSuccess(t *testing.T) {
+	attempts := 0
+	err := withRetry(func() error {
+		attempts++
+		if attempts < 3 {
+			return syscall.ECONNREFUSED
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("withRetry() = %v, want success on the third attempt", err)
+	}
+	if attempts != 3 {
+		t.Errorf("%d attempts, want 3", attempts)
+	}
+}
+
+func TestWithRetryDoesNotRetryGenuineErrors(t *testing.T) {
+	exception := &clickhouse.Exception{Code: 516, Name: "AUTHENTICATION_FAILED", Message: "wrong password"}
+
+	attempts := 0
+	err := withRetry(func() error {
+		attempts++
+		return exception
+	})
+	if !errors.Is(err, exception) || attempts != 1 {
+		t.Errorf("withRetry() = %v after %d attempts, want the exception after 1", err, attempts)
+	}
+}
+
+func TestWithRetryGivesUp(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits through every backoff")
+	}
+
+	attempts := 0
+	err := withRetry(func() error {
+		attempts++
+		return syscall.ECONNRESET
+	})
+	if !errors.Is(err, syscall.ECONNRESET) || attempts != retryAttempts {
+		t.Errorf("withRetry() = %v after %d attempts, want ECONNRESET after %d", err, attempts, retryAttempts)
+	}
+}
+
+// startingConn fails the first lookups of the migrations table like a server still starting up
+type startingConn struct {
+	schemaConn
+	failures int
+	lookups  int
+}
+
+func (c *startingConn) QueryRow(ctx context.Context, sql string, args ...interface{}) driver.Row {
+	if !strings.Contains(sql, "SHOW TABLES") {
+		return c.schemaConn.QueryRow(ctx, sql, args...)
+	}
+	c.lookups++
+	if c.lookups <= c.failures {
+		return errRow{syscall.ECONNREFUSED}
+	}
+	return stringRow("migrations")
+}
+
+type errRow struct{ err error }
+
+func (r errRow) Err() error                        { return r.err }
+func (r errRow) Scan(dest ...interface{}) error    { return r.err }
+func (r errRow) ScanStruct(dest interface{}) error { return r.err }
+
+func TestCreateMigrationsTableRetriesAStartingServer(t *testing.T) {
+	db := &startingConn{schemaConn: schemaConn{columns: []string{"name", "dt", "checksum"}, engine: "ReplacingMergeTree"}, failures: 1}
+
+	if err := createMigrationsTable(db, "migrations"); err != nil {
+		t.Fatalf("createMigrationsTable() = %v, want the lookup retried", err)
+	}
+	if db.lookups != 2 {
+		t.Errorf("%d lookups, want the refused one and its retry", db.lookups)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// rollback reverts, newest first, every migration applied after target by running its down migration, leaving
+// target as the last applied migration
+func rollback(out io.Writer, isTest bool, table string, target string, force bool, lockTTL time.Duration) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+	if target == "" {
+		return configErrorf("rollback requires --to NAME, the migration to roll back to")
+	}
+	// accept a path to the file as well, as migrate:run does
+	target = filepath.Base(target)
+	if err := guardProfile(force); err != nil {
+		return err
+	}
+	if dbName := getDbName(isTest); !force && !isTestDatabase(dbName) {
+		return configErrorf("refusing to roll back non-test database '%s' without --force", dbName)
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	lock, err := acquireGlobalLock(ctx, out, db, table, lockTTL)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	applied, err := appliedInOrder(ctx, db, table)
+	if err != nil {
+		return err
+	}
+
+	position := -1
+	for i, name := range applied {
+		if name == target {
+			position = i
+		}
+	}
+	if position < 0 {
+		return configErrorf("migration '%s' is not applied, nothing to roll back to", target)
+	}
+
+	later := applied[position+1:]
+
+	// without a down migration the schema change would stay while the migration shows as unapplied
+	for _, name := range later {
+		if _, err := os.Stat(migrationPath(downMigrationName(name))); err != nil {
+			return configErrorf("cannot roll back %s: %s is missing", name, downMigrationName(name))
+		}
+	}
+
+	for i := len(later) - 1; i >= 0; i-- {
+		if err := revertMigration(ctx, out, db, table, later[i]); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(out, "Rolled back to "+target)
+
+	return nil
+}
+
+// appliedInOrder lists the applied migrations in the order they were applied in, by applied_at as dt only has a
+// precision of seconds. Rows recorded before applied_at existed come first, in the order of dt then name
+func appliedInOrder(ctx context.Context, db driver.Conn, table string) ([]string, error) {
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT name FROM %s FINAL WHERE status = '' ORDER BY applied_at, dt, name", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var applied []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		applied = append(applied, name)
+	}
+
+	return applied, rows.Err()
+}
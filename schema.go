@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/google/uuid"
+)
+
+// dumpSchema writes the CREATE statement of every table and view of the database to path, in the declarative
+// format read by migrate:diff. The bookkeeping table is left out and the database qualifier dropped, so the file
+// applies to the test database as well
+func dumpSchema(ctx context.Context, db driver.Conn, path string, table string) error {
+	statements, err := schemaStatements(ctx, db, table)
+	if err != nil {
+		return err
+	}
+
+	content := "-- generated by logme-cli from the migrated database, do not edit\n\n" + strings.Join(statements, "\n\n") + "\n"
+
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+// schemaStatements returns the CREATE statement of every table and view of the database, ending in a semicolon. The
+// .inner tables of materialized views are left out, creating the view creates them, and so are the backups of
+// --backup-before-drop and the migration lock
+func schemaStatements(ctx context.Context, db driver.Conn, table string) ([]string, error) {
+	// tables before the views selecting from them
+	rows, err := db.Query(ctx, `
+		SELECT database, name, create_table_query
+		FROM system.tables
+		WHERE database = currentDatabase() AND name NOT IN ($1, $2) AND NOT is_temporary AND NOT startsWith(name, '.inner')
+			AND `+notBackupTable+`
+		ORDER BY engine LIKE '%View', name
+	`, table, lockTableName(table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var statements []string
+	for rows.Next() {
+		var database, name, create string
+		if err := rows.Scan(&database, &name, &create); err != nil {
+			return nil, err
+		}
+		create = strings.Replace(create, " "+database+"."+name, " "+name, 1)
+		statements = append(statements, create+";")
+	}
+
+	return statements, rows.Err()
+}
+
+// schemaDump writes the schema of the database to path, as --dump-schema-after does. With since set nothing is
+// written, it prints the changes to the tables since that migration instead: the schema from before it is rebuilt
+// in a temporary database by applying the migrations preceding it, then compared like schema:compare
+func schemaDump(out io.Writer, isTest bool, table string, path string, since string, color string) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+	useColor, err := colorEnabled(out, color)
+	if err != nil {
+		return err
+	}
+
+	db, err := getReadonlyDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if since == "" {
+		if err := dumpSchema(ctx, db, path, table); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Schema written to "+path)
+		return nil
+	}
+
+	names, err := migrationFiles()
+	if err != nil {
+		return err
+	}
+	index := -1
+	for i, name := range names {
+		if name == since {
+			index = i
+		}
+	}
+	if index < 0 {
+		return configErrorf("--since %s is not a migration in %s", since, strings.Join(migrationDirs, ", "))
+	}
+
+	// the current schema only has the changes of the migrations that ran
+	dbName := getDbName(isTest)
+	applied, err := appliedMigrations(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	if _, ok := applied[since]; !ok {
+		return configErrorf("%s has not been applied to '%s', the schema has none of its changes yet; run migrate first", since, dbName)
+	}
+	for _, name := range names[index+1:] {
+		if _, ok := applied[name]; !ok {
+			fmt.Fprintln(out, "warning: "+name+" has not been applied to '"+dbName+"', its changes are left out")
+		}
+	}
+
+	current := schemaSide{database: dbName}
+	currentSchema, err := readSchema(&current)
+	if err != nil {
+		return err
+	}
+	beforeSchema, err := schemaBefore(ctx, out, table, names[:index])
+	if err != nil {
+		return err
+	}
+	delete(currentSchema, table)
+
+	printSchemaDiff(out, "before "+since, dbName, beforeSchema, currentSchema, useColor)
+
+	return nil
+}
+
+// schemaBefore applies the given migrations, without recording them, to a temporary database dropped afterwards and
+// reads its schema
+func schemaBefore(ctx context.Context, out io.Writer, table string, names []string) (map[string]string, error) {
+	// the temporary database does not exist yet, so connect to the one every server has
+	dbName := os.Getenv("DB_NAME")
+	defer os.Setenv("DB_NAME", dbName)
+	os.Setenv("DB_NAME", "default")
+
+	admin, err := getDbConn(false)
+	if err != nil {
+		return nil, err
+	}
+
+	tempName := "logme_since_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+	if err := admin.Exec(ctx, "CREATE DATABASE "+quoteIdentifier(tempName)); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if dropErr := admin.Exec(ctx, "DROP DATABASE "+quoteIdentifier(tempName)+" SYNC"); dropErr != nil {
+			fmt.Fprintln(out, "warning: could not drop temporary database "+tempName+": "+dropErr.Error())
+		}
+	}()
+
+	os.Setenv("DB_NAME", tempName)
+	db, err := getDbConn(false)
+	if err != nil {
+		return nil, err
+	}
+
+	var serverVersion string
+	if err := db.QueryRow(ctx, "SELECT version()").Scan(&serverVersion); err != nil {
+		return nil, err
+	}
+
+	opts := migrateOptions{out: io.Discard, table: table, stateless: true}
+	for _, name := range names {
+		// skipped as they are by migrate, for another environment or a newer server
+		_, reason, err := migrationSkip(name, serverVersion)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			continue
+		}
+		if _, err := applyMigration(ctx, db, opts, name); err != nil {
+			return nil, fmt.Errorf("rebuilding the schema before the migration: %w", err)
+		}
+	}
+
+	before := schemaSide{database: tempName}
+	return readSchema(&before)
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// script migrations are executables run instead of SQL, for transformations easier written in code
+const scriptMigrationSuffix = ".sh"
+
+func isScriptMigration(name string) bool {
+	return strings.HasSuffix(name, scriptMigrationSuffix)
+}
+
+// isMigrationFile reports whether a file in a migrations directory is a migration, SQL, template or script
+func isMigrationFile(name string) bool {
+	return strings.HasSuffix(name, ".sql") || isTemplateMigration(name) || isScriptMigration(name)
+}
+
+// runScriptMigration executes a script migration with the environment of the CLI plus the connection it would use
+// (DB_ADDR, DB_NAME, the credentials as configured) and LOGME_MIGRATION and LOGME_RUN_ID. A zero exit code is success
+func runScriptMigration(opts migrateOptions, name string) error {
+	addr, err := getDbAddr()
+	if err != nil {
+		return err
+	}
+
+	path, err := filepath.Abs(migrationPath(name))
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(path)
+	cmd.Env = append(os.Environ(),
+		// already resolved from DB_ADDR, DB_HOST and DB_PORT, DB_LOCAL_ADDR or an --ssh-tunnel
+		"DB_ADDR="+addr,
+		"DB_NAME="+opts.database,
+		"LOGME_MIGRATION="+name,
+		"LOGME_RUN_ID="+opts.runID,
+	)
+	cmd.Stdout = opts.out
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
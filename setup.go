@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+var (
+	setStatementRegexp = regexp.MustCompile(`(?is)^SET\s+(.+)$`)
+	assignmentRegexp   = regexp.MustCompile(`(?s)^\s*(\w+)\s*=\s*(.+?)\s*$`)
+)
+
+// runSetupSQL executes the statements of the --setup-sql file before any migration, failing on the first error.
+// Connections are pooled, so a SET only reaches the connection it ran on, its assignments are returned to be
+// sent along with every migration statement as well
+func runSetupSQL(ctx context.Context, db driver.Conn, file string) (clickhouse.Settings, error) {
+	settings := clickhouse.Settings{}
+	if file == "" {
+		return settings, nil
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, statement := range splitStatements(string(content)) {
+		if err := db.Exec(ctx, statement); err != nil {
+			return nil, &migrationError{name: "setup SQL " + file, err: err}
+		}
+
+		match := setStatementRegexp.FindStringSubmatch(stripLeadingComments(statement))
+		if match == nil {
+			continue
+		}
+		for _, assignment := range splitTopLevel(match[1]) {
+			parts := assignmentRegexp.FindStringSubmatch(assignment)
+			if parts == nil {
+				return nil, configErrorf("setup SQL %s: cannot parse setting '%s'", file, strings.TrimSpace(assignment))
+			}
+			settings[parts[1]] = settingValue(parts[2])
+		}
+	}
+
+	return settings, nil
+}
+
+// parseSettingFlags reads the key=value pairs of --setting
+func parseSettingFlags(flags []string) (clickhouse.Settings, error) {
+	settings := clickhouse.Settings{}
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || !identifierRegexp.MatchString(key) || value == "" {
+			return nil, configErrorf("invalid --setting '%s': expected NAME=VALUE", flag)
+		}
+		settings[key] = settingValue(value)
+	}
+	return settings, nil
+}
+
+// checkSettings fails on settings the server does not know, before they break the first query. Custom settings
+// (custom_ prefix) are defined by the query itself and cannot be checked
+func checkSettings(ctx context.Context, db driver.Conn, settings clickhouse.Settings) error {
+	var names []string
+	for name := range settings {
+		if !strings.HasPrefix(name, "custom_") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(ctx, "SELECT name FROM system.settings WHERE name IN ($1)", names)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	known := map[string]bool{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return err
+		}
+		known[name] = true
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	sort.Strings(names)
+	for _, name := range names {
+		if !known[name] {
+			return configErrorf("invalid --setting: unknown ClickHouse setting '%s'", name)
+		}
+	}
+	return nil
+}
+
+// settingValue converts a SQL literal to the value sent as a query setting
+func settingValue(literal string) interface{} {
+	if n, err := strconv.Atoi(literal); err == nil {
+		return n
+	}
+	if len(literal) >= 2 && literal[0] == '\'' && literal[len(literal)-1] == '\'' {
+		return strings.ReplaceAll(literal[1:len(literal)-1], `\'`, `'`)
+	}
+	return literal
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// snapshots are written by the server itself, with the file() table function, under its user_files directory
+const snapshotDir = "logme_snapshots/"
+
+// the structure of the schema file of a snapshot
+const snapshotSchemaStructure = "name String, engine String, create String, structure String, file String"
+
+// snapshotFormats maps --dump-format to the ClickHouse format and extension of the data files, restore reads the
+// format back from the extension
+var snapshotFormats = map[string]struct{ format, extension string }{
+	"native":  {"Native", ".native"},
+	"parquet": {"Parquet", ".parquet"},
+	// INSERT ... VALUES tuples, slower and larger but readable
+	"sql": {"Values", ".sql"},
+}
+
+var snapshotNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// snapshotTable is a table or view of a snapshot, structure is the column list its data file was written with
+type snapshotTable struct {
+	name      string
+	engine    string
+	create    string
+	structure string
+	// data file in the snapshot directory, empty for tables without data
+	file string
+}
+
+// hasData reports whether the data of a table is exported, views hold none and engines such as Distributed or
+// Kafka read from elsewhere
+func (t snapshotTable) hasData() bool {
+	switch t.engine {
+	case "Log", "TinyLog", "StripeLog", "Memory":
+		return true
+	}
+	return strings.HasSuffix(t.engine, "MergeTree")
+}
+
+func (t snapshotTable) isView() bool {
+	return strings.HasSuffix(t.engine, "View")
+}
+
+// snapshotDatabase connects to the database of a snapshot, the test database unless main is set
+func snapshotDatabase(name string, main bool) (driver.Conn, error) {
+	if !snapshotNameRegexp.MatchString(name) {
+		return nil, configErrorf("invalid snapshot name '%s': use letters, digits, dashes and underscores", name)
+	}
+
+	return getDbConn(!main)
+}
+
+// snapshotCreate exports the schema and data of every table of the database in format (native by default),
+// overwriting a snapshot of the same name
+func snapshotCreate(out io.Writer, name string, main bool, format string) error {
+	dump, ok := snapshotFormats[format]
+	if !ok {
+		return configErrorf("invalid --dump-format '%s': expected native, parquet or sql", format)
+	}
+
+	db, err := snapshotDatabase(name, main)
+	if err != nil {
+		return err
+	}
+
+	ctx := clickhouse.Context(context.Background(), clickhouse.WithSettings(clickhouse.Settings{
+		"engine_file_truncate_on_insert": 1,
+	}))
+
+	tables, err := snapshotTables(ctx, db)
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return configErrorf("the database has no tables to snapshot")
+	}
+
+	for i, t := range tables {
+		if !t.hasData() {
+			continue
+		}
+		tables[i].file = t.name + dump.extension
+		if err := db.Exec(ctx, fmt.Sprintf(
+			"INSERT INTO FUNCTION file(%s, %s, %s) SELECT * FROM %s",
+			quoteString(snapshotDir+name+"/"+tables[i].file), quoteString(dump.format), quoteString(t.structure), quoteIdentifier(t.name),
+		)); err != nil {
+			return fmt.Errorf("exporting %s: %w", t.name, err)
+		}
+		fmt.Fprintln(out, "Exported: "+t.name)
+	}
+
+	// the schema goes last, a snapshot without it cannot be restored so a failed export is never half restored
+	var values []string
+	for _, t := range tables {
+		values = append(values, fmt.Sprintf("(%s, %s, %s, %s, %s)", quoteString(t.name), quoteString(t.engine), quoteString(t.create), quoteString(t.structure), quoteString(t.file)))
+	}
+	if err := db.Exec(ctx, fmt.Sprintf(
+		"INSERT INTO FUNCTION file(%s, 'TSV', %s) VALUES %s",
+		quoteString(snapshotDir+name+"/schema.tsv"), quoteString(snapshotSchemaStructure), strings.Join(values, ", "),
+	)); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "Created snapshot: %s (%d table(s))\n", name, len(tables))
+
+	return nil
+}
+
+// snapshotRestore replaces every table of the database with those of a snapshot. Tables are created and filled
+// before the views, so materialized views do not see the restored rows again
+func snapshotRestore(out io.Writer, name string, main bool, force bool) error {
+	if main && !force {
+		return configErrorf("refusing to restore a snapshot into the main database without --force")
+	}
+
+	db, err := snapshotDatabase(name, main)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	rows, err := db.Query(ctx, fmt.Sprintf("SELECT name, engine, create, structure, file FROM file(%s, 'TSV', %s)", quoteString(snapshotDir+name+"/schema.tsv"), quoteString(snapshotSchemaStructure)))
+	if err != nil {
+		return fmt.Errorf("reading snapshot %s: %w", name, err)
+	}
+	var tables []snapshotTable
+	for rows.Next() {
+		var t snapshotTable
+		if err := rows.Scan(&t.name, &t.engine, &t.create, &t.structure, &t.file); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, t)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return err
+	}
+	if len(tables) == 0 {
+		return configErrorf("snapshot %s is empty", name)
+	}
+
+	existing, err := snapshotTables(ctx, db)
+	if err != nil {
+		return err
+	}
+	// views first, they may read from the tables
+	for i := len(existing) - 1; i >= 0; i-- {
+		if err := db.Exec(ctx, "DROP TABLE "+quoteIdentifier(existing[i].name)+" SYNC"); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range tables {
+		if t.isView() {
+			continue
+		}
+		if err := db.Exec(ctx, t.create); err != nil {
+			return fmt.Errorf("creating %s: %w", t.name, err)
+		}
+		if t.file != "" {
+			format, err := snapshotFileFormat(t.file)
+			if err != nil {
+				return err
+			}
+			if err := db.Exec(ctx, fmt.Sprintf(
+				"INSERT INTO %s SELECT * FROM file(%s, %s, %s)",
+				quoteIdentifier(t.name), quoteString(snapshotDir+name+"/"+t.file), quoteString(format), quoteString(t.structure),
+			)); err != nil {
+				return fmt.Errorf("restoring %s: %w", t.name, err)
+			}
+		}
+		fmt.Fprintln(out, "Restored: "+t.name)
+	}
+
+	for _, t := range tables {
+		if !t.isView() {
+			continue
+		}
+		if err := db.Exec(ctx, t.create); err != nil {
+			return fmt.Errorf("creating %s: %w", t.name, err)
+		}
+		fmt.Fprintln(out, "Restored: "+t.name)
+	}
+
+	fmt.Fprintln(out, "Restored snapshot: "+name)
+
+	return nil
+}
+
+// snapshotFileFormat is the ClickHouse format of a snapshot data file, from its extension
+func snapshotFileFormat(file string) (string, error) {
+	for _, dump := range snapshotFormats {
+		if filepath.Ext(file) == dump.extension {
+			return dump.format, nil
+		}
+	}
+	return "", fmt.Errorf("snapshot data file %s has an unknown extension", file)
+}
+
+// snapshotTables lists the tables of the database, views last, with their CREATE statement unqualified and the
+// columns SELECT * returns. Inner tables of materialized views are left out, CREATE MATERIALIZED VIEW makes them, and
+// so are the backups of --backup-before-drop, restoring a snapshot keeps them
+func snapshotTables(ctx context.Context, db driver.Conn) ([]snapshotTable, error) {
+	// the columns SELECT * returns, as the structure argument of file()
+	rows, err := db.Query(ctx, `
+		SELECT table, name, type
+		FROM system.columns
+		WHERE database = currentDatabase() AND default_kind NOT IN ('MATERIALIZED', 'ALIAS', 'EPHEMERAL')
+		ORDER BY table, position
+	`)
+	if err != nil {
+		return nil, err
+	}
+	columns := map[string][]string{}
+	for rows.Next() {
+		var table, name, typ string
+		if err := rows.Scan(&table, &name, &typ); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		columns[table] = append(columns[table], quoteIdentifier(name)+" "+typ)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err = db.Query(ctx, `
+		SELECT database, name, engine, create_table_query
+		FROM system.tables
+		WHERE database = currentDatabase() AND NOT is_temporary AND NOT startsWith(name, '.inner')
+			AND `+notBackupTable+`
+		ORDER BY engine LIKE '%View', name
+	`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tables []snapshotTable
+	for rows.Next() {
+		var (
+			database string
+			t        snapshotTable
+		)
+		if err := rows.Scan(&database, &t.name, &t.engine, &t.create); err != nil {
+			return nil, err
+		}
+		t.create = strings.Replace(t.create, " "+database+"."+t.name, " "+t.name, 1)
+		t.structure = strings.Join(columns[t.name], ", ")
+		tables = append(tables, t)
+	}
+
+	return tables, rows.Err()
+}
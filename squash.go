@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// statements whose effect is data rather than schema, a baseline built from the schema does not redo them
+var dataStatementRegexp = regexp.MustCompile(`(?is)^(INSERT\s+INTO|DELETE\s+FROM|ALTER\s+TABLE\s+\S+\s+(UPDATE|DELETE)\b)`)
+
+// migrateSquash replaces every migration file with a single baseline holding the schema of the migrated database,
+// moving the old files (down migrations and order.txt included) to archive and recording the baseline as applied.
+// The baseline lists the migrations it replaces ("-- logme:squashes"), so migrate records it without running it on
+// databases where they all ran, runs it on new databases and refuses it on databases that only ran some of them
+func migrateSquash(out io.Writer, isTest bool, table string, name string, archive string, dryRun bool, lockTTL time.Duration) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+
+	names, err := migrationFiles()
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return configErrorf("no migrations to squash in %s", strings.Join(migrationDirs, ", "))
+	}
+
+	if name == "" {
+		name = squashBaselineName(names)
+	}
+	if !strings.HasSuffix(name, ".sql") || isDownMigration(name) || isTemplateMigration(name) || strings.ContainsAny(name, `/\`) {
+		return configErrorf("invalid baseline name '%s': expected a plain .sql file name such as 042_baseline.sql", name)
+	}
+	if containsString(names, name) {
+		return configErrorf("baseline %s is the name of a migration it would squash, pick a new name", name)
+	}
+	if archive == "" {
+		archive = migrationDirs[0] + "archive/"
+	}
+	if !strings.HasSuffix(archive, "/") {
+		archive += "/"
+	}
+
+	var db driver.Conn
+	if dryRun {
+		db, err = getReadonlyDbConn(isTest)
+	} else {
+		db, err = getDbConn(isTest)
+	}
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	var exists uint8
+	if err := db.QueryRow(ctx, "EXISTS TABLE "+table).Scan(&exists); err != nil {
+		return err
+	}
+	if exists != 1 {
+		return configErrorf("database '%s' has no %s table, run migrate before squashing", getDbName(isTest), table)
+	}
+
+	if !dryRun {
+		lock, err := acquireGlobalLock(ctx, out, db, table, lockTTL)
+		if err != nil {
+			return err
+		}
+		defer lock.release()
+	}
+
+	// the baseline is the schema of this database, so it has to include the effect of every migration
+	pending, err := pendingMigrations(ctx, db, table)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return configErrorf("cannot squash, %d migration(s) not applied to '%s': %s; run migrate first, or squash from a database where they ran", len(pending), getDbName(isTest), strings.Join(pending, ", "))
+	}
+
+	statements, err := schemaStatements(ctx, db, table)
+	if err != nil {
+		return err
+	}
+
+	// files to archive, each migration with its down migration, then order.txt
+	var files, dataMigrations []string
+	for _, migration := range names {
+		path := migrationPath(migration)
+		files = append(files, path)
+
+		dir := strings.TrimSuffix(path, migration)
+		if down := dir + downMigrationName(migration); fileExists(down) {
+			files = append(files, down)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if isScriptMigration(migration) || hasDataStatements(string(content)) {
+			dataMigrations = append(dataMigrations, migration)
+		}
+	}
+	orderPath := ""
+	for _, dir := range migrationDirs {
+		if fileExists(dir + orderFile) {
+			orderPath = dir + orderFile
+			files = append(files, orderPath)
+		}
+	}
+	for _, path := range files {
+		if target := archivePath(archive, path); fileExists(target) {
+			return fmt.Errorf("cannot archive %s: %s already exists", path, target)
+		}
+	}
+
+	content := squashBaseline(names, statements)
+	path := migrationDirs[0] + name
+
+	if dryRun {
+		fmt.Fprintf(out, "Would write %s: %d statement(s) squashing %d migration(s)\n", path, len(statements), len(names))
+		for _, file := range files {
+			fmt.Fprintln(out, "Would archive: "+file+" -> "+archivePath(archive, file))
+		}
+		if orderPath != "" {
+			fmt.Fprintln(out, "Would write "+migrationDirs[0]+orderFile+" listing "+name)
+		}
+		fmt.Fprintln(out, "Would record "+name+" as applied to '"+getDbName(isTest)+"'")
+		printSquashWarnings(out, name, names, dataMigrations)
+		return nil
+	}
+
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Wrote %s: %d statement(s) squashing %d migration(s)\n", path, len(statements), len(names))
+
+	for _, file := range files {
+		target := archivePath(archive, file)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(file, target); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(out, "Archived %d file(s) to %s\n", len(files), archive)
+
+	if orderPath != "" {
+		if err := os.WriteFile(migrationDirs[0]+orderFile, []byte(name+"\n"), 0644); err != nil {
+			return err
+		}
+		fmt.Fprintln(out, "Wrote "+migrationDirs[0]+orderFile)
+	}
+
+	if err := recordMigration(ctx, db, table, name, content); err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Recorded "+name+" as applied to '"+getDbName(isTest)+"'")
+
+	printSquashWarnings(out, name, names, dataMigrations)
+
+	return nil
+}
+
+// squashBaselineName names the baseline after the highest numeric prefix squashed, so migrations added later sort
+// after it
+func squashBaselineName(names []string) string {
+	highest, width := -1, 3
+	for _, name := range names {
+		match := migrationPrefixRegexp.FindStringSubmatch(name)
+		if match == nil {
+			continue
+		}
+		if n, err := strconv.Atoi(match[1]); err == nil && n > highest {
+			highest, width = n, len(match[1])
+		}
+	}
+	if highest < 0 {
+		return "baseline.sql"
+	}
+	return fmt.Sprintf("%0*d_baseline.sql", width, highest)
+}
+
+// squashBaseline builds the baseline migration, one "-- logme:squashes" line per migration it replaces, its CREATE
+// statements run one by one ("-- logme:multi-statement")
+func squashBaseline(names []string, statements []string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "-- baseline of %d migration(s) generated by logme-cli migrate:squash, the old files are archived\n", len(names))
+	b.WriteString(directivePrefix + multiStatementDirective + "\n")
+	for _, name := range names {
+		b.WriteString(directivePrefix + "squashes " + name + "\n")
+	}
+	b.WriteString("\n" + strings.Join(statements, "\n\n") + "\n")
+	return []byte(b.String())
+}
+
+// archivePath is where squashing moves path to. With several migrations directories each keeps its own directory
+// under archive, as they may hold files of the same name (order.txt at least)
+func archivePath(archive string, path string) string {
+	if len(migrationDirs) == 1 {
+		return archive + filepath.Base(path)
+	}
+	dir := filepath.ToSlash(filepath.Clean(filepath.Dir(path)))
+	dir = strings.ReplaceAll(strings.TrimLeft(dir, "/"), "..", "_")
+	return archive + dir + "/" + filepath.Base(path)
+}
+
+func hasDataStatements(sql string) bool {
+	for _, statement := range splitStatements(sql) {
+		if dataStatementRegexp.MatchString(stripLeadingComments(statement)) {
+			return true
+		}
+	}
+	return false
+}
+
+func printSquashWarnings(out io.Writer, name string, names []string, dataMigrations []string) {
+	fmt.Fprintf(out, "warning: databases that have not applied all %d squashed migration(s) must run migrate with the old files before they get %s, migrate refuses the baseline over a partial schema\n", len(names), name)
+	if len(dataMigrations) > 0 {
+		fmt.Fprintln(out, "warning: the baseline holds the schema only, new databases do not get the data written by "+strings.Join(dataMigrations, ", "))
+	}
+}
+
+// squashedMigrations lists the migrations replaced by the baselines in the migrations directories, they are applied
+// but no longer have a file
+func squashedMigrations() (map[string]bool, error) {
+	names, err := migrationFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	squashed := map[string]bool{}
+	for _, name := range names {
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return nil, err
+		}
+		for _, old := range directiveList(readDirectives(content), "squashes") {
+			squashed[old] = true
+		}
+	}
+
+	return squashed, nil
+}
+
+// baselineApplied tells whether every migration a baseline squashes already ran on the database, so only the
+// baseline has to be recorded. None of them having run is a new database, which runs the baseline; only some of
+// them is an error, the baseline would be applied over a partial schema
+func baselineApplied(ctx context.Context, db driver.Conn, table string, name string, directives map[string][]string) (bool, error) {
+	squashed := directiveList(directives, "squashes")
+	if len(squashed) == 0 {
+		return false, nil
+	}
+
+	applied, err := appliedMigrations(ctx, db, table)
+	if err != nil {
+		return false, err
+	}
+
+	var missing []string
+	for _, old := range squashed {
+		if _, ok := applied[old]; !ok {
+			missing = append(missing, old)
+		}
+	}
+
+	switch len(missing) {
+	case 0:
+		return true, nil
+	case len(squashed):
+		return false, nil
+	}
+
+	return false, &migrationError{name: name, err: fmt.Errorf("only %d of the %d migration(s) it squashes ran on this database, restore the archived files and run migrate before the baseline, not applied: %s", len(squashed)-len(missing), len(squashed), strings.Join(missing, ", "))}
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
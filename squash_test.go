@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSquashBaselineName(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{[]string{"001_a.sql", "042_b.sql", "7_c.sql"}, "042_baseline.sql"},
+		{[]string{"1_a.sql", "10_b.sql"}, "10_baseline.sql"},
+		{[]string{"a.sql"}, "baseline.sql"},
+	}
+
+	for _, test := range tests {
+		if got := squashBaselineName(test.names); got != test.want {
+			t.Errorf("squashBaselineName(%q) = %s, want %s", test.names, got, test.want)
+		}
+	}
+}
+
+func TestSquashedMigrationsReadsBaselines(t *testing.T) {
+	baseline := squashBaseline([]string{"001_a.sql", "002_b.sql"}, []string{"CREATE TABLE a (id UInt64) ENGINE = MergeTree ORDER BY id;"})
+	useMigrationDirs(t, map[string]string{
+		"002_baseline.sql": string(baseline),
+		"003_c.sql":        "SELECT 1",
+	})
+
+	squashed, err := squashedMigrations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]bool{"001_a.sql": true, "002_b.sql": true}
+	if !reflect.DeepEqual(squashed, want) {
+		t.Errorf("squashedMigrations() = %v, want %v", squashed, want)
+	}
+}
+
+func TestHasDataStatements(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want bool
+	}{
+		{"CREATE TABLE a (id UInt64) ENGINE = MergeTree ORDER BY id", false},
+		{"ALTER TABLE a ADD COLUMN b String", false},
+		{"CREATE TABLE a (id UInt64) ENGINE = Memory;\n-- seed\nINSERT INTO a VALUES (1)", true},
+		{"ALTER TABLE a UPDATE b = 'x' WHERE 1", true},
+		{"ALTER TABLE a DELETE WHERE id = 1", true},
+	}
+
+	for _, test := range tests {
+		if got := hasDataStatements(test.sql); got != test.want {
+			t.Errorf("hasDataStatements(%q) = %v, want %v", test.sql, got, test.want)
+		}
+	}
+}
+
+func TestBaselineApplied(t *testing.T) {
+	directives := readDirectives(squashBaseline([]string{"001_a.sql", "002_b.sql"}, nil))
+
+	tests := []struct {
+		applied    []string
+		recordOnly bool
+		failure    bool
+	}{
+		{applied: []string{"001_a.sql", "002_b.sql"}, recordOnly: true},
+		{applied: nil},
+		{applied: []string{"001_a.sql"}, failure: true},
+	}
+
+	for _, test := range tests {
+		db := &schemaConn{columns: test.applied}
+		recordOnly, err := baselineApplied(context.Background(), db, "migrations", "002_baseline.sql", directives)
+		if recordOnly != test.recordOnly {
+			t.Errorf("with %q applied: recordOnly = %v, want %v", test.applied, recordOnly, test.recordOnly)
+		}
+		if failure := errors.As(err, new(*migrationError)); failure != test.failure {
+			t.Errorf("with %q applied: err = %v", test.applied, err)
+		}
+	}
+}
+
+func TestArchivePathKeepsDirectories(t *testing.T) {
+	dirs := useMigrationDirs(t, nil, nil)
+
+	first := archivePath("archive/", dirs[0]+"order.txt")
+	second := archivePath("archive/", dirs[1]+"order.txt")
+	if first == second {
+		t.Errorf("order.txt of both directories archives to %s", first)
+	}
+
+	useMigrationDirs(t, nil)
+	if got := archivePath("archive/", "migrations/001_a.sql"); got != "archive/001_a.sql" {
+		t.Errorf("archivePath() with one directory = %s, want archive/001_a.sql", got)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// splitStatements splits SQL on top-level semicolons, ignoring those inside quotes and comments,
+// and drops statements that are only whitespace or comments
+func splitStatements(sql string) []string {
+	var (
+		statements []string
+		current    strings.Builder
+		hasCode    bool
+	)
+
+	flush := func() {
+		if hasCode {
+			statements = append(statements, strings.TrimSpace(current.String()))
+		}
+		current.Reset()
+		hasCode = false
+	}
+
+	for i := 0; i < len(sql); i++ {
+		c := sql[i]
+
+		switch {
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			end := strings.IndexByte(sql[i:], '\n')
+			if end < 0 {
+				end = len(sql) - i
+			}
+			current.WriteString(sql[i : i+end])
+			i += end - 1
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := strings.Index(sql[i+2:], "*/")
+			if end < 0 {
+				end = len(sql) - i - 2
+			} else {
+				end += 2
+			}
+			current.WriteString(sql[i : i+2+end])
+			i += 1 + end
+		case c == '\'' || c == '"' || c == '`':
+			// quoted string or identifier, backslash escapes and doubled quotes both stay inside
+			j := i + 1
+			for ; j < len(sql); j++ {
+				if sql[j] == '\\' {
+					j++
+					continue
+				}
+				if sql[j] == c {
+					if j+1 < len(sql) && sql[j+1] == c {
+						j++
+						continue
+					}
+					break
+				}
+			}
+			if j >= len(sql) {
+				j = len(sql) - 1
+			}
+			current.WriteString(sql[i : j+1])
+			hasCode = true
+			i = j
+		case c == ';':
+			flush()
+		default:
+			current.WriteByte(c)
+			if c != ' ' && c != '\t' && c != '\n' && c != '\r' {
+				hasCode = true
+			}
+		}
+	}
+	flush()
+
+	return statements
+}
+
+// multiStatementDirective marks a migration holding several statements, such as those written by migrate:diff
+const multiStatementDirective = "multi-statement"
+
+// migrationStatements returns the queries running a migration: each statement of one with a
+// "-- logme:multi-statement" header, ClickHouse only accepts one statement per query, otherwise the whole file
+func migrationStatements(sql string) []string {
+	if _, ok := readDirectives([]byte(sql))[multiStatementDirective]; ok {
+		return splitStatements(sql)
+	}
+	return []string{sql}
+}
+
+// execStatements runs the queries of a migration in order, see migrationStatements
+func execStatements(ctx context.Context, db driver.Conn, sql string) error {
+	for _, statement := range migrationStatements(sql) {
+		if err := db.Exec(ctx, statement); err != nil {
+			return err
+		}
+	}
+	return nil
+}
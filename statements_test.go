@@ -0,0 +1,48 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitStatements(t *testing.T) {
+	tests := []struct {
+		name string
+		sql  string
+		want []string
+	}{
+		{"one statement", "SELECT 1;", []string{"SELECT 1"}},
+		{"trailing statement without semicolon", "SELECT 1;\nSELECT 2\n", []string{"SELECT 1", "SELECT 2"}},
+		{"single quotes", "INSERT INTO t VALUES ('a;b');SELECT 2", []string{"INSERT INTO t VALUES ('a;b')", "SELECT 2"}},
+		{"escaped and doubled quotes", `SELECT 'it\'s;', 'it''s;';SELECT 2`, []string{`SELECT 'it\'s;', 'it''s;'`, "SELECT 2"}},
+		{"double quotes", `SELECT "a;b" FROM t;`, []string{`SELECT "a;b" FROM t`}},
+		{"backticks", "ALTER TABLE `a;b` ADD COLUMN c String;SELECT 2", []string{"ALTER TABLE `a;b` ADD COLUMN c String", "SELECT 2"}},
+		{"line comment", "-- drop; later\nSELECT 1;", []string{"-- drop; later\nSELECT 1"}},
+		{"block comment", "SELECT /* a; b */ 1;SELECT 2;", []string{"SELECT /* a; b */ 1", "SELECT 2"}},
+		{"comment only statements dropped", "SELECT 1;\n-- the end;\n/* nothing; */\n", []string{"SELECT 1"}},
+		{"empty statements dropped", ";;SELECT 1;;", []string{"SELECT 1"}},
+		{"unterminated quote", "SELECT 'a;b", []string{"SELECT 'a;b"}},
+	}
+
+	for _, test := range tests {
+		if got := splitStatements(test.sql); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: splitStatements(%q) = %q, want %q", test.name, test.sql, got, test.want)
+		}
+	}
+}
+
+func TestMigrationStatementsOnlySplitsMarkedMigrations(t *testing.T) {
+	single := "-- adds a column; keeps the rest\nALTER TABLE events ADD COLUMN a String;\n"
+	if got := migrationStatements(single); !reflect.DeepEqual(got, []string{single}) {
+		t.Errorf("migrationStatements() = %q, want the whole file as one query", got)
+	}
+
+	multi := "-- generated by migrate:diff\n-- logme:multi-statement\n\nALTER TABLE events ADD COLUMN a String;\n\nALTER TABLE events ADD COLUMN b String;\n"
+	want := []string{
+		"-- generated by migrate:diff\n-- logme:multi-statement\n\nALTER TABLE events ADD COLUMN a String",
+		"ALTER TABLE events ADD COLUMN b String",
+	}
+	if got := migrationStatements(multi); !reflect.DeepEqual(got, want) {
+		t.Errorf("migrationStatements() = %q, want %q", got, want)
+	}
+}
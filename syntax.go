@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// checkSyntax has ClickHouse parse every statement of the pending migrations with EXPLAIN AST, which runs nothing,
+// and reports all the statements that do not parse rather than stopping at the first
+func checkSyntax(ctx context.Context, db driver.Conn, opts migrateOptions) error {
+	var exists uint8
+	if err := db.QueryRow(ctx, "EXISTS TABLE "+opts.table).Scan(&exists); err != nil {
+		return err
+	}
+
+	var (
+		pending []string
+		err     error
+	)
+	if exists == 1 && !opts.stateless {
+		pending, err = pendingMigrations(ctx, db, opts.table)
+	} else {
+		pending, err = migrationFiles()
+	}
+	if err != nil {
+		return err
+	}
+
+	var failed []string
+	for _, name := range pending {
+		// scripts are programs, there is no SQL to parse
+		if isScriptMigration(name) {
+			continue
+		}
+
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return err
+		}
+		sql, err := renderMigration(name, content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		valid := true
+		for _, statement := range migrationStatements(string(sql)) {
+			if err := db.Exec(ctx, "EXPLAIN AST "+statement); err != nil {
+				fmt.Fprintln(opts.out, (&migrationError{name: name, err: err, verbose: opts.verboseErrors}).Error())
+				valid = false
+			}
+		}
+		if !valid {
+			failed = append(failed, name)
+		}
+	}
+
+	if len(failed) > 0 {
+		return &migrationError{err: fmt.Errorf("%d of %d pending migration(s) do not parse", len(failed), len(pending))}
+	}
+
+	fmt.Fprintf(opts.out, "Syntax OK: %d pending migration(s)\n", len(pending))
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// systemCommand is a named wrapper of the system command, args is how many arguments (table names) it takes
+type systemCommand struct {
+	statements  func(args []string) []string
+	args        int
+	destructive bool
+}
+
+var systemCommands = map[string]systemCommand{
+	"flush-logs": {
+		statements: func([]string) []string { return []string{"SYSTEM FLUSH LOGS"} },
+	},
+	"reload-config": {
+		statements: func([]string) []string { return []string{"SYSTEM RELOAD CONFIG"} },
+	},
+	// emptied caches make the following queries read from disk again
+	"drop-cache": {
+		statements:  func([]string) []string { return []string{"SYSTEM DROP MARK CACHE", "SYSTEM DROP UNCOMPRESSED CACHE"} },
+		destructive: true,
+	},
+	"restart-replica": {
+		statements:  func(args []string) []string { return []string{"SYSTEM RESTART REPLICA " + quoteIdentifier(args[0])} },
+		args:        1,
+		destructive: true,
+	},
+}
+
+// first words of the SYSTEM statements passed through that drop, stop or reset something
+var destructiveSystemStatements = []string{"DROP", "KILL", "RESTART", "RESTORE", "SHUTDOWN", "STOP", "UNFREEZE"}
+
+// system runs a named SYSTEM command of systemCommands, or any other arguments as a SYSTEM statement (e.g. "SYNC
+// REPLICA events"), destructive ones need force outside test databases
+func system(out io.Writer, isTest bool, args []string, force bool) error {
+	if len(args) == 0 || strings.TrimSpace(strings.Join(args, " ")) == "" {
+		names := make([]string, 0, len(systemCommands))
+		for name := range systemCommands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return configErrorf("system requires a COMMAND (%s) or a SYSTEM statement", strings.Join(names, ", "))
+	}
+
+	var (
+		statements  []string
+		destructive bool
+	)
+	if command, ok := systemCommands[args[0]]; ok {
+		if len(args)-1 != command.args {
+			return configErrorf("system %s takes %d argument(s), got %d", args[0], command.args, len(args)-1)
+		}
+		statements, destructive = command.statements(args[1:]), command.destructive
+	} else {
+		sql := strings.TrimSpace(strings.Join(args, " "))
+		if fields := strings.Fields(sql); strings.EqualFold(fields[0], "SYSTEM") {
+			sql = strings.TrimSpace(sql[len(fields[0]):])
+		}
+		if sql == "" {
+			return configErrorf("system requires a SYSTEM statement after SYSTEM")
+		}
+		statements = []string{"SYSTEM " + sql}
+		destructive = containsString(destructiveSystemStatements, strings.ToUpper(strings.Fields(sql)[0]))
+	}
+
+	if destructive {
+		if err := guardProfile(force); err != nil {
+			return err
+		}
+		if dbName := getDbName(isTest); !force && !isTestDatabase(dbName) {
+			return configErrorf("refusing to run %s against non-test database '%s' without --force", statements[0], dbName)
+		}
+	}
+
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	for _, sql := range statements {
+		start := time.Now()
+		if err := db.Exec(ctx, sql); err != nil {
+			return fmt.Errorf("%s: %w", sql, err)
+		}
+
+		fmt.Fprintf(out, "Ran: %s (%s)\n", sql, time.Since(start).Round(time.Millisecond))
+	}
+
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// tableSortKeys are the orders accepted by tables --sort
+var tableSortKeys = []string{"name", "rows", "size"}
+
+type tableSummary struct {
+	Name   string `json:"name"`
+	Engine string `json:"engine"`
+	Rows   uint64 `json:"rows"`
+	Bytes  uint64 `json:"bytes_on_disk"`
+}
+
+// tables lists the tables of the configured database with their engine and the rows and disk space of their active
+// parts, views and other tables without parts count as empty
+func tables(out io.Writer, isTest bool, sortBy string, format string) error {
+	if !containsString(tableSortKeys, sortBy) {
+		return configErrorf("invalid --sort '%s': expected name, rows or size", sortBy)
+	}
+
+	db, err := getReadonlyDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	// only the configured database is listed, so system and information_schema never show up
+	rows, err := db.Query(context.Background(), `
+		SELECT t.name, t.engine, p.rows, p.bytes
+		FROM system.tables AS t
+		LEFT JOIN (
+			SELECT table, sum(rows) AS rows, sum(bytes_on_disk) AS bytes
+			FROM system.parts
+			WHERE database = currentDatabase() AND active
+			GROUP BY table
+		) AS p ON p.table = t.name
+		WHERE t.database = currentDatabase()
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	summaries := []tableSummary{}
+	for rows.Next() {
+		var summary tableSummary
+		if err := rows.Scan(&summary.Name, &summary.Engine, &summary.Rows, &summary.Bytes); err != nil {
+			return err
+		}
+		summaries = append(summaries, summary)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// largest first for the sizes, alphabetical otherwise and between ties
+	sort.SliceStable(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		switch {
+		case sortBy == "rows" && a.Rows != b.Rows:
+			return a.Rows > b.Rows
+		case sortBy == "size" && a.Bytes != b.Bytes:
+			return a.Bytes > b.Bytes
+		}
+		return a.Name < b.Name
+	})
+
+	if format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(summaries)
+	}
+
+	if len(summaries) == 0 {
+		fmt.Fprintln(out, "No tables in database "+getDbName(isTest))
+		return nil
+	}
+
+	if format == "markdown" {
+		var cells [][]string
+		for _, summary := range summaries {
+			cells = append(cells, []string{summary.Name, summary.Engine, fmt.Sprint(summary.Rows), formatSize(summary.Bytes)})
+		}
+		return writeMarkdownTable(out, []string{"Table", "Engine", "Rows", "Size"}, cells)
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tENGINE\tROWS\tSIZE")
+	for _, summary := range summaries {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", summary.Name, summary.Engine, summary.Rows, formatSize(summary.Bytes))
+	}
+
+	return w.Flush()
+}
+
+// formatSize renders a byte count with a binary unit (e.g. 1.5 GiB)
+func formatSize(bytes uint64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	value, exponent := float64(bytes)/unit, 0
+	for value >= unit && exponent < 4 {
+		value /= unit
+		exponent++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exponent])
+}
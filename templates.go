@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"text/template"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// template migrations are SQL migrations rendered with text/template first, for values differing across replicas
+const templateMigrationSuffix = ".sql.tmpl"
+
+const defaultZKPrefix = "/clickhouse/tables"
+
+func isTemplateMigration(name string) bool {
+	return strings.HasSuffix(name, templateMigrationSuffix)
+}
+
+// migrationTemplate is the data of a template migration, the helpers read the environment only when used so a
+// template not referencing them does not need the variables
+type migrationTemplate struct {
+	// DB_SOURCE when {{.SourceDB}} was used, checked to exist by checkTemplates
+	source string
+}
+
+// Shard is DB_SHARD
+func (*migrationTemplate) Shard() (string, error) {
+	return requiredEnv("DB_SHARD")
+}
+
+// Replica is DB_REPLICA
+func (*migrationTemplate) Replica() (string, error) {
+	return requiredEnv("DB_REPLICA")
+}
+
+// SourceDB is DB_SOURCE quoted as an identifier, the database a backfill copies from (e.g. INSERT INTO events
+// SELECT * FROM {{.SourceDB}}.events)
+func (t *migrationTemplate) SourceDB() (string, error) {
+	source, err := requiredEnv("DB_SOURCE")
+	if err != nil {
+		return "", err
+	}
+	t.source = source
+
+	return quoteIdentifier(source), nil
+}
+
+// ZKPath is the keeper path of a replicated table, DB_ZK_PREFIX/<shard>/<table>
+func (t *migrationTemplate) ZKPath(table string) (string, error) {
+	shard, err := t.Shard()
+	if err != nil {
+		return "", err
+	}
+
+	prefix := os.Getenv("DB_ZK_PREFIX")
+	if prefix == "" {
+		prefix = defaultZKPrefix
+	}
+
+	return path.Join("/", prefix, shard, table), nil
+}
+
+func requiredEnv(name string) (string, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return "", fmt.Errorf("%s is not set", name)
+	}
+	return value, nil
+}
+
+// renderMigration returns the SQL of a migration, rendering template migrations and leaving others unchanged
+func renderMigration(name string, content []byte) ([]byte, error) {
+	if !isTemplateMigration(name) {
+		return content, nil
+	}
+
+	sql, _, err := renderTemplate(name, content)
+	return sql, err
+}
+
+func renderTemplate(name string, content []byte) ([]byte, *migrationTemplate, error) {
+	tmpl, err := template.New(name).Parse(string(content))
+	if err != nil {
+		return nil, nil, &configError{err: err}
+	}
+
+	data := &migrationTemplate{}
+	var sql bytes.Buffer
+	if err := tmpl.Execute(&sql, data); err != nil {
+		return nil, nil, &configError{err: err}
+	}
+
+	return sql.Bytes(), data, nil
+}
+
+// checkTemplates renders every template migration among names, reporting the first that cannot be rendered or
+// whose {{.SourceDB}} does not exist on the server
+func checkTemplates(ctx context.Context, db driver.Conn, names []string) error {
+	checked := map[string]bool{}
+
+	for _, name := range names {
+		if !isTemplateMigration(name) {
+			continue
+		}
+
+		content, err := os.ReadFile(migrationPath(name))
+		if err != nil {
+			return err
+		}
+		_, data, err := renderTemplate(name, content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+
+		if data.source == "" || checked[data.source] {
+			continue
+		}
+		var exists uint8
+		if err := db.QueryRow(ctx, "EXISTS DATABASE "+quoteIdentifier(data.source)).Scan(&exists); err != nil {
+			return err
+		}
+		if exists != 1 {
+			return configErrorf("%s: source database '%s' (DB_SOURCE) does not exist", name, data.source)
+		}
+		checked[data.source] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// testSummary counts the package results of plain go test output
+type testSummary struct {
+	passed  int
+	failed  []string
+	noTests int
+}
+
+// parseTestOutput reads the "ok", "FAIL" and "?" package lines go test prints once per package
+func parseTestOutput(output []byte) testSummary {
+	var summary testSummary
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 {
+			continue
+		}
+
+		switch fields[0] {
+		case "ok":
+			summary.passed++
+		case "?":
+			summary.noTests++
+		case "FAIL":
+			// a bare "FAIL" line closes the run of a failing package, "FAIL <pkg> <elapsed>" names it
+			summary.failed = append(summary.failed, fields[1])
+		}
+	}
+
+	return summary
+}
+
+func printTestSummary(w io.Writer, summary testSummary, elapsed time.Duration) {
+	total := summary.passed + len(summary.failed) + summary.noTests
+	fmt.Fprintf(w, "%d package(s): %d passed, %d failed, %d without tests in %s\n", total, summary.passed, len(summary.failed), summary.noTests, elapsed.Round(10*time.Millisecond))
+	for _, pkg := range summary.failed {
+		fmt.Fprintln(w, "FAIL: "+pkg)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+)
+
+// truncate empties the given tables, or with all every table holding data but the migrations table, on a pool of
+// concurrency workers. Every table is attempted before the failures are reported
+func truncate(out io.Writer, isTest bool, table string, tables []string, all bool, concurrency int, force bool) error {
+	if err := validateTableName(table); err != nil {
+		return err
+	}
+	if len(tables) == 0 && !all {
+		return configErrorf("truncate requires at least one TABLE or --all")
+	}
+	if concurrency < 1 {
+		return configErrorf("invalid --concurrency %d: expected at least 1", concurrency)
+	}
+	if err := guardProfile(force); err != nil {
+		return err
+	}
+	if dbName := getDbName(isTest); !force && !isTestDatabase(dbName) {
+		return configErrorf("refusing to truncate tables of non-test database '%s' without --force", dbName)
+	}
+
+	poolSize = concurrency
+	db, err := getDbConn(isTest)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if all {
+		if tables, err = dataTables(ctx, db, table); err != nil {
+			return err
+		}
+	}
+
+	out = &lockedWriter{w: out}
+	failures := forEachTable(tables, concurrency, func(name string) error {
+		start := time.Now()
+		if err := db.Exec(ctx, "TRUNCATE TABLE "+quoteIdentifier(name)); err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Truncated: %s (%s)\n", name, time.Since(start).Round(time.Millisecond))
+		return nil
+	})
+
+	return reportTableFailures(out, failures, len(tables))
+}
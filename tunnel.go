@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// how long ssh gets to authenticate and open the forwarded port
+const tunnelTimeout = 15 * time.Second
+
+// sshTunnel is an "ssh -N -L" process forwarding a local port to ClickHouse through a bastion host
+type sshTunnel struct {
+	cmd       *exec.Cmd
+	exited    chan error
+	localAddr string
+}
+
+// openSSHTunnel forwards localPort (a free port when 0) to the ClickHouse address through bastion (user@host) and
+// waits until the forwarded port accepts connections. The bastion reaches DB_ADDR (or DB_HOST), DB_LOCAL_ADDR is a
+// host-side address and is ignored
+func openSSHTunnel(bastion string, key string, localPort int) (*sshTunnel, error) {
+	target, err := getServerAddr()
+	if err != nil {
+		return nil, configErrorf("--ssh-tunnel requires DB_ADDR or DB_HOST, the address of ClickHouse as seen from %s", bastion)
+	}
+
+	if localPort == 0 {
+		if localPort, err = freePort(); err != nil {
+			return nil, err
+		}
+	}
+	localAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(localPort))
+
+	path, err := exec.LookPath("ssh")
+	if err != nil {
+		return nil, fmt.Errorf("ssh not found in PATH; install OpenSSH to use --ssh-tunnel")
+	}
+
+	args := []string{"-N", "-o", "ExitOnForwardFailure=yes", "-o", "BatchMode=yes", "-L", localAddr + ":" + target}
+	if key != "" {
+		args = append(args, "-i", key)
+	}
+	args = append(args, bastion)
+
+	cmd := exec.Command(path, args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	tunnel := &sshTunnel{cmd: cmd, exited: make(chan error, 1), localAddr: localAddr}
+	go func() { tunnel.exited <- cmd.Wait() }()
+
+	deadline := time.Now().Add(tunnelTimeout)
+	for {
+		select {
+		case err := <-tunnel.exited:
+			return nil, fmt.Errorf("ssh tunnel through %s exited: %v", bastion, err)
+		default:
+		}
+
+		if conn, err := net.DialTimeout("tcp", localAddr, time.Second); err == nil {
+			conn.Close()
+			return tunnel, nil
+		}
+
+		if time.Now().After(deadline) {
+			tunnel.close()
+			return nil, fmt.Errorf("ssh tunnel through %s did not open %s within %s", bastion, localAddr, tunnelTimeout)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func (t *sshTunnel) close() {
+	t.cmd.Process.Kill()
+	<-t.exited
+}
+
+func freePort() (int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	return listener.Addr().(*net.TCPAddr).Port, nil
+}
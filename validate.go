@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// migrateValidate applies every migration to a new database with a random name, dropped afterwards whatever the
+// outcome unless keep is set, to check the migrations work from scratch
+func migrateValidate(opts migrateOptions, keep bool) error {
+	if err := validateTableName(opts.table); err != nil {
+		return err
+	}
+
+	// the temporary database does not exist yet, so connect to the one every server has
+	dbName := os.Getenv("DB_NAME")
+	defer os.Setenv("DB_NAME", dbName)
+	os.Setenv("DB_NAME", "default")
+
+	admin, err := getDbConn(false)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	tempName := "logme_validate_" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+	if err := admin.Exec(ctx, "CREATE DATABASE "+quoteIdentifier(tempName)); err != nil {
+		return err
+	}
+	fmt.Fprintln(opts.out, "Created temporary database: "+tempName)
+
+	defer func() {
+		if keep {
+			fmt.Fprintln(opts.out, "Kept temporary database: "+tempName)
+			return
+		}
+		if dropErr := admin.Exec(ctx, "DROP DATABASE "+quoteIdentifier(tempName)+" SYNC"); dropErr != nil {
+			fmt.Fprintln(opts.out, "warning: could not drop temporary database "+tempName+": "+dropErr.Error())
+			return
+		}
+		fmt.Fprintln(opts.out, "Dropped temporary database: "+tempName)
+	}()
+
+	os.Setenv("DB_NAME", tempName)
+
+	if err := migrate(false, opts); err != nil {
+		fmt.Fprintln(opts.out, "Validation failed: the migrations do not apply to an empty database")
+		return err
+	}
+
+	fmt.Fprintln(opts.out, "Validation passed: every migration applies to an empty database")
+
+	return nil
+}
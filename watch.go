@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+	"github.com/fsnotify/fsnotify"
+)
+
+// editors save in several steps (temp file, rename, chmod), wait for them to settle before migrating
+const watchDebounce = 500 * time.Millisecond
+
+// watchMigrations re-runs the pending migrations whenever a migration file is created or changed, until interrupted
+func watchMigrations(db driver.Conn, opts migrateOptions) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	for _, dir := range migrationDirs {
+		if err := watcher.Add(dir); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintln(opts.out, "Watching "+strings.Join(migrationDirs, ", ")+" for new migrations, press Ctrl+C to stop")
+
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			name := filepath.Base(event.Name)
+			if !isMigrationFile(name) || isDownMigration(name) {
+				continue
+			}
+			if event.Op&(fsnotify.Create|fsnotify.Write|fsnotify.Rename) != 0 {
+				debounce.Reset(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			return err
+		case <-debounce.C:
+			// a failing migration is reported and retried on the next save rather than ending the watch
+			if err := runMigrations(db, opts); err != nil {
+				fmt.Fprintln(opts.out, "error: "+err.Error())
+			}
+		}
+	}
+}